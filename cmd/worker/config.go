@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/opsee/basic/schema"
+	log "github.com/opsee/logrus"
+	"github.com/opsee/marktricks/service"
+	"github.com/opsee/marktricks/worker"
+	"github.com/spf13/viper"
+)
+
+// initConfig reads settings from the environment and the optional config file,
+// and sets the defaults of everything not set.
+func initConfig() {
+	viper.SetEnvPrefix("marktricks")
+	viper.AutomaticEnv()
+
+	// structured settings such as tag rules come from an optional config file
+	viper.SetConfigName("marktricks")
+	viper.AddConfigPath("/etc/marktricks")
+	viper.AddConfigPath(".")
+	if configFile := viper.GetString("config"); configFile != "" {
+		viper.SetConfigFile(configFile)
+	}
+	// viper reports a missing config file as an unsupported config type, but
+	// only sets the file used once one is found
+	if err := viper.ReadInConfig(); err != nil && viper.ConfigFileUsed() != "" {
+		log.WithError(err).Fatal("Couldn't read config file.")
+	}
+
+	viper.SetDefault("log_level", "info")
+	logLevelStr := viper.GetString("log_level")
+	logLevel, err := log.ParseLevel(logLevelStr)
+	if err != nil {
+		log.WithError(err).Error("Could not parse log level, using default.")
+		logLevel = log.InfoLevel
+	}
+	log.SetLevel(logLevel)
+
+	viper.SetDefault("kairosdb_address", "http://172.30.200.227:8080")
+	viper.SetDefault("address", ":9111")
+	viper.SetDefault("health_address", ":9112")
+	viper.SetDefault("shutdown_timeout", "30s")
+	viper.SetDefault("store", "kairosdb")
+	viper.SetDefault("kairosdb_telnet_address", "172.30.200.227:4242")
+	viper.SetDefault("kairosdb_telnet_pool_size", 4)
+	viper.SetDefault("kairosdb_gzip_threshold", 1000)
+
+	viper.SetDefault("batch_size", 500)
+	viper.SetDefault("batch_flush_interval", "1s")
+	viper.SetDefault("requeue_max_attempts", 10)
+	viper.SetDefault("requeue_base_delay", "5s")
+	viper.SetDefault("requeue_max_delay", "5m")
+	viper.SetDefault("deadletter_topic", "marktricks.deadletter")
+	viper.SetDefault("quarantine_topic", "marktricks.quarantine")
+	viper.SetDefault("spool_max_size", "1GB")
+	viper.SetDefault("spool_max_age", "24h")
+	viper.SetDefault("spool_slow_threshold", "10s")
+	viper.SetDefault("spool_recovery_interval", "10s")
+	// raw check results are only archived if archive_dir is set
+	viper.SetDefault("archive_file_size", "64MB")
+	viper.SetDefault("archive_file_age", "1h")
+	viper.SetDefault("archive_max_open_files", 256)
+
+	// messages are held in flight until their batch is written, so this bounds
+	// how many results a single batch can contain.
+	viper.SetDefault("max_in_flight", 64)
+	viper.SetDefault("nsq_topics", []string{"_.results"})
+	viper.SetDefault("nsq_channel", "marktricks-worker")
+	viper.SetDefault("cardinality_window", "24h")
+	viper.SetDefault("cardinality_customer_limit", 100000)
+	viper.SetDefault("cardinality_metric_limit", 20000)
+	viper.SetDefault("cardinality_action", worker.CardinalityCollapse)
+	viper.SetDefault("cardinality_tags", []string{"target", "target_addr"})
+	viper.SetDefault("cardinality_customer_tag", "customer")
+	viper.SetDefault("retention_query_mode", service.RetentionClamp)
+	viper.SetDefault("rollup_metrics", []string{"request_latency"})
+	viper.SetDefault("rollup_resolutions", []string{"1m", "1h", "24h"})
+	viper.SetDefault("rollup_interval", "1m")
+	viper.SetDefault("rollup_delay", "2m")
+	viper.SetDefault("rollup_lookback", "24h")
+	viper.SetDefault("rollup_routing", true)
+	viper.SetDefault("shadow_sample_rate", 0.01)
+	viper.SetDefault("shadow_tolerance", 0.001)
+	viper.SetDefault("shadow_max_in_flight", 4)
+}
+
+// tagRules returns the configured tag rules, or the defaults.
+func tagRules() ([]*worker.TagRule, error) {
+	if !viper.IsSet("tags") {
+		return worker.DefaultTagRules(), nil
+	}
+
+	var rules []*worker.TagRule
+	if err := viper.UnmarshalKey("tags", &rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+type extractorRegistry interface {
+	Register(reply interface{}, extractor worker.Extractor)
+}
+
+func registerExtractors(r extractorRegistry) {
+	r.Register(&schema.CheckResponse_HttpResponse{}, worker.NewHTTPExtractor(viper.GetStringSlice("http_metrics_allow"), viper.GetStringSlice("http_metrics_deny")))
+	r.Register(&schema.CheckResponse_CloudwatchResponse{}, worker.NewCloudWatchExtractor())
+}
+
+func retentionConfig() (*worker.RetentionConfig, error) {
+	config := &worker.RetentionConfig{
+		Customers:   make(map[string]time.Duration),
+		CustomerTag: viper.GetString("cardinality_customer_tag"),
+	}
+
+	var err error
+	if r := viper.GetString("retention_default"); r != "" {
+		if config.Default, err = worker.ParseRetention(r); err != nil {
+			return nil, fmt.Errorf("invalid default retention: %s", err)
+		}
+	}
+	for customerID, r := range viper.GetStringMapString("retention_customers") {
+		if config.Customers[customerID], err = worker.ParseRetention(r); err != nil {
+			return nil, fmt.Errorf("invalid retention for customer %s: %s", customerID, err)
+		}
+	}
+
+	return config, nil
+}
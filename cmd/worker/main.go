@@ -1,66 +1,246 @@
 package main
 
 import (
+	"expvar"
+	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
-	builder "github.com/dan-compton/go-kairosdb/builder"
-	client "github.com/dan-compton/go-kairosdb/client"
 	"github.com/gogo/protobuf/proto"
 	_ "github.com/lib/pq"
 	"github.com/nsqio/go-nsq"
 	"github.com/opsee/basic/schema"
 	log "github.com/opsee/logrus"
+	"github.com/opsee/marktricks/rollup"
 	"github.com/opsee/marktricks/service"
+	"github.com/opsee/marktricks/store"
 	"github.com/opsee/marktricks/worker"
 	"github.com/spf13/viper"
 )
 
 func main() {
-	viper.SetEnvPrefix("marktricks")
-	viper.AutomaticEnv()
-
-	viper.SetDefault("log_level", "info")
-	logLevelStr := viper.GetString("log_level")
-	logLevel, err := log.ParseLevel(logLevelStr)
-	if err != nil {
-		log.WithError(err).Error("Could not parse log level, using default.")
-		logLevel = log.InfoLevel
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "quarantine":
+			os.Exit(quarantineCommand(os.Args[2:]))
+		case "replay":
+			os.Exit(replayCommand(os.Args[2:]))
+		}
 	}
-	log.SetLevel(logLevel)
 
-	viper.SetDefault("kairosdb_address", "http://172.30.200.227:8080")
-	viper.SetDefault("address", ":9111")
-	viper.SetDefault("health_address", ":9112")
-	kdbAddr := viper.GetString("kairosdb_address")
+	initConfig()
 
-	nsqConfig := nsq.NewConfig()
-	nsqConfig.MaxInFlight = 4
+	nsqdAddrs := viper.GetStringSlice("nsqd_addrs")
+	if len(nsqdAddrs) == 0 && viper.GetString("nsqd_host") != "" {
+		nsqdAddrs = []string{viper.GetString("nsqd_host")}
+	}
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
+	// one consumer per topic, e.g. to split staging and production results
 	maxTasks := viper.GetInt("max_tasks")
-	consumer, err := worker.NewConsumer(&worker.ConsumerConfig{
-		Topic:            "_.results",
-		Channel:          "marktricks-worker",
-		LookupdAddresses: viper.GetStringSlice("nsqlookupd_addrs"),
-		NSQConfig:        nsqConfig,
-		HandlerCount:     maxTasks,
+	var consumers []worker.Consumer
+	for _, topic := range viper.GetStringSlice("nsq_topics") {
+		nsqConfig := nsq.NewConfig()
+		nsqConfig.MaxInFlight = viper.GetInt("max_in_flight")
+
+		consumer, err := worker.NewConsumer(&worker.ConsumerConfig{
+			Topic:            topic,
+			Channel:          viper.GetString("nsq_channel"),
+			LookupdAddresses: viper.GetStringSlice("nsqlookupd_addrs"),
+			NSQDAddresses:    nsqdAddrs,
+			NSQConfig:        nsqConfig,
+			HandlerCount:     maxTasks,
+		})
+
+		if err != nil {
+			log.WithError(err).Fatal("Failed to create consumer.")
+		}
+		consumers = append(consumers, consumer)
+	}
+
+	rules, err := tagRules()
+	if err != nil {
+		log.WithError(err).Fatal("Couldn't parse tag rules.")
+	}
+
+	tagMapper, err := worker.NewTagMapper(rules)
+	if err != nil {
+		log.WithError(err).Fatal("Invalid tag rules.")
+	}
+	log.Infof("tagging series with required tags %v", tagMapper.Required())
+
+	extractors := worker.NewRegistry(tagMapper)
+	registerExtractors(extractors)
+
+	guard, err := worker.NewCardinalityGuard(&worker.CardinalityConfig{
+		Window:        viper.GetDuration("cardinality_window"),
+		CustomerLimit: viper.GetInt("cardinality_customer_limit"),
+		MetricLimit:   viper.GetInt("cardinality_metric_limit"),
+		Action:        viper.GetString("cardinality_action"),
+		Tags:          viper.GetStringSlice("cardinality_tags"),
+		CustomerTag:   viper.GetString("cardinality_customer_tag"),
 	})
+	if err != nil {
+		log.WithError(err).Fatal("Invalid cardinality config.")
+	}
 
+	rc, err := retentionConfig()
 	if err != nil {
-		log.WithError(err).Fatal("Failed to create consumer.")
+		log.WithError(err).Fatal("Invalid retention config.")
+	}
+	retention := worker.NewRetentionPolicy(rc)
+
+	var deadLetters worker.DeadLetterSink
+	if nsqdHost := viper.GetString("nsqd_host"); nsqdHost != "" {
+		deadLetters, err = worker.NewNSQDeadLetterSink(nsqdHost, viper.GetString("deadletter_topic"))
+		if err != nil {
+			log.WithError(err).Fatal("Failed to create dead letter sink.")
+		}
+	}
+
+	responder := worker.NewResponder(&worker.ResponderConfig{
+		MaxAttempts: uint16(viper.GetInt("requeue_max_attempts")),
+		BaseDelay:   viper.GetDuration("requeue_base_delay"),
+		MaxDelay:    viper.GetDuration("requeue_max_delay"),
+		DeadLetters: deadLetters,
+	})
+
+	// malformed results are quarantined to a local file if one is configured,
+	// otherwise to an nsq topic
+	var quarantineSink worker.DeadLetterSink
+	if quarantineFile := viper.GetString("quarantine_file"); quarantineFile != "" {
+		quarantineSink, err = worker.NewFileDeadLetterSink(quarantineFile)
+		if err != nil {
+			log.WithError(err).Fatal("Failed to open quarantine file.")
+		}
+	} else if nsqdHost := viper.GetString("nsqd_host"); nsqdHost != "" {
+		quarantineSink, err = worker.NewNSQDeadLetterSink(nsqdHost, viper.GetString("quarantine_topic"))
+		if err != nil {
+			log.WithError(err).Fatal("Failed to create quarantine sink.")
+		}
+	} else {
+		// the responder would fall back to logging them, losing them for good
+		log.Fatal("Malformed results can't be quarantined, set quarantine_file or nsqd_host.")
+	}
+
+	quarantine := worker.NewResponder(&worker.ResponderConfig{
+		DeadLetters: quarantineSink,
+	})
+
+	configs, err := sinkConfigs()
+	if err != nil {
+		log.WithError(err).Fatal("Couldn't parse sinks.")
+	}
+	if err := checkTelnetRetention(configs, rc); err != nil {
+		log.WithError(err).Fatal("Invalid sinks.")
+	}
+	sinks, err := newSinks(configs)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to create sinks.")
+	}
+
+	writer, err := worker.NewFanoutWriter(&worker.FanoutConfig{Sinks: sinks})
+	if err != nil {
+		log.WithError(err).Fatal("Failed to create writer.")
+	}
+	writer.Start()
+
+	// queries and rollups read from the first primary sink
+	var st store.Store
+	for _, sink := range sinks {
+		if sink.Primary {
+			st = sink.Store
+			break
+		}
+	}
+
+	expvar.Publish("sinks", expvar.Func(func() interface{} {
+		return writer.Stats()
+	}))
+	expvar.Publish("spool", expvar.Func(func() interface{} {
+		segments, bytes := writer.SpoolDepth()
+		return map[string]int64{
+			"segments": int64(segments),
+			"bytes":    bytes,
+		}
+	}))
+
+	var producers []stopper
+	for _, consumer := range consumers {
+		producers = append(producers, consumer)
+	}
+
+	var resolutions []time.Duration
+	for _, r := range viper.GetStringSlice("rollup_resolutions") {
+		res, err := time.ParseDuration(r)
+		if err != nil {
+			log.WithError(err).Fatal("Invalid rollup resolution.")
+		}
+		resolutions = append(resolutions, res)
+	}
+
+	// rollups should only run on one worker
+	if viper.GetBool("rollup_enabled") {
+
+		roller := rollup.New(&rollup.Config{
+			Store:       st,
+			Writer:      writer,
+			Retention:   retention,
+			Metrics:     viper.GetStringSlice("rollup_metrics"),
+			Resolutions: resolutions,
+			Interval:    viper.GetDuration("rollup_interval"),
+			Delay:       viper.GetDuration("rollup_delay"),
+			Lookback:    viper.GetDuration("rollup_lookback"),
+		})
+		roller.Start()
+		producers = append(producers, roller)
+	}
+
+	ingesterConfig := &worker.IngesterConfig{
+		Extractors:  extractors,
+		TagMapper:   tagMapper,
+		Guard:       guard,
+		Retention:   retention,
+		Writer:      writer,
+		CustomerTag: viper.GetString("cardinality_customer_tag"),
+	}
+
+	// raw results are archived for replays, stopped once nothing is ingesting
+	var closers []stopper
+	if archiveDir := viper.GetString("archive_dir"); archiveDir != "" {
+		archive, err := worker.NewArchive(&worker.ArchiveConfig{
+			Dir:          archiveDir,
+			FileBytes:    int64(viper.GetSizeInBytes("archive_file_size")),
+			FileAge:      viper.GetDuration("archive_file_age"),
+			MaxOpenFiles: viper.GetInt("archive_max_open_files"),
+		})
+		if err != nil {
+			log.WithError(err).Fatal("Failed to open archive.")
+		}
+		archive.Start()
+		ingesterConfig.Archive = archive
+		closers = append(closers, archive)
+
+		expvar.Publish("archive", expvar.Func(func() interface{} {
+			return archive.Stats()
+		}))
 	}
 
-	cli := client.NewHttpClient(kdbAddr)
-	consumer.AddHandler(func(msg *nsq.Message) error {
+	ingester := worker.NewIngester(ingesterConfig)
+
+	handler := func(msg *nsq.Message) error {
 		result := &schema.CheckResult{}
 		if err := proto.Unmarshal(msg.Body, result); err != nil {
 			log.WithError(err).Error("Error unmarshalling message from NSQ.")
-			return err
+			msg.DisableAutoResponse()
+			quarantine.DeadLetter(msg, fmt.Sprintf("unmarshal: %s", err))
+			return nil
 		}
 
 		logger := log.WithFields(log.Fields{
@@ -69,89 +249,150 @@ func main() {
 			"bastion_id":  result.BastionId,
 		})
 
-		if result.CustomerId == "" || result.CheckId == "" {
-			logger.Error("Received invalid check result.")
-			return nil
+		// the message is finished once its batch has been written to the
+		// primary sinks
+		msg.DisableAutoResponse()
+		ingest := ingester.IngestResult
+		if msg.Attempts > 1 {
+			// archived when first delivered
+			ingest = ingester.RetryResult
 		}
-
-		mb := builder.NewMetricBuilder()
-		for _, resp := range result.Responses {
-			switch t := resp.Reply.(type) {
-			case *schema.CheckResponse_HttpResponse:
-				for _, m := range t.HttpResponse.Metrics {
-					switch m.Name {
-					case "request_latency":
-
-						if resp.Target == nil {
-							logger.Error("Nil target")
-							return nil
-						}
-						tags := map[string]string{
-							"check":       result.CheckId,
-							"customer":    result.CustomerId,
-							"target":      resp.Target.Id,
-							"target_name": resp.Target.Name,
-							"target_type": resp.Target.Type,
-							"target_addr": resp.Target.Address,
-							"region":      result.Region,
-						}
-
-						vtags := 0
-						nm := builder.NewMetric("request_latency").AddDataPoint(result.Timestamp.Millis(), m.Value)
-						for k, v := range tags {
-							if len(v) > 0 {
-								vtags += 1
-								nm.AddTag(k, v)
-							}
-						}
-
-						// no tags, disregard result
-						if vtags > 0 {
-							mb.AddRealMetric(nm)
-						} else {
-							logger.Warn("no valid tags found for metric")
-						}
-
-					default:
-						logger.Debugf("unsupported metric type: %s", m.Name)
-						return nil
-					}
-				}
-			default:
-				logger.Debugf("unsupported check type: %s", t)
-				return nil
+		_, err := ingest(result, func(err error) {
+			if err != nil {
+				logger.WithError(err).Error("failed to push metrics")
 			}
-		}
-
-		_, err := cli.PushMetrics(mb)
+			responder.Respond(msg, err)
+		})
 		if err != nil {
-			log.WithError(err).Error("failed to push metrics to kairosdb")
+			logger.WithError(err).Error("Received invalid check result.")
+			quarantine.DeadLetter(msg, err.Error())
 		}
 
 		return nil
-	})
+	}
 
-	if err := consumer.Start(); err != nil {
-		log.WithError(err).Fatal("Failed to start consumer.")
+	for _, consumer := range consumers {
+		consumer.AddHandler(handler)
+		if err := consumer.Start(); err != nil {
+			log.WithError(err).Fatal("Failed to start consumer.")
+		}
 	}
 
 	go func() {
 		for {
-			consumer.Info()
+			for _, consumer := range consumers {
+				consumer.Info()
+			}
+			for name, stats := range writer.Stats() {
+				log.Infof("(Sink %s) Written: %d, Failed: %d, Dropped: %d, Queued: %d, Lag: %dms, Spool Segments: %d, Spool Bytes: %d", name, stats.Written, stats.Failed, stats.Dropped, stats.Queued, stats.LagMillis, stats.SpoolSegments, stats.SpoolBytes)
+			}
 			time.Sleep(time.Second * 10)
 		}
 	}()
 
+	// expvar stats, e.g. spool depth, for alerting
+	go func() {
+		log.WithError(http.ListenAndServe(viper.GetString("health_address"), nil)).Error("Error in health listener")
+	}()
+
 	// grpc server for kdb queries
-	svc, err := service.New(viper.GetString("kairosdb_address"))
+	var router service.Router
+	if viper.GetBool("rollup_routing") {
+		router = rollup.NewRouter(&rollup.RouterConfig{
+			Store:       st,
+			Metrics:     viper.GetStringSlice("rollup_metrics"),
+			Resolutions: resolutions,
+		})
+	}
+
+	// shadow reads compare the answers of another sink, e.g. one being migrated to
+	var shadow *service.ShadowConfig
+	if name := viper.GetString("shadow_sink"); name != "" {
+		for _, sink := range sinks {
+			if sink.Name == name {
+				shadow = &service.ShadowConfig{
+					Store:       sink.Store,
+					SampleRate:  viper.GetFloat64("shadow_sample_rate"),
+					Tolerance:   viper.GetFloat64("shadow_tolerance"),
+					MaxInFlight: viper.GetInt("shadow_max_in_flight"),
+				}
+			}
+		}
+		if shadow == nil {
+			log.Fatalf("Unknown shadow sink: %s", name)
+		}
+	}
+
+	svc, err := service.New(&service.Config{
+		Store:         st,
+		Cardinality:   guard,
+		Retention:     retention,
+		RetentionMode: viper.GetString("retention_query_mode"),
+		CustomerTag:   viper.GetString("cardinality_customer_tag"),
+		Rollups:       router,
+		Shadow:        shadow,
+		Ingester:      ingester,
+	})
 	if err != nil {
 		log.WithError(err).Fatal("unable to start service")
 	}
+	expvar.Publish("shadow", expvar.Func(func() interface{} {
+		return svc.ShadowStats()
+	}))
+
 	go func() {
-		log.WithError(svc.StartMux(viper.GetString("address"), viper.GetString("cert"), viper.GetString("cert_key"))).Fatal("Error in listener")
+		if err := svc.StartMux(viper.GetString("address"), viper.GetString("cert"), viper.GetString("cert_key")); err != nil {
+			log.WithError(err).Fatal("Error in listener")
+		}
 	}()
 
 	<-sigChan
+	shutdown(producers, writer, svc, closers, viper.GetDuration("shutdown_timeout"))
+}
+
+type stopper interface {
+	Stop(timeout time.Duration) error
+}
+
+// shutdown stops consuming, serving and rolling up, waits for in-flight
+// messages and requests to be handled and their metrics flushed, then stops
+// closers, e.g. the archive, all within timeout. The writer keeps flushing
+// while producers drain, since in-flight messages are only finished once their
+// batch is written.
+func shutdown(producers []stopper, writer, svc stopper, closers []stopper, timeout time.Duration) {
+	log.Infof("shutting down, waiting up to %s", timeout)
+	deadline := time.Now().Add(timeout)
+
+	var wg sync.WaitGroup
+	for _, producer := range producers {
+		wg.Add(1)
+		go func(p stopper) {
+			defer wg.Done()
+			if err := p.Stop(deadline.Sub(time.Now())); err != nil {
+				log.WithError(err).Error("Failed to stop cleanly.")
+			}
+		}(producer)
+	}
+
+	// requests ingesting over http and rpc wait on the writer like messages
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := svc.Stop(deadline.Sub(time.Now())); err != nil {
+			log.WithError(err).Error("Failed to stop service cleanly.")
+		}
+	}()
+	wg.Wait()
+
+	if err := writer.Stop(deadline.Sub(time.Now())); err != nil {
+		log.WithError(err).Error("Failed to flush pending metrics.")
+	}
+
+	for _, c := range closers {
+		if err := c.Stop(deadline.Sub(time.Now())); err != nil {
+			log.WithError(err).Error("Failed to stop cleanly.")
+		}
+	}
 
-	consumer.Stop()
+	log.Info("shutdown complete")
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/nsqio/go-nsq"
+	"github.com/opsee/basic/schema"
+	"github.com/opsee/marktricks/pb"
+	"github.com/opsee/marktricks/worker"
+)
+
+const quarantineUsage = `usage: worker quarantine <inspect|reinject> [flags] <file>
+
+  inspect   print every quarantined message in the file
+  reinject  publish quarantined messages back to nsq
+
+<file> is a worker's quarantine_file. Messages quarantined to the nsq
+quarantine_topic are dead letter protobufs, one per message.
+`
+
+// quarantineCommand inspects and re-injects messages quarantined to a file.
+func quarantineCommand(args []string) int {
+	if len(args) < 1 {
+		fmt.Fprint(os.Stderr, quarantineUsage)
+		return 2
+	}
+
+	fs := flag.NewFlagSet("quarantine "+args[0], flag.ContinueOnError)
+	reason := fs.String("reason", "", "only messages whose rejection reason contains this")
+	verbose := fs.Bool("v", false, "print the decoded check result (inspect)")
+	nsqdAddr := fs.String("nsqd", os.Getenv("MARKTRICKS_NSQD_HOST"), "nsqd address to publish to (reinject)")
+	topic := fs.String("topic", "_.results", "topic to publish to (reinject)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	if fs.NArg() != 1 {
+		fmt.Fprint(os.Stderr, quarantineUsage)
+		return 2
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer f.Close()
+
+	matches := func(letter *pb.DeadLetter) bool {
+		return strings.Contains(letter.Reason, *reason)
+	}
+
+	switch args[0] {
+	case "inspect":
+		err = worker.ReadDeadLetters(f, func(letter *pb.DeadLetter) error {
+			if !matches(letter) {
+				return nil
+			}
+
+			fmt.Printf("%s\t%q\tattempts=%d\tbytes=%d", letter.Timestamp.Time().Format("2006-01-02T15:04:05Z07:00"), letter.Reason, letter.Attempts, len(letter.Body))
+
+			result := &schema.CheckResult{}
+			if err := proto.Unmarshal(letter.Body, result); err != nil {
+				fmt.Println("\tundecodable")
+				return nil
+			}
+
+			fmt.Printf("\tcustomer_id=%s\tcheck_id=%s\n", result.CustomerId, result.CheckId)
+			if *verbose {
+				fmt.Println(proto.MarshalTextString(result))
+			}
+			return nil
+		})
+
+	case "reinject":
+		if *nsqdAddr == "" {
+			fmt.Fprintln(os.Stderr, "an nsqd address is required to reinject")
+			return 2
+		}
+
+		var producer *nsq.Producer
+		producer, err = nsq.NewProducer(*nsqdAddr, nsq.NewConfig())
+		if err != nil {
+			break
+		}
+		defer producer.Stop()
+
+		count := 0
+		err = worker.ReadDeadLetters(f, func(letter *pb.DeadLetter) error {
+			if !matches(letter) {
+				return nil
+			}
+
+			if err := producer.Publish(*topic, letter.Body); err != nil {
+				return err
+			}
+			count++
+			return nil
+		})
+		fmt.Printf("reinjected %d messages to %s\n", count, *topic)
+
+	default:
+		fmt.Fprint(os.Stderr, quarantineUsage)
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	builder "github.com/dan-compton/go-kairosdb/builder"
+	"github.com/opsee/basic/schema"
+	log "github.com/opsee/logrus"
+	"github.com/opsee/marktricks/worker"
+	"github.com/spf13/viper"
+)
+
+const replayUsage = `usage: worker replay [flags] <file>...
+
+Extracts the metrics of check results read from files, - for stdin, and writes
+them to the configured sinks. Files hold length delimited protobufs, or JSON
+lines if named *.json, *.jsonl or *.ndjson, and may be gzipped. Directories are
+read as archives, or a customer's part of one, replaying the archived files
+that overlap -start and -end.
+
+`
+
+// replayCommand rebuilds history from archived check results.
+func replayCommand(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	customers := fs.String("customer", "", "only results of these comma separated customer ids")
+	checks := fs.String("check", "", "only results of these comma separated check ids")
+	start := fs.String("start", "", "only results at or after this RFC3339 time")
+	end := fs.String("end", "", "only results before this RFC3339 time")
+	format := fs.String("format", "", "delimited or json, by default from each file's name")
+	rate := fs.Float64("rate", 1000, "most metrics written per second, 0 for no limit")
+	dryRun := fs.Bool("dry-run", false, "print the datapoints that would be written instead")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, replayUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	filter, err := newReplayFilter(*customers, *checks, *start, *end)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	initConfig()
+
+	rules, err := tagRules()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "couldn't parse tag rules:", err)
+		return 1
+	}
+	tagMapper, err := worker.NewTagMapper(rules)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid tag rules:", err)
+		return 1
+	}
+	extractors := worker.NewRegistry(tagMapper)
+	registerExtractors(extractors)
+
+	rc, err := retentionConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var writer replayWriter = &printWriter{out: os.Stdout}
+	if !*dryRun {
+		configs, err := sinkConfigs()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "couldn't parse sinks:", err)
+			return 1
+		}
+		if err := checkTelnetRetention(configs, rc); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		// the spools belong to the running worker
+		for i := range configs {
+			configs[i].SpoolDir = ""
+		}
+
+		sinks, err := newSinks(configs)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		fanout, err := worker.NewFanoutWriter(&worker.FanoutConfig{Sinks: sinks})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fanout.Start()
+		writer = fanout
+	}
+
+	// the cardinality guard tracks live ingest, backfills aren't limited by it
+	ingester := worker.NewIngester(&worker.IngesterConfig{
+		Extractors:  extractors,
+		TagMapper:   tagMapper,
+		Retention:   worker.NewRetentionPolicy(rc),
+		Writer:      writer,
+		CustomerTag: viper.GetString("cardinality_customer_tag"),
+	})
+
+	var (
+		stats   replayStats
+		pending sync.WaitGroup
+		limiter = &rateLimiter{rate: *rate, start: time.Now()}
+	)
+	replay := func(result *schema.CheckResult) error {
+		stats.read++
+		if !filter.matches(result) {
+			stats.skipped++
+			return nil
+		}
+
+		pending.Add(1)
+		n, err := ingester.IngestResult(result, func(err error) {
+			if err != nil {
+				log.WithError(err).Errorf("failed to write metrics of check %s at %s", result.CheckId, result.Timestamp.Time())
+				atomic.AddInt64(&stats.failed, 1)
+			}
+			pending.Done()
+		})
+		if err != nil {
+			pending.Done()
+			stats.invalid++
+			log.WithError(err).Warnf("skipping invalid result of check %s", result.CheckId)
+			return nil
+		}
+
+		stats.replayed++
+		stats.metrics += int64(n)
+		limiter.wait(n)
+		return nil
+	}
+
+	paths, err := replayPaths(fs.Args(), filter)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	status := 0
+	for _, path := range paths {
+		if err := replayFile(path, *format, replay); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+			status = 1
+		}
+	}
+
+	pending.Wait()
+	if err := writer.Stop(viper.GetDuration("shutdown_timeout")); err != nil {
+		fmt.Fprintln(os.Stderr, "failed to flush metrics:", err)
+		status = 1
+	}
+
+	// secondary sinks drop batches rather than slow the replay down
+	if fanout, ok := writer.(interface {
+		Stats() map[string]worker.SinkStats
+	}); ok {
+		for name, s := range fanout.Stats() {
+			if s.Dropped > 0 {
+				fmt.Fprintf(os.Stderr, "sink %s dropped %d metrics\n", name, s.Dropped)
+				status = 1
+			}
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "read %d results, replayed %d with %d metrics, skipped %d, invalid %d, failed to write %d\n",
+		stats.read, stats.replayed, stats.metrics, stats.skipped, stats.invalid, stats.failed)
+	if stats.failed > 0 {
+		status = 1
+	}
+
+	return status
+}
+
+type replayStats struct {
+	read, replayed, skipped, invalid, metrics int64
+	// failed is updated by writers' done funcs
+	failed int64
+}
+
+// replayPaths expands archive directories into their files in range.
+func replayPaths(args []string, filter *replayFilter) ([]string, error) {
+	var paths []string
+	for _, arg := range args {
+		fi, err := os.Stat(arg)
+		if err != nil || !fi.IsDir() {
+			// a missing file is reported when it's replayed
+			paths = append(paths, arg)
+			continue
+		}
+
+		files, err := worker.ArchivedFiles(arg, filter.start, filter.end)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", arg, err)
+		}
+		paths = append(paths, files...)
+	}
+	return paths, nil
+}
+
+func replayFile(path, format string, fn func(*schema.CheckResult) error) error {
+	if format == "" {
+		format = resultsFormat(path)
+	}
+
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	return worker.ReadResults(r, format, fn)
+}
+
+// resultsFormat guesses the format of a file of results from its name.
+func resultsFormat(path string) string {
+	switch filepath.Ext(strings.TrimSuffix(path, ".gz")) {
+	case ".json", ".jsonl", ".ndjson":
+		return worker.ResultsJSON
+	}
+	return worker.ResultsDelimited
+}
+
+type replayFilter struct {
+	customers  map[string]bool
+	checks     map[string]bool
+	start, end time.Time
+}
+
+func newReplayFilter(customers, checks, start, end string) (*replayFilter, error) {
+	f := &replayFilter{
+		customers: commaSet(customers),
+		checks:    commaSet(checks),
+	}
+
+	var err error
+	if start != "" {
+		if f.start, err = time.Parse(time.RFC3339, start); err != nil {
+			return nil, fmt.Errorf("invalid start: %s", err)
+		}
+	}
+	if end != "" {
+		if f.end, err = time.Parse(time.RFC3339, end); err != nil {
+			return nil, fmt.Errorf("invalid end: %s", err)
+		}
+	}
+
+	return f, nil
+}
+
+func (f *replayFilter) matches(result *schema.CheckResult) bool {
+	if len(f.customers) > 0 && !f.customers[result.CustomerId] {
+		return false
+	}
+	if len(f.checks) > 0 && !f.checks[result.CheckId] {
+		return false
+	}
+
+	if f.start.IsZero() && f.end.IsZero() {
+		return true
+	}
+	if result.Timestamp == nil {
+		return false
+	}
+	ts := result.Timestamp.Time()
+	return !ts.Before(f.start) && (f.end.IsZero() || ts.Before(f.end))
+}
+
+func commaSet(s string) map[string]bool {
+	set := make(map[string]bool)
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			set[v] = true
+		}
+	}
+	return set
+}
+
+// rateLimiter paces writes to rate metrics per second on average.
+type rateLimiter struct {
+	rate  float64
+	start time.Time
+	count float64
+}
+
+func (l *rateLimiter) wait(n int) {
+	if l.rate <= 0 {
+		return
+	}
+
+	l.count += float64(n)
+	due := l.start.Add(time.Duration(l.count / l.rate * float64(time.Second)))
+	if d := due.Sub(time.Now()); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+type replayWriter interface {
+	worker.Writer
+	Stop(timeout time.Duration) error
+}
+
+// printWriter prints datapoints instead of writing them, one per line with
+// the metric name, timestamp, value and sorted tags.
+type printWriter struct {
+	out io.Writer
+}
+
+func (w *printWriter) Write(metrics []builder.Metric, done func(error)) {
+	for _, m := range metrics {
+		tags := make([]string, 0, len(m.GetTags()))
+		for k, v := range m.GetTags() {
+			tags = append(tags, k+"="+v)
+		}
+		sort.Strings(tags)
+
+		for _, dp := range m.GetDataPoints() {
+			var value interface{}
+			if v, err := dp.Float64Value(); err == nil {
+				value = v
+			} else {
+				value, _ = dp.Int64Value()
+			}
+			fmt.Fprintf(w.out, "%s\t%d\t%v\t%s\tttl=%d\n", m.GetName(), dp.Timestamp(), value, strings.Join(tags, ","), m.GetTTL())
+		}
+	}
+	done(nil)
+}
+
+func (w *printWriter) Stop(timeout time.Duration) error {
+	return nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/opsee/basic/schema"
+	"github.com/opsee/marktricks/worker"
+	opsee_types "github.com/opsee/protobuf/opseeproto/types"
+)
+
+var testTime = time.Date(2017, 7, 14, 12, 0, 0, 0, time.UTC)
+
+func testResult(customerID, checkID string, ts time.Time) *schema.CheckResult {
+	return &schema.CheckResult{CustomerId: customerID, CheckId: checkID, Timestamp: opsee_types.NewTimestamp(ts)}
+}
+
+func TestReplayFilter(t *testing.T) {
+	untimed := &schema.CheckResult{CustomerId: "customer-1", CheckId: "check-1"}
+
+	tests := []struct {
+		name                          string
+		customers, checks, start, end string
+		result                        *schema.CheckResult
+		want                          bool
+	}{
+		{name: "everything", result: testResult("customer-1", "check-1", testTime), want: true},
+		{name: "untimed without a range", result: untimed, want: true},
+		{name: "customer", customers: "customer-2, customer-1", result: testResult("customer-1", "check-1", testTime), want: true},
+		{name: "other customer", customers: "customer-2", result: testResult("customer-1", "check-1", testTime), want: false},
+		{name: "check", checks: "check-1", result: testResult("customer-1", "check-1", testTime), want: true},
+		{name: "other check", checks: "check-2,", result: testResult("customer-1", "check-1", testTime), want: false},
+		{name: "at start", start: "2017-07-14T12:00:00Z", result: testResult("customer-1", "check-1", testTime), want: true},
+		{name: "before start", start: "2017-07-14T12:00:01Z", result: testResult("customer-1", "check-1", testTime), want: false},
+		{name: "before end", end: "2017-07-14T12:00:01Z", result: testResult("customer-1", "check-1", testTime), want: true},
+		{name: "at end", end: "2017-07-14T12:00:00Z", result: testResult("customer-1", "check-1", testTime), want: false},
+		{name: "in range", start: "2017-07-14T00:00:00Z", end: "2017-07-15T00:00:00Z", result: testResult("customer-1", "check-1", testTime), want: true},
+		{name: "other zone", start: "2017-07-14T13:00:00+02:00", result: testResult("customer-1", "check-1", testTime), want: true},
+		{name: "untimed in a range", start: "2017-07-14T00:00:00Z", result: untimed, want: false},
+		{name: "untimed before an end", end: "2017-07-15T00:00:00Z", result: untimed, want: false},
+	}
+
+	for _, test := range tests {
+		f, err := newReplayFilter(test.customers, test.checks, test.start, test.end)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if got := f.matches(test.result); got != test.want {
+			t.Errorf("%s: got match %t, want %t", test.name, got, test.want)
+		}
+	}
+
+	for _, bounds := range [][2]string{{"yesterday", ""}, {"", "2017-07-14"}} {
+		if _, err := newReplayFilter("", "", bounds[0], bounds[1]); err == nil {
+			t.Errorf("start %q, end %q: got no error", bounds[0], bounds[1])
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	tests := []struct {
+		rate    float64
+		batches []int
+		min     time.Duration
+		max     time.Duration
+	}{
+		{rate: 0, batches: []int{1000, 1000}, max: 20 * time.Millisecond},
+		{rate: 1000, batches: []int{50, 50}, min: 100 * time.Millisecond, max: time.Second},
+		{rate: 100, batches: []int{5, 5, 5, 5}, min: 200 * time.Millisecond, max: time.Second},
+	}
+
+	for _, test := range tests {
+		start := time.Now()
+		l := &rateLimiter{rate: test.rate, start: start}
+		for _, n := range test.batches {
+			l.wait(n)
+		}
+
+		if took := time.Since(start); took < test.min || took > test.max {
+			t.Errorf("rate %g, batches %v: took %s, want between %s and %s", test.rate, test.batches, took, test.min, test.max)
+		}
+	}
+
+	// time already spent writing counts towards the rate
+	l := &rateLimiter{rate: 100, start: time.Now().Add(-time.Second)}
+	start := time.Now()
+	l.wait(50)
+	if took := time.Since(start); took > 20*time.Millisecond {
+		t.Errorf("caught up limiter waited %s", took)
+	}
+}
+
+func TestResultsFormat(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"results.jsonl", worker.ResultsJSON},
+		{"results.json", worker.ResultsJSON},
+		{"results.ndjson.gz", worker.ResultsJSON},
+		{"results.pb", worker.ResultsDelimited},
+		{"results.pb.gz", worker.ResultsDelimited},
+		{"archive/customer-1/2017-07-14/00000000000000000001.pb.gz", worker.ResultsDelimited},
+		{"results.gz", worker.ResultsDelimited},
+		{"-", worker.ResultsDelimited},
+	}
+
+	for _, test := range tests {
+		if got := resultsFormat(test.path); got != test.want {
+			t.Errorf("%s: got format %s, want %s", test.path, got, test.want)
+		}
+	}
+}
+
+func TestReplayPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archiveDir := filepath.Join(dir, "archive")
+	archive, err := worker.NewArchive(&worker.ArchiveConfig{Dir: archiveDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive.Start()
+	for _, result := range []*schema.CheckResult{
+		testResult("customer-1", "check-1", testTime.AddDate(0, 0, -2)),
+		testResult("customer-1", "check-1", testTime),
+		testResult("customer-2", "check-2", testTime),
+	} {
+		if err := archive.Archive(result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Stop(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := worker.ArchivedFiles(archiveDir, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 3 {
+		t.Fatalf("got archive files %q, want 3", all)
+	}
+	customer1, _ := worker.ArchivedFiles(filepath.Join(archiveDir, "customer-1"), testTime.AddDate(0, 0, -1), time.Time{})
+	if len(customer1) != 1 {
+		t.Fatalf("got customer-1 files %q since yesterday, want 1", customer1)
+	}
+
+	file := filepath.Join(dir, "results.jsonl")
+	missing := filepath.Join(dir, "missing.pb")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		args  []string
+		start string
+		want  []string
+	}{
+		{name: "files", args: []string{file, missing, "-"}, want: []string{file, missing, "-"}},
+		{name: "archive", args: []string{archiveDir}, want: all},
+		{name: "archive in range", args: []string{filepath.Join(archiveDir, "customer-1"), file}, start: "2017-07-13T00:00:00Z", want: append(customer1, file)},
+		{name: "nothing in range", args: []string{archiveDir}, start: "2017-07-15T00:00:00Z", want: nil},
+	}
+
+	for _, test := range tests {
+		filter, err := newReplayFilter("", "", test.start, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := replayPaths(test.args, filter)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got paths %q, want %q", test.name, got, test.want)
+		}
+	}
+}
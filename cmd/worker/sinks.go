@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	log "github.com/opsee/logrus"
+	"github.com/opsee/marktricks/store"
+	"github.com/opsee/marktricks/worker"
+	"github.com/spf13/viper"
+)
+
+// sinkConfig is a sink as listed under sinks in the config file, e.g.
+//
+//	sinks:
+//	  - name: kairosdb
+//	    store: kairosdb
+//	    address: http://kairosdb:8080
+//	    primary: true
+//	  - name: kairosdb-next
+//	    store: kairosdb
+//	    address: http://kairosdb-next:8080
+type sinkConfig struct {
+	Name    string `mapstructure:"name"`
+	Store   string `mapstructure:"store"`
+	Address string `mapstructure:"address"`
+	// GzipThreshold is the fewest datapoints gzipped writes have, negative
+	// to never gzip, DisableGzipQueries asks for uncompressed query responses.
+	GzipThreshold      int  `mapstructure:"gzip_threshold"`
+	DisableGzipQueries bool `mapstructure:"disable_gzip_queries"`
+	// TelnetAddress and TelnetPoolSize configure kairosdb-telnet stores,
+	// which can't be used with retention, see checkTelnetRetention.
+	TelnetAddress  string `mapstructure:"telnet_address"`
+	TelnetPoolSize int    `mapstructure:"telnet_pool_size"`
+	Primary        bool   `mapstructure:"primary"`
+	QueueSize      int    `mapstructure:"queue_size"`
+	MaxRetries     int    `mapstructure:"max_retries"`
+	RetryDelay     string `mapstructure:"retry_delay"`
+	// SpoolDir defaults to a directory named after the sink under spool_dir.
+	SpoolDir string `mapstructure:"spool_dir"`
+}
+
+func newStore(c sinkConfig) (store.Store, error) {
+	switch c.Store {
+	case "kairosdb":
+		return store.NewKairosDB(&store.KairosDBConfig{
+			Address:            c.Address,
+			GzipThreshold:      c.GzipThreshold,
+			DisableGzipQueries: c.DisableGzipQueries,
+		}), nil
+	case "kairosdb-telnet":
+		return store.NewKairosDBTelnet(&store.TelnetConfig{
+			KairosDBConfig: store.KairosDBConfig{
+				Address:            c.Address,
+				GzipThreshold:      c.GzipThreshold,
+				DisableGzipQueries: c.DisableGzipQueries,
+			},
+			TelnetAddress: c.TelnetAddress,
+			PoolSize:      c.TelnetPoolSize,
+		}), nil
+	case "memory":
+		log.Warn("storing metrics in memory, they will be lost on exit")
+		return store.NewMemory(), nil
+	}
+	return nil, fmt.Errorf("unknown store: %s", c.Store)
+}
+
+// sinkConfigs returns the configured sinks, or a single primary sink writing to
+// the store and spool_dir if there are none.
+func sinkConfigs() ([]sinkConfig, error) {
+	if !viper.IsSet("sinks") {
+		return []sinkConfig{{
+			Name:               viper.GetString("store"),
+			Store:              viper.GetString("store"),
+			Address:            viper.GetString("kairosdb_address"),
+			TelnetAddress:      viper.GetString("kairosdb_telnet_address"),
+			TelnetPoolSize:     viper.GetInt("kairosdb_telnet_pool_size"),
+			GzipThreshold:      viper.GetInt("kairosdb_gzip_threshold"),
+			DisableGzipQueries: viper.GetBool("kairosdb_disable_gzip_queries"),
+			Primary:            true,
+			SpoolDir:           viper.GetString("spool_dir"),
+		}}, nil
+	}
+
+	var configs []sinkConfig
+	if err := viper.UnmarshalKey("sinks", &configs); err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for i, c := range configs {
+		if c.Name == "" {
+			return nil, fmt.Errorf("sink %d has no name", i)
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("duplicate sink %s", c.Name)
+		}
+		names[c.Name] = true
+
+		if c.Store == "" {
+			configs[i].Store = "kairosdb"
+		}
+		if c.SpoolDir == "" && viper.GetString("spool_dir") != "" {
+			configs[i].SpoolDir = filepath.Join(viper.GetString("spool_dir"), c.Name)
+		}
+	}
+
+	return configs, nil
+}
+
+// checkTelnetRetention rejects kairosdb-telnet sinks if points are kept for
+// less than forever, since the line protocol can't carry their TTLs and every
+// point would be written over http.
+func checkTelnetRetention(configs []sinkConfig, rc *worker.RetentionConfig) error {
+	retained := rc.Default > 0
+	for _, r := range rc.Customers {
+		retained = retained || r > 0
+	}
+	if !retained {
+		return nil
+	}
+
+	for _, c := range configs {
+		if c.Store == "kairosdb-telnet" {
+			return fmt.Errorf("sink %s: kairosdb-telnet can't write points with a retention, use kairosdb", c.Name)
+		}
+	}
+	return nil
+}
+
+// newSinks builds the stores, batch writers and spools of the configured sinks.
+func newSinks(configs []sinkConfig) ([]*worker.SinkConfig, error) {
+	var sinks []*worker.SinkConfig
+	for _, c := range configs {
+		st, err := newStore(c)
+		if err != nil {
+			return nil, fmt.Errorf("sink %s: %s", c.Name, err)
+		}
+
+		var retryDelay time.Duration
+		if c.RetryDelay != "" {
+			if retryDelay, err = time.ParseDuration(c.RetryDelay); err != nil {
+				return nil, fmt.Errorf("sink %s: invalid retry delay: %s", c.Name, err)
+			}
+		}
+
+		writerConfig := &worker.BatchWriterConfig{
+			BatchSize:        viper.GetInt("batch_size"),
+			FlushInterval:    viper.GetDuration("batch_flush_interval"),
+			SlowThreshold:    viper.GetDuration("spool_slow_threshold"),
+			RecoveryInterval: viper.GetDuration("spool_recovery_interval"),
+		}
+
+		if c.SpoolDir != "" {
+			writerConfig.Spool, err = worker.NewSpool(&worker.SpoolConfig{
+				Dir:      c.SpoolDir,
+				MaxBytes: int64(viper.GetSizeInBytes("spool_max_size")),
+				MaxAge:   viper.GetDuration("spool_max_age"),
+			})
+			if err != nil {
+				return nil, fmt.Errorf("sink %s: failed to open spool: %s", c.Name, err)
+			}
+		}
+
+		sinks = append(sinks, &worker.SinkConfig{
+			Name:       c.Name,
+			Store:      st,
+			Writer:     writerConfig,
+			Primary:    c.Primary,
+			QueueSize:  c.QueueSize,
+			MaxRetries: c.MaxRetries,
+			RetryDelay: retryDelay,
+		})
+	}
+
+	return sinks, nil
+}
@@ -0,0 +1,336 @@
+// Code generated by protoc-gen-gogo.
+// source: marktricks.proto
+// DO NOT EDIT!
+
+/*
+Package pb is a generated protocol buffer package.
+
+It is generated from these files:
+
+	marktricks.proto
+
+It has these top-level messages:
+
+	GetCardinalityRequest
+	MetricCardinality
+	CustomerCardinality
+	GetCardinalityResponse
+	PushMetricsRequest
+	PointError
+	PushMetricsResponse
+	DeadLetter
+*/
+package pb
+
+import proto "github.com/gogo/protobuf/proto"
+import fmt "fmt"
+import math "math"
+import opsee "github.com/opsee/basic/schema"
+import opsee_types "github.com/opsee/protobuf/opseeproto/types"
+
+import (
+	context "golang.org/x/net/context"
+	grpc "google.golang.org/grpc"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+const _ = proto.GoGoProtoPackageIsVersion1
+
+type GetCardinalityRequest struct {
+	CustomerId string `protobuf:"bytes,1,opt,name=customer_id,json=customerId,proto3" json:"customer_id,omitempty"`
+}
+
+func (m *GetCardinalityRequest) Reset()                    { *m = GetCardinalityRequest{} }
+func (m *GetCardinalityRequest) String() string            { return proto.CompactTextString(m) }
+func (*GetCardinalityRequest) ProtoMessage()               {}
+func (*GetCardinalityRequest) Descriptor() ([]byte, []int) { return fileDescriptorMarktricks, []int{0} }
+
+type MetricCardinality struct {
+	Name   string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Series int64  `protobuf:"varint,2,opt,name=series,proto3" json:"series,omitempty"`
+}
+
+func (m *MetricCardinality) Reset()                    { *m = MetricCardinality{} }
+func (m *MetricCardinality) String() string            { return proto.CompactTextString(m) }
+func (*MetricCardinality) ProtoMessage()               {}
+func (*MetricCardinality) Descriptor() ([]byte, []int) { return fileDescriptorMarktricks, []int{1} }
+
+type CustomerCardinality struct {
+	CustomerId string               `protobuf:"bytes,1,opt,name=customer_id,json=customerId,proto3" json:"customer_id,omitempty"`
+	Series     int64                `protobuf:"varint,2,opt,name=series,proto3" json:"series,omitempty"`
+	Metrics    []*MetricCardinality `protobuf:"bytes,3,rep,name=metrics" json:"metrics,omitempty"`
+	Dropped    int64                `protobuf:"varint,4,opt,name=dropped,proto3" json:"dropped,omitempty"`
+	Limited    int64                `protobuf:"varint,5,opt,name=limited,proto3" json:"limited,omitempty"`
+}
+
+func (m *CustomerCardinality) Reset()                    { *m = CustomerCardinality{} }
+func (m *CustomerCardinality) String() string            { return proto.CompactTextString(m) }
+func (*CustomerCardinality) ProtoMessage()               {}
+func (*CustomerCardinality) Descriptor() ([]byte, []int) { return fileDescriptorMarktricks, []int{2} }
+
+func (m *CustomerCardinality) GetMetrics() []*MetricCardinality {
+	if m != nil {
+		return m.Metrics
+	}
+	return nil
+}
+
+type GetCardinalityResponse struct {
+	Customers []*CustomerCardinality `protobuf:"bytes,1,rep,name=customers" json:"customers,omitempty"`
+}
+
+func (m *GetCardinalityResponse) Reset()         { *m = GetCardinalityResponse{} }
+func (m *GetCardinalityResponse) String() string { return proto.CompactTextString(m) }
+func (*GetCardinalityResponse) ProtoMessage()    {}
+func (*GetCardinalityResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptorMarktricks, []int{3}
+}
+
+func (m *GetCardinalityResponse) GetCustomers() []*CustomerCardinality {
+	if m != nil {
+		return m.Customers
+	}
+	return nil
+}
+
+// PushMetricsRequest is a batch of metrics reported on behalf of a customer,
+// and optionally one of its checks, bastions, regions or targets. The scope is
+// tagged by the same tag rules as check results.
+type PushMetricsRequest struct {
+	CustomerId string          `protobuf:"bytes,1,opt,name=customer_id,json=customerId,proto3" json:"customer_id,omitempty"`
+	CheckId    string          `protobuf:"bytes,2,opt,name=check_id,json=checkId,proto3" json:"check_id,omitempty"`
+	BastionId  string          `protobuf:"bytes,3,opt,name=bastion_id,json=bastionId,proto3" json:"bastion_id,omitempty"`
+	Region     string          `protobuf:"bytes,4,opt,name=region,proto3" json:"region,omitempty"`
+	Target     *opsee.Target   `protobuf:"bytes,5,opt,name=target" json:"target,omitempty"`
+	Metrics    []*opsee.Metric `protobuf:"bytes,6,rep,name=metrics" json:"metrics,omitempty"`
+}
+
+func (m *PushMetricsRequest) Reset()                    { *m = PushMetricsRequest{} }
+func (m *PushMetricsRequest) String() string            { return proto.CompactTextString(m) }
+func (*PushMetricsRequest) ProtoMessage()               {}
+func (*PushMetricsRequest) Descriptor() ([]byte, []int) { return fileDescriptorMarktricks, []int{4} }
+
+func (m *PushMetricsRequest) GetTarget() *opsee.Target {
+	if m != nil {
+		return m.Target
+	}
+	return nil
+}
+
+func (m *PushMetricsRequest) GetMetrics() []*opsee.Metric {
+	if m != nil {
+		return m.Metrics
+	}
+	return nil
+}
+
+type PointError struct {
+	Index int32  `protobuf:"varint,1,opt,name=index,proto3" json:"index,omitempty"`
+	Error string `protobuf:"bytes,2,opt,name=error,proto3" json:"error,omitempty"`
+}
+
+func (m *PointError) Reset()                    { *m = PointError{} }
+func (m *PointError) String() string            { return proto.CompactTextString(m) }
+func (*PointError) ProtoMessage()               {}
+func (*PointError) Descriptor() ([]byte, []int) { return fileDescriptorMarktricks, []int{5} }
+
+type PushMetricsResponse struct {
+	Accepted int64         `protobuf:"varint,1,opt,name=accepted,proto3" json:"accepted,omitempty"`
+	Errors   []*PointError `protobuf:"bytes,2,rep,name=errors" json:"errors,omitempty"`
+}
+
+func (m *PushMetricsResponse) Reset()                    { *m = PushMetricsResponse{} }
+func (m *PushMetricsResponse) String() string            { return proto.CompactTextString(m) }
+func (*PushMetricsResponse) ProtoMessage()               {}
+func (*PushMetricsResponse) Descriptor() ([]byte, []int) { return fileDescriptorMarktricks, []int{6} }
+
+func (m *PushMetricsResponse) GetErrors() []*PointError {
+	if m != nil {
+		return m.Errors
+	}
+	return nil
+}
+
+// DeadLetter is the raw body of a message marktricks gave up on, along with why.
+// Dead letters are published to nsq as is, and appended to quarantine files
+// length delimited.
+type DeadLetter struct {
+	Body      []byte                 `protobuf:"bytes,1,opt,name=body,proto3" json:"body,omitempty"`
+	Reason    string                 `protobuf:"bytes,2,opt,name=reason,proto3" json:"reason,omitempty"`
+	Attempts  int32                  `protobuf:"varint,3,opt,name=attempts,proto3" json:"attempts,omitempty"`
+	Timestamp *opsee_types.Timestamp `protobuf:"bytes,4,opt,name=timestamp" json:"timestamp,omitempty"`
+}
+
+func (m *DeadLetter) Reset()                    { *m = DeadLetter{} }
+func (m *DeadLetter) String() string            { return proto.CompactTextString(m) }
+func (*DeadLetter) ProtoMessage()               {}
+func (*DeadLetter) Descriptor() ([]byte, []int) { return fileDescriptorMarktricks, []int{7} }
+
+func (m *DeadLetter) GetTimestamp() *opsee_types.Timestamp {
+	if m != nil {
+		return m.Timestamp
+	}
+	return nil
+}
+
+func init() {
+	proto.RegisterType((*GetCardinalityRequest)(nil), "marktricks.GetCardinalityRequest")
+	proto.RegisterType((*MetricCardinality)(nil), "marktricks.MetricCardinality")
+	proto.RegisterType((*CustomerCardinality)(nil), "marktricks.CustomerCardinality")
+	proto.RegisterType((*GetCardinalityResponse)(nil), "marktricks.GetCardinalityResponse")
+	proto.RegisterType((*PushMetricsRequest)(nil), "marktricks.PushMetricsRequest")
+	proto.RegisterType((*PointError)(nil), "marktricks.PointError")
+	proto.RegisterType((*PushMetricsResponse)(nil), "marktricks.PushMetricsResponse")
+	proto.RegisterType((*DeadLetter)(nil), "marktricks.DeadLetter")
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion3
+
+// Client API for Marktricks service
+
+type MarktricksClient interface {
+	GetCardinality(ctx context.Context, in *GetCardinalityRequest, opts ...grpc.CallOption) (*GetCardinalityResponse, error)
+	PushMetrics(ctx context.Context, in *PushMetricsRequest, opts ...grpc.CallOption) (*PushMetricsResponse, error)
+}
+
+type marktricksClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewMarktricksClient(cc *grpc.ClientConn) MarktricksClient {
+	return &marktricksClient{cc}
+}
+
+func (c *marktricksClient) GetCardinality(ctx context.Context, in *GetCardinalityRequest, opts ...grpc.CallOption) (*GetCardinalityResponse, error) {
+	out := new(GetCardinalityResponse)
+	err := grpc.Invoke(ctx, "/marktricks.Marktricks/GetCardinality", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *marktricksClient) PushMetrics(ctx context.Context, in *PushMetricsRequest, opts ...grpc.CallOption) (*PushMetricsResponse, error) {
+	out := new(PushMetricsResponse)
+	err := grpc.Invoke(ctx, "/marktricks.Marktricks/PushMetrics", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Server API for Marktricks service
+
+type MarktricksServer interface {
+	GetCardinality(context.Context, *GetCardinalityRequest) (*GetCardinalityResponse, error)
+	PushMetrics(context.Context, *PushMetricsRequest) (*PushMetricsResponse, error)
+}
+
+func RegisterMarktricksServer(s *grpc.Server, srv MarktricksServer) {
+	s.RegisterService(&_Marktricks_serviceDesc, srv)
+}
+
+func _Marktricks_GetCardinality_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetCardinalityRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MarktricksServer).GetCardinality(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/marktricks.Marktricks/GetCardinality",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MarktricksServer).GetCardinality(ctx, req.(*GetCardinalityRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Marktricks_PushMetrics_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PushMetricsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MarktricksServer).PushMetrics(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/marktricks.Marktricks/PushMetrics",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MarktricksServer).PushMetrics(ctx, req.(*PushMetricsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _Marktricks_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "marktricks.Marktricks",
+	HandlerType: (*MarktricksServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetCardinality",
+			Handler:    _Marktricks_GetCardinality_Handler,
+		},
+		{
+			MethodName: "PushMetrics",
+			Handler:    _Marktricks_PushMetrics_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: fileDescriptorMarktricks,
+}
+
+var fileDescriptorMarktricks = []byte{
+	// 570 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x54, 0x61, 0x8b, 0xd3, 0x4c,
+	0x10, 0x7e, 0x73, 0xbd, 0xf6, 0xae, 0xd3, 0x57, 0xd1, 0x3d, 0x3d, 0x62, 0xe1, 0x6c, 0x0d, 0x88,
+	0xc5, 0x0f, 0x09, 0x54, 0xc1, 0x43, 0x10, 0xc1, 0x53, 0xe4, 0xc0, 0x83, 0xb2, 0x1c, 0x88, 0x7e,
+	0x91, 0x4d, 0x32, 0xb6, 0xcb, 0x5d, 0xb2, 0x71, 0x77, 0x0b, 0xf6, 0x2f, 0xf8, 0x8f, 0xc4, 0x1f,
+	0xe2, 0xdf, 0x91, 0x4c, 0x36, 0x69, 0x6a, 0xef, 0xd4, 0x6f, 0x79, 0xe6, 0x99, 0x99, 0x3e, 0xf3,
+	0xcc, 0x6c, 0xe1, 0x56, 0x26, 0xf4, 0x85, 0xd5, 0x32, 0xb9, 0x30, 0x61, 0xa1, 0x95, 0x55, 0x0c,
+	0xd6, 0x91, 0xe1, 0xe3, 0xb9, 0xb4, 0x8b, 0x65, 0x1c, 0x26, 0x2a, 0x8b, 0x54, 0x61, 0x10, 0xa3,
+	0x58, 0x18, 0x99, 0x44, 0x26, 0x59, 0x60, 0x26, 0xa2, 0x64, 0x81, 0x4d, 0xdd, 0xf0, 0xf9, 0x56,
+	0x2e, 0xc5, 0xe3, 0xe5, 0xe7, 0x0a, 0x12, 0x8a, 0xec, 0xaa, 0x40, 0x13, 0x59, 0x99, 0xa1, 0xb1,
+	0x22, 0x2b, 0xaa, 0xda, 0xe0, 0x18, 0xee, 0xbe, 0x45, 0x7b, 0x22, 0x74, 0x2a, 0x73, 0x71, 0x29,
+	0xed, 0x8a, 0xe3, 0x97, 0x25, 0x1a, 0xcb, 0x46, 0x30, 0x48, 0x96, 0xc6, 0xaa, 0x0c, 0xf5, 0x27,
+	0x99, 0xfa, 0xde, 0xd8, 0x9b, 0xf4, 0x39, 0xd4, 0xa1, 0xd3, 0x34, 0x78, 0x09, 0xb7, 0xcf, 0xb0,
+	0x54, 0xdb, 0x2a, 0x66, 0x0c, 0x76, 0x73, 0x91, 0xa1, 0x4b, 0xa7, 0x6f, 0x76, 0x08, 0x3d, 0x83,
+	0x5a, 0xa2, 0xf1, 0x77, 0xc6, 0xde, 0xa4, 0xc3, 0x1d, 0x0a, 0x7e, 0x78, 0x70, 0x70, 0xe2, 0xfa,
+	0xb5, 0x7b, 0xfc, 0xed, 0x97, 0xaf, 0x6b, 0xc8, 0x9e, 0xc1, 0x5e, 0x46, 0x8a, 0x8c, 0xdf, 0x19,
+	0x77, 0x26, 0x83, 0xe9, 0x51, 0xd8, 0xf2, 0x78, 0x4b, 0x2c, 0xaf, 0xb3, 0x99, 0x0f, 0x7b, 0xa9,
+	0x56, 0x45, 0x81, 0xa9, 0xbf, 0x4b, 0x1d, 0x6b, 0x58, 0x32, 0x97, 0x32, 0x93, 0x16, 0x53, 0xbf,
+	0x5b, 0x31, 0x0e, 0x06, 0xef, 0xe1, 0xf0, 0x77, 0xe3, 0x4c, 0xa1, 0x72, 0x83, 0xec, 0x05, 0xf4,
+	0x6b, 0xb1, 0xc6, 0xf7, 0x48, 0xc8, 0xa8, 0x2d, 0xe4, 0x8a, 0x99, 0xf9, 0xba, 0x22, 0xf8, 0xe9,
+	0x01, 0x9b, 0x2d, 0xcd, 0xa2, 0xd2, 0x6b, 0xfe, 0x75, 0x1f, 0xec, 0x1e, 0xec, 0xd3, 0x55, 0x94,
+	0xec, 0x0e, 0xb1, 0x7b, 0x84, 0x4f, 0x53, 0x76, 0x04, 0x10, 0x0b, 0x63, 0xa5, 0xca, 0x4b, 0xb2,
+	0x43, 0x64, 0xdf, 0x45, 0x2a, 0x3f, 0x35, 0xce, 0xa5, 0xca, 0x69, 0xfa, 0x3e, 0x77, 0x88, 0x3d,
+	0x84, 0x9e, 0x15, 0x7a, 0x8e, 0x96, 0x66, 0x1f, 0x4c, 0x6f, 0x84, 0x74, 0x4e, 0xe1, 0x39, 0x05,
+	0xb9, 0x23, 0xd9, 0xa3, 0xb5, 0xed, 0xbd, 0x71, 0xa7, 0x95, 0x57, 0x4d, 0xd0, 0xd8, 0x1c, 0x1c,
+	0x03, 0xcc, 0x94, 0xcc, 0xed, 0x1b, 0xad, 0x95, 0x66, 0x77, 0xa0, 0x2b, 0xf3, 0x14, 0xbf, 0xd2,
+	0x28, 0x5d, 0x5e, 0x81, 0x32, 0x8a, 0x25, 0xed, 0x46, 0xa8, 0x40, 0x20, 0xe0, 0x60, 0xc3, 0x12,
+	0xe7, 0xf4, 0x10, 0xf6, 0x45, 0x92, 0x60, 0x51, 0xae, 0xc7, 0xa3, 0xf5, 0x34, 0x98, 0x85, 0xd0,
+	0xa3, 0xda, 0xf2, 0x48, 0x4a, 0x51, 0x87, 0xed, 0x15, 0xac, 0x65, 0x70, 0x97, 0x15, 0x7c, 0xf3,
+	0x00, 0x5e, 0xa3, 0x48, 0xdf, 0xa1, 0xb5, 0xa8, 0xcb, 0x43, 0x8e, 0x55, 0xba, 0xa2, 0xb6, 0xff,
+	0x73, 0xfa, 0xae, 0x7c, 0x12, 0x46, 0xe5, 0x4e, 0x9c, 0x43, 0x24, 0xc3, 0x5a, 0xcc, 0x0a, 0x6b,
+	0xc8, 0xdc, 0x2e, 0x6f, 0x30, 0x7b, 0x0a, 0xfd, 0xe6, 0xc9, 0x91, 0xbd, 0xa5, 0x92, 0xca, 0x1e,
+	0x7a, 0x90, 0xe1, 0x79, 0xcd, 0xf2, 0x75, 0xe2, 0xf4, 0xbb, 0x07, 0x70, 0xd6, 0xc8, 0x65, 0x1f,
+	0xe0, 0xe6, 0xe6, 0xad, 0xb1, 0x07, 0xed, 0x69, 0xae, 0x7c, 0xc0, 0xc3, 0xe0, 0x4f, 0x29, 0x95,
+	0x81, 0xc1, 0x7f, 0x6c, 0x06, 0x83, 0x96, 0xb3, 0xec, 0xfe, 0x86, 0x4b, 0x5b, 0x57, 0x38, 0x1c,
+	0x5d, 0xcb, 0xd7, 0x1d, 0x5f, 0xed, 0x7e, 0xdc, 0x29, 0xe2, 0xb8, 0x47, 0x7f, 0x2f, 0x4f, 0x7e,
+	0x0d, 0x00, 0x45, 0x74, 0x39, 0x01, 0xe6, 0x04, 0x00, 0x00,
+}
@@ -0,0 +1,116 @@
+package rollup
+
+import (
+	"fmt"
+	"time"
+
+	opsee "github.com/opsee/basic/service"
+	"github.com/opsee/marktricks/store"
+	opsee_types "github.com/opsee/protobuf/opseeproto/types"
+)
+
+// series is the raw points of one tag combination of a metric.
+type series struct {
+	tags   map[string]string
+	points []*opsee.Datapoint
+}
+
+// querySeries returns the raw points of every series of metric in [start, end).
+// The series' tag names are looked up first so the points can be grouped by
+// all of them.
+func querySeries(st store.Store, metric string, start, end time.Time) ([]*series, error) {
+	in := &opsee.QueryMetricsRequest{
+		StartAbsolute: opsee_types.NewTimestamp(start),
+		// query ends are inclusive
+		EndAbsolute: opsee_types.NewTimestamp(end.Add(-time.Millisecond)),
+		Metrics:     []*opsee.QueryMetric{{Name: metric}},
+	}
+
+	tagsResp, err := st.QueryTags(in)
+	if err != nil {
+		return nil, err
+	}
+
+	var tagNames []string
+	for _, q := range tagsResp.Queries {
+		for _, result := range q.Results {
+			for name := range result.Tags {
+				tagNames = append(tagNames, name)
+			}
+		}
+	}
+	if len(tagNames) == 0 {
+		// no points in the range
+		return nil, nil
+	}
+
+	in.Metrics[0].GroupBy = []*opsee.GroupBy{{Name: "tag", Tags: tagNames}}
+	resp, err := st.Query(in)
+	if err != nil {
+		return nil, err
+	}
+
+	var all []*series
+	for _, q := range resp.Queries {
+		for _, result := range q.Results {
+			if len(result.Values) == 0 {
+				continue
+			}
+
+			s := &series{tags: make(map[string]string), points: result.Values}
+			for _, g := range result.GroupBy {
+				if g.Name == "tag" {
+					for k, v := range g.Group {
+						s.tags[k] = v
+					}
+				}
+			}
+			all = append(all, s)
+		}
+	}
+
+	return all, nil
+}
+
+// loadWatermark returns the end of the last window of metric rolled up to res,
+// or the zero time if it has never been rolled up within watermarkLookback.
+func loadWatermark(st store.Store, metric string, res time.Duration) (time.Time, error) {
+	now := time.Now()
+	in := &opsee.QueryMetricsRequest{
+		StartAbsolute: opsee_types.NewTimestamp(now.Add(-watermarkLookback)),
+		EndAbsolute:   opsee_types.NewTimestamp(now),
+		Metrics: []*opsee.QueryMetric{{
+			Name: WatermarkMetric,
+			Tags: map[string]*opsee.StringList{
+				"metric":     {Values: []string{metric}},
+				"resolution": {Values: []string{FormatResolution(res)}},
+			},
+			Aggregators: []*opsee.Aggregator{{
+				Name:     "max",
+				Sampling: &opsee.Sampling{Value: fmt.Sprintf("%d", watermarkLookback/(24*time.Hour)), Unit: "days"},
+			}},
+		}},
+	}
+
+	resp, err := st.Query(in)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var watermark time.Time
+	for _, q := range resp.Queries {
+		for _, result := range q.Results {
+			for _, dp := range result.Values {
+				if t := millisTime(int64(dp.Value)); t.After(watermark) {
+					watermark = t
+				}
+			}
+		}
+	}
+
+	return watermark, nil
+}
+
+func millisTime(millis int64) time.Time {
+	return time.Unix(millis/1000, (millis%1000)*int64(time.Millisecond)).UTC()
+}
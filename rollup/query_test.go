@@ -0,0 +1,109 @@
+package rollup
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	builder "github.com/dan-compton/go-kairosdb/builder"
+	"github.com/opsee/marktricks/store"
+)
+
+// testStart is whole hours, so windows of every resolution start at it.
+var testStart = time.Unix(1500001200, 0).UTC()
+
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// describeSeries renders series as sorted "tags: seconds=value ..." lines,
+// seconds counted from testStart.
+func describeSeries(all []*series) []string {
+	lines := []string{}
+	for _, s := range all {
+		var tags []string
+		for k, v := range s.tags {
+			tags = append(tags, k+"="+v)
+		}
+		sort.Strings(tags)
+
+		line := strings.Join(tags, ",") + ":"
+		for _, dp := range s.points {
+			line += fmt.Sprintf(" %d=%v", (dp.Timestamp.Millis()-millis(testStart))/1000, dp.Value)
+		}
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func TestQuerySeries(t *testing.T) {
+	st := store.NewMemory()
+	at := func(seconds int) int64 { return millis(testStart.Add(time.Duration(seconds) * time.Second)) }
+	err := st.Write([]builder.Metric{
+		builder.NewMetric("latency").AddTag("host", "a").AddTag("region", "us").
+			AddDataPoint(at(0), 1).AddDataPoint(at(30), 2).AddDataPoint(at(60), 3),
+		builder.NewMetric("latency").AddTag("host", "a").AddTag("region", "eu").AddDataPoint(at(10), 4),
+		builder.NewMetric("latency").AddTag("host", "b").AddDataPoint(at(20), 5),
+		builder.NewMetric("errors").AddTag("host", "a").AddDataPoint(at(0), 6),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		metric     string
+		start, end time.Time
+		want       []string
+	}{
+		{
+			name:   "grouped by every tag",
+			metric: "latency",
+			start:  testStart,
+			end:    testStart.Add(time.Hour),
+			want:   []string{"host=a,region=eu: 10=4", "host=a,region=us: 0=1 30=2 60=3", "host=b: 20=5"},
+		},
+		{
+			name:   "end is exclusive",
+			metric: "latency",
+			start:  testStart,
+			end:    testStart.Add(time.Minute),
+			want:   []string{"host=a,region=eu: 10=4", "host=a,region=us: 0=1 30=2", "host=b: 20=5"},
+		},
+		{
+			name:   "series out of range",
+			metric: "latency",
+			start:  testStart.Add(25 * time.Second),
+			end:    testStart.Add(time.Hour),
+			want:   []string{"host=a,region=us: 30=2 60=3"},
+		},
+		{
+			name:   "nothing in range",
+			metric: "latency",
+			start:  testStart.Add(time.Hour),
+			end:    testStart.Add(2 * time.Hour),
+			want:   []string{},
+		},
+		{
+			name:   "other metric",
+			metric: "errors",
+			start:  testStart,
+			end:    testStart.Add(time.Hour),
+			want:   []string{"host=a: 0=6"},
+		},
+	}
+
+	for _, test := range tests {
+		all, err := querySeries(st, test.metric, test.start, test.end)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if got := describeSeries(all); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got series %q, want %q", test.name, got, test.want)
+		}
+	}
+}
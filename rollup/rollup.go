@@ -0,0 +1,250 @@
+// Package rollup periodically pre-aggregates raw series into fixed windows,
+// so long range queries can read a point per window instead of every raw point.
+package rollup
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	builder "github.com/dan-compton/go-kairosdb/builder"
+	log "github.com/opsee/logrus"
+	"github.com/opsee/marktricks/store"
+)
+
+const (
+	// WatermarkMetric records the end of the last window rolled up for each
+	// metric and resolution, tagged with both.
+	WatermarkMetric = "marktricks.rollup.watermark"
+
+	watermarkLookback = 90 * 24 * time.Hour
+
+	defaultInterval = time.Minute
+	defaultDelay    = 2 * time.Minute
+	defaultLookback = 24 * time.Hour
+	defaultMaxRange = 6 * time.Hour
+)
+
+var (
+	DefaultResolutions = []time.Duration{time.Minute, time.Hour, 24 * time.Hour}
+
+	errStopTimeout = errors.New("timed out stopping rollups")
+	errStopped     = errors.New("rollups stopped")
+)
+
+// Writer writes metrics, calling done once they've been written or failed.
+type Writer interface {
+	Write(metrics []builder.Metric, done func(error))
+}
+
+// Retention sets the TTLs of metrics before they are written.
+type Retention interface {
+	Apply(metrics []builder.Metric)
+}
+
+type Config struct {
+	Store     store.Store
+	Writer    Writer
+	Retention Retention
+	// Metrics are the raw metrics rolled up to each of Resolutions.
+	Metrics     []string
+	Resolutions []time.Duration
+	// Interval is how often windows are rolled up.
+	Interval time.Duration
+	// Delay is how long after a window ends it's considered complete.
+	Delay time.Duration
+	// Lookback is how far back rollups start for a metric with no watermark.
+	Lookback time.Duration
+	// MaxRange is the most raw data read per query while catching up.
+	MaxRange time.Duration
+}
+
+// roller rolls up completed windows of raw data into min, max, avg, count and
+// percentile series per window, and records a watermark with every write so
+// it picks up where it left off after downtime.
+type roller struct {
+	config      *Config
+	watermarks  map[string]time.Time
+	stopChan    chan struct{}
+	stoppedChan chan struct{}
+	once        *sync.Once
+	logger      *log.Entry
+}
+
+func New(config *Config) *roller {
+	r := &roller{
+		config:      config,
+		watermarks:  make(map[string]time.Time),
+		stopChan:    make(chan struct{}),
+		stoppedChan: make(chan struct{}),
+		once:        &sync.Once{},
+		logger:      log.WithField("rollup", "roller"),
+	}
+
+	if len(r.config.Resolutions) == 0 {
+		r.config.Resolutions = DefaultResolutions
+	}
+
+	if r.config.Interval <= 0 {
+		r.logger.Infof("no rollup interval config detected, setting to %s", defaultInterval)
+		r.config.Interval = defaultInterval
+	}
+
+	if r.config.Delay <= 0 {
+		r.config.Delay = defaultDelay
+	}
+
+	if r.config.Lookback <= 0 {
+		r.config.Lookback = defaultLookback
+	}
+
+	if r.config.MaxRange <= 0 {
+		r.config.MaxRange = defaultMaxRange
+	}
+
+	return r
+}
+
+func (r *roller) Start() {
+	go r.run()
+}
+
+// Stop waits up to timeout for the rollup in progress to finish its current
+// window.
+func (r *roller) Stop(timeout time.Duration) error {
+	r.logger.Info("stopping")
+	r.once.Do(func() { close(r.stopChan) })
+
+	select {
+	case <-r.stoppedChan:
+	case <-time.After(timeout):
+		return errStopTimeout
+	}
+
+	r.logger.Info("stopped")
+	return nil
+}
+
+func (r *roller) run() {
+	defer close(r.stoppedChan)
+
+	ticker := time.NewTicker(r.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		for _, metric := range r.config.Metrics {
+			for _, res := range r.config.Resolutions {
+				if err := r.catchUp(metric, res); err == errStopped {
+					return
+				} else if err != nil {
+					r.logger.WithError(err).Errorf("failed to roll up %s to %s", metric, FormatResolution(res))
+				}
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-r.stopChan:
+			return
+		}
+	}
+}
+
+// catchUp rolls up every completed window of metric at res since its
+// watermark, at most MaxRange of raw data at a time.
+func (r *roller) catchUp(metric string, res time.Duration) error {
+	key := metric + "/" + FormatResolution(res)
+	watermark, ok := r.watermarks[key]
+	if !ok {
+		loaded, err := loadWatermark(r.config.Store, metric, res)
+		if err != nil {
+			return err
+		}
+
+		if loaded.IsZero() {
+			loaded = time.Now().Add(-r.config.Lookback).Truncate(res)
+			r.logger.Infof("no watermark for %s, starting at %s", key, loaded)
+		}
+		watermark = loaded
+		r.watermarks[key] = watermark
+	}
+
+	step := r.config.MaxRange.Truncate(res)
+	if step < res {
+		step = res
+	}
+
+	complete := time.Now().Add(-r.config.Delay).Truncate(res)
+	for watermark.Before(complete) {
+		select {
+		case <-r.stopChan:
+			return errStopped
+		default:
+		}
+
+		end := watermark.Add(step)
+		if end.After(complete) {
+			end = complete
+		}
+
+		if err := r.rollup(metric, res, watermark, end); err != nil {
+			return err
+		}
+
+		watermark = end
+		r.watermarks[key] = watermark
+	}
+
+	return nil
+}
+
+// rollup writes the rollups of every window of metric at res in [start, end),
+// along with the new watermark, end.
+func (r *roller) rollup(metric string, res time.Duration, start, end time.Time) error {
+	all, err := querySeries(r.config.Store, metric, start, end)
+	if err != nil {
+		return err
+	}
+
+	var metrics []builder.Metric
+	for _, s := range all {
+		windows := make(map[int64][]float64)
+		for _, dp := range s.points {
+			if dp.Timestamp == nil {
+				continue
+			}
+			window := dp.Timestamp.Time().Truncate(res).UnixNano() / int64(time.Millisecond)
+			windows[window] = append(windows[window], dp.Value)
+		}
+
+		for window, values := range windows {
+			stats := summarize(values)
+			for _, stat := range Stats {
+				m := builder.NewMetric(Name(metric, res, stat)).AddDataPoint(window, stats[stat])
+				for k, v := range s.tags {
+					m.AddTag(k, v)
+				}
+				metrics = append(metrics, m)
+			}
+		}
+	}
+
+	if r.config.Retention != nil {
+		r.config.Retention.Apply(metrics)
+	}
+
+	endMillis := end.UnixNano() / int64(time.Millisecond)
+	metrics = append(metrics, builder.NewMetric(WatermarkMetric).
+		AddDataPoint(endMillis, endMillis).
+		AddTag("metric", metric).
+		AddTag("resolution", FormatResolution(res)))
+
+	done := make(chan error, 1)
+	r.config.Writer.Write(metrics, func(err error) { done <- err })
+	if err := <-done; err != nil {
+		return err
+	}
+
+	r.logger.Debugf("rolled up %d series of %s to %s until %s", len(all), metric, FormatResolution(res), end)
+	return nil
+}
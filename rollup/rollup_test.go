@@ -0,0 +1,147 @@
+package rollup
+
+import (
+	"testing"
+	"time"
+
+	builder "github.com/dan-compton/go-kairosdb/builder"
+	opsee "github.com/opsee/basic/service"
+	"github.com/opsee/marktricks/store"
+	opsee_types "github.com/opsee/protobuf/opseeproto/types"
+)
+
+// storeWriter writes straight to a store, counting writes.
+type storeWriter struct {
+	store.Store
+	writes int
+}
+
+func (w *storeWriter) Write(metrics []builder.Metric, done func(error)) {
+	w.writes++
+	done(w.Store.Write(metrics))
+}
+
+// ttl sets a TTL on every metric, recording that it was applied.
+type ttl struct {
+	applied int
+}
+
+func (r *ttl) Apply(metrics []builder.Metric) {
+	for _, m := range metrics {
+		m.AddTTL(3600)
+		r.applied++
+	}
+}
+
+// countPoints returns the points of name per host in [start, end).
+func countPoints(t *testing.T, st store.Store, name string, start, end time.Time) map[string]int {
+	resp, err := st.Query(&opsee.QueryMetricsRequest{
+		StartAbsolute: opsee_types.NewTimestamp(start),
+		EndAbsolute:   opsee_types.NewTimestamp(end.Add(-time.Millisecond)),
+		Metrics:       []*opsee.QueryMetric{{Name: name, GroupBy: []*opsee.GroupBy{{Name: "tag", Tags: []string{"host"}}}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := make(map[string]int)
+	for _, result := range resp.Queries[0].Results {
+		for _, g := range result.GroupBy {
+			counts[g.Group["host"]] += len(result.Values)
+		}
+	}
+	return counts
+}
+
+func TestCatchUpAfterDowntime(t *testing.T) {
+	now := time.Now()
+	start := now.Add(-5 * time.Hour).Truncate(time.Hour)
+	down := now.Add(-3 * time.Hour).Truncate(time.Minute)
+
+	st := store.NewMemory()
+	metrics := []builder.Metric{
+		builder.NewMetric("latency").AddTag("host", "a"),
+		builder.NewMetric("latency").AddTag("host", "b"),
+	}
+	for ts := start; ts.Before(now); ts = ts.Add(10 * time.Second) {
+		for i, m := range metrics {
+			m.AddDataPoint(millis(ts), float64(i))
+		}
+	}
+	// the rollups stopped at down, when the worker went away
+	metrics = append(metrics, builder.NewMetric(WatermarkMetric).
+		AddDataPoint(millis(down), millis(down)).
+		AddTag("metric", "latency").
+		AddTag("resolution", "1m"))
+	if err := st.Write(metrics); err != nil {
+		t.Fatal(err)
+	}
+
+	writer := &storeWriter{Store: st}
+	retention := &ttl{}
+	r := New(&Config{
+		Store:       st,
+		Writer:      writer,
+		Retention:   retention,
+		Metrics:     []string{"latency"},
+		Resolutions: []time.Duration{time.Minute},
+		Interval:    time.Minute,
+		MaxRange:    time.Hour,
+	})
+
+	if err := r.catchUp("latency", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	caughtUp := r.watermarks["latency/1m"]
+	if complete := time.Now().Add(-defaultDelay).Truncate(time.Minute); caughtUp.Before(complete.Add(-time.Minute)) || caughtUp.After(complete) {
+		t.Errorf("caught up until %s, want %s", caughtUp, complete)
+	}
+	if loaded, err := loadWatermark(st, "latency", time.Minute); err != nil || !loaded.Equal(caughtUp) {
+		t.Errorf("loaded watermark %s, %v, want %s", loaded, err, caughtUp)
+	}
+
+	// an hour of raw data is rolled up at a time
+	if want := int(caughtUp.Sub(down) / time.Hour); writer.writes < want || writer.writes > want+1 {
+		t.Errorf("rolled up in %d writes, want %d or %d", writer.writes, want, want+1)
+	}
+
+	windows := int(caughtUp.Sub(down) / time.Minute)
+	for _, stat := range Stats {
+		name := Name("latency", time.Minute, stat)
+		if before := countPoints(t, st, name, start, down); len(before) != 0 {
+			t.Errorf("%s: rolled up before the watermark: %v", name, before)
+		}
+		if after := countPoints(t, st, name, down, caughtUp); after["a"] != windows || after["b"] != windows {
+			t.Errorf("%s: got windows %v since the watermark, want %d per host", name, after, windows)
+		}
+	}
+	if want := windows * 2 * len(Stats); retention.applied != want {
+		t.Errorf("retention applied to %d rollups, want %d", retention.applied, want)
+	}
+
+	// each window since the watermark has a raw point every 10s
+	resp, err := st.Query(&opsee.QueryMetricsRequest{
+		StartAbsolute: opsee_types.NewTimestamp(down),
+		EndAbsolute:   opsee_types.NewTimestamp(down),
+		Metrics: []*opsee.QueryMetric{{
+			Name: Name("latency", time.Minute, "count"),
+			Tags: map[string]*opsee.StringList{"host": {Values: []string{"b"}}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values := resp.Queries[0].Results[0].Values; len(values) != 1 || values[0].Value != 6 {
+		t.Errorf("got count rollup %v, want 6", values)
+	}
+
+	// caught up, there is nothing more to roll up
+	writes := writer.writes
+	if err := r.catchUp("latency", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if writer.writes > writes+1 {
+		t.Errorf("rolled up %d more times once caught up", writer.writes-writes)
+	}
+}
@@ -0,0 +1,145 @@
+package rollup
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/opsee/logrus"
+	"github.com/opsee/marktricks/store"
+)
+
+const watermarkCacheTTL = time.Minute
+
+// rollupAggregators maps the kairosdb aggregators a rollup can stand in for to
+// the rollup stat to read and the aggregator to apply to it. avg isn't among
+// them: an average of per-window averages weights every window equally, so it
+// differs from the average of the raw points whenever window counts differ.
+var rollupAggregators = map[string]struct{ stat, aggregator string }{
+	"min":   {"min", "min"},
+	"max":   {"max", "max"},
+	"count": {"count", "sum"},
+}
+
+type RouterConfig struct {
+	Store store.Store
+	// Metrics and Resolutions are the rollups available, see Config.
+	Metrics     []string
+	Resolutions []time.Duration
+}
+
+// Route is where to read an aggregated query from: Metric aggregated with
+// Aggregator before Split, and the raw metric from Split on.
+type Route struct {
+	Metric     string
+	Aggregator string
+	Split      time.Time
+}
+
+type cachedWatermark struct {
+	watermark time.Time
+	fetched   time.Time
+}
+
+// router picks the rollup series that can answer an aggregated query.
+type router struct {
+	config     *RouterConfig
+	metrics    map[string]bool
+	watermarks map[string]*cachedWatermark
+	mut        *sync.Mutex
+	logger     *log.Entry
+}
+
+func NewRouter(config *RouterConfig) *router {
+	r := &router{
+		config:     config,
+		metrics:    make(map[string]bool),
+		watermarks: make(map[string]*cachedWatermark),
+		mut:        &sync.Mutex{},
+		logger:     log.WithField("rollup", "router"),
+	}
+
+	if len(r.config.Resolutions) == 0 {
+		r.config.Resolutions = DefaultResolutions
+	}
+
+	// coarsest first
+	r.config.Resolutions = append([]time.Duration(nil), r.config.Resolutions...)
+	sort.Sort(sort.Reverse(durations(r.config.Resolutions)))
+
+	for _, m := range r.config.Metrics {
+		r.metrics[m] = true
+	}
+
+	return r
+}
+
+// Route returns where to read metric aggregated with aggregator every sampling
+// over [start, end), if a rollup can answer it. The rollup used is the coarsest
+// whose resolution divides sampling and whose windows start falls on, as its
+// points are at the start of each window, and it is read until its watermark,
+// rounded down to a whole sampling period from start, so no period is split
+// between the rollup and raw data.
+func (r *router) Route(metric, aggregator string, sampling time.Duration, start, end time.Time) (*Route, bool) {
+	agg, ok := rollupAggregators[aggregator]
+	if !ok || !r.metrics[metric] || sampling <= 0 {
+		return nil, false
+	}
+
+	for _, res := range r.config.Resolutions {
+		if res > sampling || sampling%res != 0 || !start.Truncate(res).Equal(start) {
+			continue
+		}
+
+		watermark, err := r.watermark(metric, res)
+		if err != nil {
+			r.logger.WithError(err).Warnf("couldn't read %s watermark, querying raw data", Name(metric, res, agg.stat))
+			return nil, false
+		}
+
+		if watermark.After(end) {
+			watermark = end
+		}
+		split := start.Add(watermark.Sub(start) / sampling * sampling)
+		if split.Sub(start) < sampling {
+			// nothing rolled up yet covers a whole period of the query
+			continue
+		}
+
+		return &Route{
+			Metric:     Name(metric, res, agg.stat),
+			Aggregator: agg.aggregator,
+			Split:      split,
+		}, true
+	}
+
+	return nil, false
+}
+
+func (r *router) watermark(metric string, res time.Duration) (time.Time, error) {
+	key := metric + "/" + FormatResolution(res)
+
+	r.mut.Lock()
+	cached, ok := r.watermarks[key]
+	r.mut.Unlock()
+	if ok && time.Since(cached.fetched) < watermarkCacheTTL {
+		return cached.watermark, nil
+	}
+
+	watermark, err := loadWatermark(r.config.Store, metric, res)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	r.mut.Lock()
+	r.watermarks[key] = &cachedWatermark{watermark: watermark, fetched: time.Now()}
+	r.mut.Unlock()
+
+	return watermark, nil
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
@@ -0,0 +1,63 @@
+package rollup
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// Stats are the statistics computed for every rollup window, in the order
+// their series are written.
+var Stats = []string{"min", "max", "avg", "count", "p50", "p95", "p99"}
+
+// Name is the name of the series holding stat of metric rolled up to res,
+// e.g. request_latency.1m.p95
+func Name(metric string, res time.Duration, stat string) string {
+	return fmt.Sprintf("%s.%s.%s", metric, FormatResolution(res), stat)
+}
+
+// FormatResolution formats res in the largest whole unit of days, hours,
+// minutes or seconds, e.g. 1d, 6h, 1m.
+func FormatResolution(res time.Duration) string {
+	switch {
+	case res%(24*time.Hour) == 0:
+		return fmt.Sprintf("%dd", res/(24*time.Hour))
+	case res%time.Hour == 0:
+		return fmt.Sprintf("%dh", res/time.Hour)
+	case res%time.Minute == 0:
+		return fmt.Sprintf("%dm", res/time.Minute)
+	default:
+		return fmt.Sprintf("%ds", res/time.Second)
+	}
+}
+
+// summarize computes every one of Stats for values, which must not be empty.
+// values is sorted in place.
+func summarize(values []float64) map[string]float64 {
+	sort.Float64s(values)
+
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+
+	return map[string]float64{
+		"min":   values[0],
+		"max":   values[len(values)-1],
+		"avg":   sum / float64(len(values)),
+		"count": float64(len(values)),
+		"p50":   percentile(values, 50),
+		"p95":   percentile(values, 95),
+		"p99":   percentile(values, 99),
+	}
+}
+
+// percentile returns the nearest-rank percentile p of sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
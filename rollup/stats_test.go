@@ -0,0 +1,80 @@
+package rollup
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSummarize(t *testing.T) {
+	tests := []struct {
+		values []float64
+		want   map[string]float64
+	}{
+		{
+			values: []float64{7},
+			want:   map[string]float64{"min": 7, "max": 7, "avg": 7, "count": 1, "p50": 7, "p95": 7, "p99": 7},
+		},
+		{
+			values: []float64{4, 1, 3, 2},
+			want:   map[string]float64{"min": 1, "max": 4, "avg": 2.5, "count": 4, "p50": 2, "p95": 4, "p99": 4},
+		},
+		{
+			values: []float64{-1, 5, -3},
+			want:   map[string]float64{"min": -3, "max": 5, "avg": 1.0 / 3, "count": 3, "p50": -1, "p95": 5, "p99": 5},
+		},
+	}
+
+	for _, test := range tests {
+		if got := summarize(test.values); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("summarize(%v) = %v, want %v", test.values, got, test.want)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	hundred := make([]float64, 100)
+	for i := range hundred {
+		hundred[i] = float64(i + 1)
+	}
+
+	tests := []struct {
+		sorted []float64
+		p      float64
+		want   float64
+	}{
+		{hundred, 50, 50},
+		{hundred, 95, 95},
+		{hundred, 99, 99},
+		{hundred, 100, 100},
+		{hundred, 0, 1},
+		{[]float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, 95, 10},
+		{[]float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, 50, 5},
+		{[]float64{1, 2}, 50, 1},
+		{[]float64{1, 2}, 51, 2},
+	}
+
+	for _, test := range tests {
+		if got := percentile(test.sorted, test.p); got != test.want {
+			t.Errorf("percentile(%d values, %v) = %v, want %v", len(test.sorted), test.p, got, test.want)
+		}
+	}
+}
+
+func TestFormatResolution(t *testing.T) {
+	tests := []struct {
+		res  time.Duration
+		want string
+	}{
+		{24 * time.Hour, "1d"},
+		{6 * time.Hour, "6h"},
+		{90 * time.Minute, "90m"},
+		{30 * time.Second, "30s"},
+	}
+
+	for _, test := range tests {
+		if got := FormatResolution(test.res); got != test.want {
+			t.Errorf("FormatResolution(%s) = %s, want %s", test.res, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package service
+
+import (
+	"errors"
+	"sort"
+
+	log "github.com/opsee/logrus"
+	"github.com/opsee/marktricks/pb"
+	"github.com/opsee/marktricks/worker"
+	"golang.org/x/net/context"
+)
+
+// CardinalityReporter reports distinct series counts for a customer, or every
+// customer if customerID is empty.
+type CardinalityReporter interface {
+	Cardinality(customerID string) []*worker.CustomerCardinality
+}
+
+var errNoCardinality = errors.New("cardinality tracking is not enabled")
+
+func (s *service) GetCardinality(ctx context.Context, in *pb.GetCardinalityRequest) (*pb.GetCardinalityResponse, error) {
+	log.Infof("received GetCardinality request: %v", in)
+	if s.cardinality == nil {
+		return nil, errNoCardinality
+	}
+
+	resp := &pb.GetCardinalityResponse{}
+	for _, c := range s.cardinality.Cardinality(in.CustomerId) {
+		cc := &pb.CustomerCardinality{
+			CustomerId: c.CustomerId,
+			Series:     int64(c.Series),
+			Dropped:    c.Dropped,
+			Limited:    c.Limited,
+		}
+		names := make([]string, 0, len(c.Metrics))
+		for name := range c.Metrics {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			cc.Metrics = append(cc.Metrics, &pb.MetricCardinality{Name: name, Series: int64(c.Metrics[name])})
+		}
+		resp.Customers = append(resp.Customers, cc)
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,267 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	builder "github.com/dan-compton/go-kairosdb/builder"
+	"github.com/gogo/protobuf/jsonpb"
+	"github.com/julienschmidt/httprouter"
+	"github.com/opsee/basic/schema"
+	"github.com/opsee/basic/tp"
+	log "github.com/opsee/logrus"
+	"github.com/opsee/marktricks/worker"
+	"golang.org/x/net/context"
+)
+
+const (
+	userKey = iota
+	requestKey
+)
+
+const (
+	maxIngestBytes = 32 << 20
+	ingestTimeout  = 30 * time.Second
+)
+
+var errWrongCustomer = errors.New("customer_id doesn't match the authorized customer")
+
+// Ingester writes check results and metrics the same way the nsq consumer
+// does, see worker.ingester.
+type Ingester interface {
+	IngestResult(result *schema.CheckResult, done func(error)) (int, error)
+	IngestMetrics(customerID string, metrics []builder.Metric, done func(error)) (int, error)
+	IngestScoped(scope *schema.CheckResult, metrics []*schema.Metric, done func(error)) (int, []error, error)
+}
+
+// PostResultsRequest is the json body of POST /results, check results encoded
+// with jsonpb. Results can also be posted as a stream of length delimited
+// protobufs with content type application/x-protobuf.
+type PostResultsRequest struct {
+	Results []json.RawMessage `json:"results"`
+}
+
+// PostMetricsRequest is the body of POST /metrics, metrics in the shape of
+// kairosdb's push api. Datapoints are [timestamp in ms, value] pairs.
+type PostMetricsRequest struct {
+	Metrics []*RawMetric `json:"metrics"`
+}
+
+type RawMetric struct {
+	Name       string            `json:"name"`
+	Tags       map[string]string `json:"tags"`
+	Datapoints [][]interface{}   `json:"datapoints"`
+}
+
+// IngestResult is whether the item at Index of a request was accepted, and
+// how many metrics were written for it.
+type IngestResult struct {
+	Index    int    `json:"index"`
+	Accepted bool   `json:"accepted"`
+	Metrics  int    `json:"metrics"`
+	Error    string `json:"error,omitempty"`
+}
+
+type IngestResponse struct {
+	Results []*IngestResult `json:"results"`
+}
+
+// ingestItem is a decoded item of a request, or why it couldn't be decoded.
+type ingestItem struct {
+	result  *schema.CheckResult
+	metrics []builder.Metric
+	err     error
+}
+
+func (s *service) ingestRoutes(router *tp.Router) {
+	if s.ingester == nil {
+		return
+	}
+
+	router.Timeout(ingestTimeout)
+	router.Handle("POST", "/results", []tp.DecodeFunc{tp.AuthorizationDecodeFunc(userKey, schema.User{}), decodeResults}, s.postResults)
+	router.Handle("POST", "/metrics", []tp.DecodeFunc{tp.AuthorizationDecodeFunc(userKey, schema.User{}), decodeMetrics}, s.postMetrics)
+}
+
+func (s *service) postResults(ctx context.Context) (interface{}, int, error) {
+	user, ok := ctx.Value(userKey).(*schema.User)
+	if !ok {
+		return nil, http.StatusUnauthorized, errors.New("unable to get user from context")
+	}
+	items, _ := ctx.Value(requestKey).([]*ingestItem)
+
+	return s.ingest(ctx, items, func(item *ingestItem, done func(error)) (int, error) {
+		if item.result.CustomerId != user.CustomerId && !user.Admin {
+			return 0, errWrongCustomer
+		}
+		return s.ingester.IngestResult(item.result, done)
+	})
+}
+
+func (s *service) postMetrics(ctx context.Context) (interface{}, int, error) {
+	user, ok := ctx.Value(userKey).(*schema.User)
+	if !ok {
+		return nil, http.StatusUnauthorized, errors.New("unable to get user from context")
+	}
+	items, _ := ctx.Value(requestKey).([]*ingestItem)
+
+	return s.ingest(ctx, items, func(item *ingestItem, done func(error)) (int, error) {
+		return s.ingester.IngestMetrics(user.CustomerId, item.metrics, done)
+	})
+}
+
+// ingest writes every decodable item and waits for them all to be written.
+func (s *service) ingest(ctx context.Context, items []*ingestItem, write func(*ingestItem, func(error)) (int, error)) (interface{}, int, error) {
+	resp := &IngestResponse{Results: make([]*IngestResult, len(items))}
+	dones := make([]chan error, len(items))
+
+	for i, item := range items {
+		resp.Results[i] = &IngestResult{Index: i}
+		if item.err != nil {
+			resp.Results[i].Error = item.err.Error()
+			continue
+		}
+
+		done := make(chan error, 1)
+		n, err := write(item, func(err error) { done <- err })
+		if err != nil {
+			resp.Results[i].Error = err.Error()
+			continue
+		}
+		resp.Results[i].Metrics = n
+		dones[i] = done
+	}
+
+	for i, done := range dones {
+		if done == nil {
+			continue
+		}
+
+		select {
+		case err := <-done:
+			if err != nil {
+				resp.Results[i].Error = err.Error()
+				continue
+			}
+			resp.Results[i].Accepted = true
+		case <-ctx.Done():
+			return nil, http.StatusServiceUnavailable, ctx.Err()
+		}
+	}
+
+	accepted := 0
+	for _, r := range resp.Results {
+		if r.Accepted {
+			accepted++
+		}
+	}
+	log.Infof("ingested %d of %d items over http", accepted, len(items))
+
+	return resp, http.StatusOK, nil
+}
+
+func decodeResults(ctx context.Context, rw http.ResponseWriter, r *http.Request, _ httprouter.Params) (context.Context, int, error) {
+	body := http.MaxBytesReader(rw, r.Body, maxIngestBytes)
+
+	var items []*ingestItem
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-protobuf") {
+		br := bufio.NewReader(body)
+		for {
+			result := &schema.CheckResult{}
+			err := worker.ReadDelimited(br, result)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				// the rest of the stream can't be framed
+				items = append(items, &ingestItem{err: fmt.Errorf("malformed result: %s", err)})
+				break
+			}
+			items = append(items, &ingestItem{result: result})
+		}
+		return context.WithValue(ctx, requestKey, items), 0, nil
+	}
+
+	req := &PostResultsRequest{}
+	if err := json.NewDecoder(body).Decode(req); err != nil {
+		return ctx, http.StatusBadRequest, fmt.Errorf("malformed request body: %s", err)
+	}
+
+	for _, raw := range req.Results {
+		result := &schema.CheckResult{}
+		if err := jsonpb.UnmarshalString(string(raw), result); err != nil {
+			items = append(items, &ingestItem{err: fmt.Errorf("malformed result: %s", err)})
+			continue
+		}
+		items = append(items, &ingestItem{result: result})
+	}
+
+	return context.WithValue(ctx, requestKey, items), 0, nil
+}
+
+func decodeMetrics(ctx context.Context, rw http.ResponseWriter, r *http.Request, _ httprouter.Params) (context.Context, int, error) {
+	req := &PostMetricsRequest{}
+	decoder := json.NewDecoder(http.MaxBytesReader(rw, r.Body, maxIngestBytes))
+	decoder.UseNumber()
+	if err := decoder.Decode(req); err != nil {
+		return ctx, http.StatusBadRequest, fmt.Errorf("malformed request body: %s", err)
+	}
+
+	var items []*ingestItem
+	for _, m := range req.Metrics {
+		metric, err := m.metric()
+		items = append(items, &ingestItem{metrics: []builder.Metric{metric}, err: err})
+	}
+
+	return context.WithValue(ctx, requestKey, items), 0, nil
+}
+
+// metric converts a raw metric, keeping integer values integers.
+func (m *RawMetric) metric() (builder.Metric, error) {
+	if m == nil {
+		return nil, errors.New("metric is null")
+	}
+
+	metric := builder.NewMetric(m.Name)
+	for k, v := range m.Tags {
+		metric.AddTag(k, v)
+	}
+
+	for _, dp := range m.Datapoints {
+		if len(dp) != 2 {
+			return nil, errors.New("datapoints must be [timestamp, value] pairs")
+		}
+
+		// decoded with UseNumber, anything else isn't a number
+		ts, ok := dp[0].(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("invalid timestamp %v", dp[0])
+		}
+		millis, err := ts.Int64()
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp %s", ts)
+		}
+
+		value, ok := dp[1].(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("invalid value %v", dp[1])
+		}
+		if v, err := value.Int64(); err == nil {
+			metric.AddDataPoint(millis, v)
+			continue
+		}
+		v, err := value.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %s", value)
+		}
+		metric.AddDataPoint(millis, v)
+	}
+
+	return metric, nil
+}
@@ -0,0 +1,302 @@
+package service
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+
+	builder "github.com/dan-compton/go-kairosdb/builder"
+	"github.com/opsee/basic/schema"
+	"github.com/opsee/basic/tp"
+	"github.com/opsee/marktricks/store"
+	"github.com/opsee/marktricks/worker"
+	"golang.org/x/net/context"
+)
+
+// fakeIngester accepts results with a check id and fails to write those of
+// check "unwritable", or metrics named "unwritable".
+type fakeIngester struct {
+	results []string
+	metrics []string
+}
+
+func (f *fakeIngester) IngestResult(result *schema.CheckResult, done func(error)) (int, error) {
+	if result.CheckId == "" {
+		return 0, errors.New("missing check id")
+	}
+
+	f.results = append(f.results, result.CustomerId+"/"+result.CheckId)
+	if result.CheckId == "unwritable" {
+		done(errors.New("write failed"))
+	} else {
+		done(nil)
+	}
+	return len(result.Responses), nil
+}
+
+func (f *fakeIngester) IngestMetrics(customerID string, metrics []builder.Metric, done func(error)) (int, error) {
+	var err error
+	for _, m := range metrics {
+		for _, dp := range m.GetDataPoints() {
+			value := "unknown"
+			if v, err := dp.Int64Value(); err == nil {
+				value = fmt.Sprintf("int %d", v)
+			} else if v, err := dp.Float64Value(); err == nil {
+				value = fmt.Sprintf("float %g", v)
+			}
+			f.metrics = append(f.metrics, fmt.Sprintf("%s %s %d %s", customerID, m.GetName(), dp.Timestamp(), value))
+		}
+		if m.GetName() == "unwritable" {
+			err = errors.New("write failed")
+		}
+	}
+	done(err)
+	return len(metrics), nil
+}
+
+func (f *fakeIngester) IngestScoped(scope *schema.CheckResult, metrics []*schema.Metric, done func(error)) (int, []error, error) {
+	return 0, nil, errors.New("not implemented")
+}
+
+func authorization(customerID string, admin bool) string {
+	b, _ := json.Marshal(&schema.User{Id: 1, CustomerId: customerID, Email: "user@example.com", Active: true, Admin: admin})
+	return "Basic " + base64.StdEncoding.EncodeToString(b)
+}
+
+// describeIngest renders a response as "index: metrics=n" lines for accepted
+// items and "index: error" for the rest.
+func describeIngest(t *testing.T, body []byte) []string {
+	resp := &IngestResponse{}
+	if err := json.Unmarshal(body, resp); err != nil {
+		t.Fatalf("undecodable response %q: %s", body, err)
+	}
+
+	lines := []string{}
+	for i, r := range resp.Results {
+		if r.Index != i {
+			t.Errorf("result %d has index %d", i, r.Index)
+		}
+		if r.Accepted {
+			lines = append(lines, fmt.Sprintf("%d: metrics=%d", r.Index, r.Metrics))
+		} else {
+			lines = append(lines, fmt.Sprintf("%d: %s", r.Index, r.Error))
+		}
+	}
+	return lines
+}
+
+func testIngestRouter(t *testing.T, ingester Ingester) *tp.Router {
+	s, err := New(&Config{Store: store.NewMemory(), Ingester: ingester})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := tp.NewHTTPRouter(context.Background())
+	s.ingestRoutes(router)
+	return router
+}
+
+func TestPostResults(t *testing.T) {
+	results := `{"results": [
+		{"customer_id": "customer-1", "check_id": "check-1", "responses": [{"target": {"id": "i-1"}}, {"target": {"id": "i-2"}}]},
+		{"customer_id": "customer-2", "check_id": "check-2"},
+		{"customer_id": "customer-1", "check_id": 5},
+		{"customer_id": "customer-1"},
+		{"customer_id": "customer-1", "check_id": "unwritable"}
+	]}`
+
+	tests := []struct {
+		name          string
+		authorization string
+		contentType   string
+		body          []byte
+		wantStatus    int
+		want          []string
+		wantIngested  []string
+	}{
+		{
+			name:          "mixed",
+			authorization: authorization("customer-1", false),
+			body:          []byte(results),
+			wantStatus:    http.StatusOK,
+			want: []string{
+				"0: metrics=2",
+				"1: " + errWrongCustomer.Error(),
+				"2: malformed result: json: cannot unmarshal number into Go value of type string",
+				"3: missing check id",
+				"4: write failed",
+			},
+			wantIngested: []string{"customer-1/check-1", "customer-1/unwritable"},
+		},
+		{
+			name:          "admin",
+			authorization: authorization("customer-1", true),
+			body:          []byte(results),
+			wantStatus:    http.StatusOK,
+			want: []string{
+				"0: metrics=2",
+				"1: metrics=0",
+				"2: malformed result: json: cannot unmarshal number into Go value of type string",
+				"3: missing check id",
+				"4: write failed",
+			},
+			wantIngested: []string{"customer-1/check-1", "customer-1/unwritable", "customer-2/check-2"},
+		},
+		{
+			name:          "protobuf",
+			authorization: authorization("customer-1", false),
+			contentType:   "application/x-protobuf",
+			body: func() []byte {
+				var b bytes.Buffer
+				worker.WriteDelimited(&b, &schema.CheckResult{CustomerId: "customer-1", CheckId: "check-1"})
+				worker.WriteDelimited(&b, &schema.CheckResult{CustomerId: "customer-1", CheckId: "check-2"})
+				// a length with a truncated result
+				return append(b.Bytes(), 10, 1)
+			}(),
+			wantStatus:   http.StatusOK,
+			want:         []string{"0: metrics=0", "1: metrics=0", "2: malformed result: unexpected EOF"},
+			wantIngested: []string{"customer-1/check-1", "customer-1/check-2"},
+		},
+		{
+			name:          "malformed body",
+			authorization: authorization("customer-1", false),
+			body:          []byte(`{"results": {}}`),
+			wantStatus:    http.StatusBadRequest,
+		},
+		{
+			name:       "unauthorized",
+			body:       []byte(results),
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:          "malformed authorization",
+			authorization: "Basic not-base64",
+			body:          []byte(results),
+			wantStatus:    http.StatusUnauthorized,
+		},
+		{
+			name:          "invalid user",
+			authorization: "Basic " + base64.StdEncoding.EncodeToString([]byte(`{"id": 1, "customer_id": "customer-1"}`)),
+			body:          []byte(results),
+			wantStatus:    http.StatusUnauthorized,
+		},
+	}
+
+	for _, test := range tests {
+		ingester := &fakeIngester{}
+		router := testIngestRouter(t, ingester)
+
+		req := httptest.NewRequest("POST", "/results", bytes.NewReader(test.body))
+		req.Header.Set("Authorization", test.authorization)
+		if test.contentType != "" {
+			req.Header.Set("Content-Type", test.contentType)
+		}
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, req)
+
+		if rw.Code != test.wantStatus {
+			t.Errorf("%s: got status %d, want %d: %s", test.name, rw.Code, test.wantStatus, rw.Body)
+			continue
+		}
+
+		sort.Strings(ingester.results)
+		if !reflect.DeepEqual(ingester.results, test.wantIngested) {
+			t.Errorf("%s: ingested %q, want %q", test.name, ingester.results, test.wantIngested)
+		}
+		if test.wantStatus != http.StatusOK {
+			continue
+		}
+		if got := describeIngest(t, rw.Body.Bytes()); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got response %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPostMetrics(t *testing.T) {
+	body := `{"metrics": [
+		{"name": "requests", "tags": {"host": "a"}, "datapoints": [[1500000000000, 5], [1500000060000, 7]]},
+		{"name": "latency", "datapoints": [[1500000000000, 0.25]]},
+		{"name": "latency", "datapoints": [[1500000000000]]},
+		{"name": "latency", "datapoints": [["yesterday", 1]]},
+		{"name": "latency", "datapoints": [[1500000000000, "slow"]]},
+		null,
+		{"name": "unwritable", "datapoints": [[1500000000000, 1]]}
+	]}`
+
+	tests := []struct {
+		name          string
+		authorization string
+		body          string
+		wantStatus    int
+		want          []string
+		wantIngested  []string
+	}{
+		{
+			name:          "mixed",
+			authorization: authorization("customer-1", false),
+			body:          body,
+			wantStatus:    http.StatusOK,
+			want: []string{
+				"0: metrics=1",
+				"1: metrics=1",
+				"2: datapoints must be [timestamp, value] pairs",
+				"3: invalid timestamp yesterday",
+				"4: invalid value slow",
+				"5: metric is null",
+				"6: write failed",
+			},
+			// metrics are written for the authorized customer, keeping
+			// integers integers
+			wantIngested: []string{
+				"customer-1 latency 1500000000000 float 0.25",
+				"customer-1 requests 1500000000000 int 5",
+				"customer-1 requests 1500000060000 int 7",
+				"customer-1 unwritable 1500000000000 int 1",
+			},
+		},
+		{
+			name:          "malformed body",
+			authorization: authorization("customer-1", false),
+			body:          `{"metrics": [`,
+			wantStatus:    http.StatusBadRequest,
+		},
+		{
+			name:       "unauthorized",
+			body:       body,
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, test := range tests {
+		ingester := &fakeIngester{}
+		router := testIngestRouter(t, ingester)
+
+		req := httptest.NewRequest("POST", "/metrics", bytes.NewReader([]byte(test.body)))
+		req.Header.Set("Authorization", test.authorization)
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, req)
+
+		if rw.Code != test.wantStatus {
+			t.Errorf("%s: got status %d, want %d: %s", test.name, rw.Code, test.wantStatus, rw.Body)
+			continue
+		}
+
+		sort.Strings(ingester.metrics)
+		if !reflect.DeepEqual(ingester.metrics, test.wantIngested) {
+			t.Errorf("%s: ingested %q, want %q", test.name, ingester.metrics, test.wantIngested)
+		}
+		if test.wantStatus != http.StatusOK {
+			continue
+		}
+		if got := describeIngest(t, rw.Body.Bytes()); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got response %q, want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -1,64 +1,50 @@
 package service
 
 import (
-	"bytes"
-	"encoding/json"
-	"errors"
 	"fmt"
-	"io/ioutil"
-	"net/http"
+	"strconv"
 	"time"
 
 	kdbutil "github.com/dan-compton/go-kairosdb/builder/utils"
 
 	opsee_types "github.com/opsee/protobuf/opseeproto/types"
 
-	"github.com/dan-compton/go-kairosdb/builder"
-	"github.com/hashicorp/go-multierror"
 	"github.com/opsee/basic/schema"
 	opsee "github.com/opsee/basic/service"
 	log "github.com/opsee/logrus"
 	"golang.org/x/net/context"
 )
 
-const KdbQueryPath = "api/v1/datapoints/query"
-
 // New endpoint to replace GetMetrics
 func (s *service) QueryMetrics(ctx context.Context, in *opsee.QueryMetricsRequest) (*opsee.QueryMetricsResponse, error) {
 	log.Infof("received GetMetrics request: %v", in)
 
-	b, err := json.Marshal(in)
-	if err != nil {
+	if err := s.guardRetention(in); err != nil {
 		return nil, err
 	}
 
-	hreq, err := http.NewRequest("POST", fmt.Sprintf("%s/%s", s.kdbAddress, KdbQueryPath), bytes.NewBuffer(b))
-	hreq.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(hreq)
-	if err != nil {
-		panic(err)
+	shadowed := s.shadow.sample()
+	if shadowed && in.EndAbsolute == nil {
+		// pin the end so the shadow store is asked for the same range
+		in.EndAbsolute = opsee_types.NewTimestamp(time.Now())
 	}
-	defer resp.Body.Close()
-	body, _ := ioutil.ReadAll(resp.Body)
 
-	gr := &opsee.QueryMetricsResponse{}
-	err = json.Unmarshal(body, &gr)
-	if err != nil {
-		return nil, err
+	var (
+		out *opsee.QueryMetricsResponse
+		err error
+	)
+	routed, ok := s.routeQuery(in)
+	if ok {
+		out, err = s.queryRouted(s.store, routed)
+	} else {
+		out, err = s.store.Query(in)
 	}
 
-	// handle errors field
-	if len(gr.Errors) > 0 {
-		var errs error
-		for _, e := range gr.Errors {
-			errs = multierror.Append(errs, errors.New(e))
-		}
-		return nil, errs
+	if err == nil && shadowed {
+		s.shadowQuery(in, routed, out)
 	}
 
-	return gr, nil
+	return out, err
 }
 
 // Legacy, here for compatibility
@@ -119,51 +105,52 @@ func (s *service) GetMetrics(ctx context.Context, in *opsee.GetMetricsRequest) (
 		return &opsee.GetMetricsResponse{Results: res}, fmt.Errorf("invalid absolute_start_time or absolute_end_time")
 	}
 
-	// convert basicproto metrics to client querymetrics
-	// TODO(dan) use protobuf when rewriting client or add protobuf to match this client lib
-	// TODO(dan) save units?
-	qb := builder.NewQueryBuilder().SetAbsoluteStart(ast).SetAbsoluteEnd(aet)
+	// convert basicproto metrics to a query
+	query := &opsee.QueryMetricsRequest{
+		StartAbsolute: opsee_types.NewTimestamp(ast),
+		EndAbsolute:   opsee_types.NewTimestamp(aet),
+	}
 	for _, m := range in.Metrics {
 		if m.Name == "" {
 			log.Warn("query missing metric name")
 			continue
 		}
-		nm := builder.NewQueryMetric(m.Name)
-		tags := map[string]string{}
+		qm := &opsee.QueryMetric{
+			Name: m.Name,
+			Tags: map[string]*opsee.StringList{},
+		}
 		for _, t := range m.Tags {
 			if t.Name != "" && t.Value != "" {
-				tags[t.Name] = t.Value
+				qm.Tags[t.Name] = &opsee.StringList{Values: []string{t.Value}}
 			}
 		}
-		if len(tags) > 0 {
-			nm.AddTags(tags)
-		}
 
 		if in.Aggregation != nil {
-			switch m.Statistic {
-			case "avg":
-				nm.AddAggregator(builder.CreateAverageAggregator(int(agPeriod), agUnit))
-			case "sum":
-				nm.AddAggregator(builder.CreateSumAggregator(int(agPeriod), agUnit))
-			case "min":
-				nm.AddAggregator(builder.CreateMaxAggregator(int(agPeriod), agUnit))
-			case "max":
-				nm.AddAggregator(builder.CreateMinAggregator(int(agPeriod), agUnit))
-			default:
+			agName, ok := legacyAggregator(m.Statistic)
+			if !ok {
 				continue
 			}
+			qm.Aggregators = []*opsee.Aggregator{{
+				Name:     agName,
+				Sampling: &opsee.Sampling{Value: strconv.FormatInt(agPeriod, 10), Unit: string(agUnit)},
+			}}
 		}
 
-		qb.AddRealMetric(nm)
+		query.Metrics = append(query.Metrics, qm)
 	}
-	log.Infof("Querying with %v", qb)
+	log.Infof("Querying with %v", query)
 
 	// execute the query
-	qr, err := s.kclient.Query(qb)
+	var qr *opsee.QueryMetricsResponse
+	if routed, ok := s.routeQuery(query); ok {
+		qr, err = s.queryRouted(s.store, routed)
+	} else {
+		qr, err = s.store.Query(query)
+	}
 	if err == nil {
 		// parse the query response into basicproto metrics
-		for _, query := range qr.QueriesArr {
-			for _, result := range query.ResultsArr {
+		for _, query := range qr.Queries {
+			for _, result := range query.Results {
 				nqr := &opsee.QueryResult{
 					Metrics: []*schema.Metric{},
 					Groups:  []*opsee.Group{},
@@ -172,32 +159,25 @@ func (s *service) GetMetrics(ctx context.Context, in *opsee.GetMetricsRequest) (
 				// get tags to set in basicproto metric
 				var tags []*schema.Tag
 				for k, v := range result.Tags {
-					if len(v) == 0 {
+					if v == nil || len(v.Values) == 0 {
 						continue
 					}
-					tags = append(tags, &schema.Tag{Name: k, Value: v[0]})
+					tags = append(tags, &schema.Tag{Name: k, Value: v.Values[0]})
 				}
 
-				for _, datap := range result.DataPoints {
-					ts := &opsee_types.Timestamp{}
-					tserr := ts.Scan(datap.Timestamp())
-					if tserr != nil {
-						continue
-					}
-
-					val, err := datap.Float64Value()
-					if err != nil {
+				for _, datap := range result.Values {
+					if datap.Timestamp == nil {
 						continue
 					}
 
 					nqr.Metrics = append(nqr.Metrics, &schema.Metric{
 						Name:      result.Name,
-						Value:     val,
-						Timestamp: ts,
+						Value:     datap.Value,
+						Timestamp: datap.Timestamp,
 						Tags:      tags,
 					})
 				}
-				for _, g := range result.Group {
+				for _, g := range result.GroupBy {
 					nqr.Groups = append(nqr.Groups, &opsee.Group{Name: g.Name})
 				}
 				res = append(res, nqr)
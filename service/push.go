@@ -0,0 +1,55 @@
+package service
+
+import (
+	"errors"
+
+	"github.com/opsee/basic/schema"
+	log "github.com/opsee/logrus"
+	"github.com/opsee/marktricks/pb"
+	"golang.org/x/net/context"
+)
+
+var errNoIngester = errors.New("ingestion is not enabled")
+
+// PushMetrics writes metrics reported on behalf of a customer. Metrics that
+// can't be written are reported by index and the rest are written, the call
+// fails if the scope is invalid or the accepted metrics couldn't be written.
+func (s *service) PushMetrics(ctx context.Context, in *pb.PushMetricsRequest) (*pb.PushMetricsResponse, error) {
+	log.Infof("received PushMetrics request for customer %s with %d metrics", in.CustomerId, len(in.Metrics))
+	if s.ingester == nil {
+		return nil, errNoIngester
+	}
+
+	scope := &schema.CheckResult{
+		CustomerId: in.CustomerId,
+		CheckId:    in.CheckId,
+		BastionId:  in.BastionId,
+		Region:     in.Region,
+		Target:     in.Target,
+	}
+
+	done := make(chan error, 1)
+	accepted, errs, err := s.ingester.IngestScoped(scope, in.Metrics, func(err error) { done <- err })
+	if err != nil {
+		return nil, err
+	}
+
+	// metrics dropped by the cardinality guard are neither errors nor accepted
+	resp := &pb.PushMetricsResponse{Accepted: int64(accepted)}
+	for i, err := range errs {
+		if err != nil {
+			resp.Errors = append(resp.Errors, &pb.PointError{Index: int32(i), Error: err.Error()})
+		}
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil, err
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	return resp, nil
+}
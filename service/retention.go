@@ -0,0 +1,71 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	opsee "github.com/opsee/basic/service"
+	log "github.com/opsee/logrus"
+	opsee_types "github.com/opsee/protobuf/opseeproto/types"
+)
+
+const (
+	// RetentionClamp moves the start of queries older than retention up to it.
+	RetentionClamp = "clamp"
+	// RetentionReject fails queries that start before retention.
+	RetentionReject = "reject"
+
+	defaultCustomerTag = "customer"
+)
+
+var errBeforeRetention = errors.New("query starts before the retention period")
+
+// RetentionPolicy reports how long a customer's points are kept, zero is forever.
+type RetentionPolicy interface {
+	Retention(customerID string) time.Duration
+}
+
+// guardRetention clamps or rejects a query starting before the shortest
+// retention of the customers it queries. Queries that don't name a customer
+// are held to the default retention.
+func (s *service) guardRetention(in *opsee.QueryMetricsRequest) error {
+	if s.retention == nil || in.StartAbsolute == nil {
+		return nil
+	}
+
+	var (
+		shortest  time.Duration
+		customers []string
+	)
+	for _, m := range in.Metrics {
+		if list, ok := m.Tags[s.customerTag]; ok && list != nil {
+			customers = append(customers, list.Values...)
+		}
+	}
+	if len(customers) == 0 {
+		customers = []string{""}
+	}
+
+	for _, c := range customers {
+		if r := s.retention.Retention(c); r > 0 && (shortest == 0 || r < shortest) {
+			shortest = r
+		}
+	}
+	if shortest == 0 {
+		return nil
+	}
+
+	earliest := time.Now().Add(-shortest)
+	if !in.StartAbsolute.Time().Before(earliest) {
+		return nil
+	}
+
+	if s.retentionMode == RetentionReject {
+		return fmt.Errorf("%s: earliest start is %s", errBeforeRetention, earliest.Format(time.RFC3339))
+	}
+
+	log.Infof("clamping query start %s to retention %s", in.StartAbsolute.Time(), earliest)
+	in.StartAbsolute = opsee_types.NewTimestamp(earliest)
+	return nil
+}
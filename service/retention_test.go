@@ -0,0 +1,79 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	opsee "github.com/opsee/basic/service"
+	opsee_types "github.com/opsee/protobuf/opseeproto/types"
+)
+
+type retentionMap map[string]time.Duration
+
+func (r retentionMap) Retention(customerID string) time.Duration {
+	return r[customerID]
+}
+
+func TestGuardRetention(t *testing.T) {
+	policy := retentionMap{"": 30 * 24 * time.Hour, "short": 24 * time.Hour}
+	start := time.Now().Add(-7 * 24 * time.Hour)
+
+	tests := []struct {
+		name        string
+		customerTag string
+		mode        string
+		tags        map[string]*opsee.StringList
+		wantClamp   bool
+		wantErr     bool
+	}{
+		{
+			name:      "default retention",
+			tags:      map[string]*opsee.StringList{"customer": {Values: []string{"long"}}},
+			wantClamp: false,
+		},
+		{
+			name:      "customer retention",
+			tags:      map[string]*opsee.StringList{"customer": {Values: []string{"long", "short"}}},
+			wantClamp: true,
+		},
+		{
+			name:        "renamed customer tag",
+			customerTag: "tenant",
+			tags:        map[string]*opsee.StringList{"tenant": {Values: []string{"short"}}},
+			wantClamp:   true,
+		},
+		{
+			name:        "other tags aren't customers",
+			customerTag: "tenant",
+			tags:        map[string]*opsee.StringList{"customer": {Values: []string{"short"}}},
+			wantClamp:   false,
+		},
+		{
+			name:    "reject",
+			mode:    RetentionReject,
+			tags:    map[string]*opsee.StringList{"customer": {Values: []string{"short"}}},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		s, err := New(&Config{Retention: policy, RetentionMode: test.mode, CustomerTag: test.customerTag})
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		in := &opsee.QueryMetricsRequest{
+			Metrics:       []*opsee.QueryMetric{{Name: "request_latency", Tags: test.tags}},
+			StartAbsolute: opsee_types.NewTimestamp(start),
+		}
+		err = s.guardRetention(in)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %t", test.name, err, test.wantErr)
+			continue
+		}
+
+		if clamped := in.StartAbsolute.Millis() != start.UnixNano()/int64(time.Millisecond); clamped != test.wantClamp {
+			t.Errorf("%s: clamped %t, want %t", test.name, clamped, test.wantClamp)
+		}
+	}
+}
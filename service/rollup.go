@@ -0,0 +1,232 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	opsee "github.com/opsee/basic/service"
+	log "github.com/opsee/logrus"
+	"github.com/opsee/marktricks/rollup"
+	"github.com/opsee/marktricks/store"
+	opsee_types "github.com/opsee/protobuf/opseeproto/types"
+)
+
+// Router picks the rollup series, if any, that can answer an aggregated query.
+type Router interface {
+	Route(metric, aggregator string, sampling time.Duration, start, end time.Time) (*rollup.Route, bool)
+}
+
+var samplingUnits = map[string]time.Duration{
+	"milliseconds": time.Millisecond,
+	"seconds":      time.Second,
+	"minutes":      time.Minute,
+	"hours":        time.Hour,
+	"days":         24 * time.Hour,
+	"weeks":        7 * 24 * time.Hour,
+}
+
+// samplingDuration converts a kairosdb sampling to a duration. Months and years
+// vary in length and are not converted.
+func samplingDuration(value int64, unit string) (time.Duration, bool) {
+	d, ok := samplingUnits[unit]
+	if !ok || value <= 0 {
+		return 0, false
+	}
+	return time.Duration(value) * d, true
+}
+
+// legacyAggregator is the kairosdb aggregator GetMetrics uses for a statistic.
+// GetMetrics has always answered min with kairosdb's max and max with min;
+// existing callers depend on it.
+func legacyAggregator(statistic string) (string, bool) {
+	switch statistic {
+	case "avg", "sum":
+		return statistic, true
+	case "min":
+		return "max", true
+	case "max":
+		return "min", true
+	}
+	return "", false
+}
+
+// routedQuery is a query split between rollups and raw data. rolled reads the
+// rollups until the split, raw reads the same metrics' raw data from the split
+// on and rest reads the metrics that weren't routed. indexes map the metrics of
+// each back to their position in the original query.
+type routedQuery struct {
+	original    *opsee.QueryMetricsRequest
+	rolled      *opsee.QueryMetricsRequest
+	raw         *opsee.QueryMetricsRequest
+	rest        *opsee.QueryMetricsRequest
+	routed      []int
+	restIndexes []int
+}
+
+// routeQuery routes the metrics of a query with a single sampled aggregator
+// that a rollup can answer. All the routed metrics switch to raw data at the
+// earliest of their splits, metrics whose sampling doesn't line up with it
+// aren't routed.
+func (s *service) routeQuery(in *opsee.QueryMetricsRequest) (*routedQuery, bool) {
+	if s.rollups == nil || in.StartAbsolute == nil {
+		return nil, false
+	}
+
+	start, end := in.StartAbsolute.Time(), time.Now()
+	if in.EndAbsolute != nil {
+		end = in.EndAbsolute.Time()
+	}
+
+	var (
+		routes    = make(map[int]*rollup.Route)
+		samplings = make(map[int]time.Duration)
+		split     time.Time
+	)
+	for i, m := range in.Metrics {
+		if len(m.Aggregators) != 1 || m.Aggregators[0].Sampling == nil {
+			continue
+		}
+
+		agg := m.Aggregators[0]
+		value, err := strconv.ParseInt(agg.Sampling.Value, 10, 64)
+		if err != nil {
+			continue
+		}
+		sampling, ok := samplingDuration(value, agg.Sampling.Unit)
+		if !ok {
+			continue
+		}
+
+		if route, ok := s.rollups.Route(m.Name, agg.Name, sampling, start, end); ok {
+			routes[i] = route
+			samplings[i] = sampling
+			if split.IsZero() || route.Split.Before(split) {
+				split = route.Split
+			}
+		}
+	}
+
+	if len(routes) == 0 {
+		return nil, false
+	}
+
+	rolled, raw, rest := *in, *in, *in
+	rolled.Metrics, raw.Metrics, rest.Metrics = nil, nil, nil
+	rolled.EndAbsolute = opsee_types.NewTimestamp(split.Add(-time.Millisecond))
+	raw.StartAbsolute = opsee_types.NewTimestamp(split)
+
+	q := &routedQuery{original: in, rolled: &rolled, raw: &raw, rest: &rest}
+	for i, m := range in.Metrics {
+		route, ok := routes[i]
+		if !ok || split.Sub(start)%samplings[i] != 0 {
+			rest.Metrics = append(rest.Metrics, m)
+			q.restIndexes = append(q.restIndexes, i)
+			continue
+		}
+
+		rm := *m
+		rm.Name = route.Metric
+		rm.Aggregators = []*opsee.Aggregator{{
+			Name:          route.Aggregator,
+			AlignSampling: m.Aggregators[0].AlignSampling,
+			Sampling:      m.Aggregators[0].Sampling,
+		}}
+		rolled.Metrics = append(rolled.Metrics, &rm)
+		raw.Metrics = append(raw.Metrics, m)
+		q.routed = append(q.routed, i)
+	}
+
+	log.Infof("routing %d of %d metrics to rollups until %s", len(q.routed), len(in.Metrics), split)
+	return q, true
+}
+
+// queryRouted runs the parts of a routed query against st and stitches their
+// results back together in the order of the original query.
+func (s *service) queryRouted(st store.Store, q *routedQuery) (*opsee.QueryMetricsResponse, error) {
+	out := &opsee.QueryMetricsResponse{
+		Queries: make([]*opsee.Query, len(q.original.Metrics)),
+	}
+
+	rolled, err := st.Query(q.rolled)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := st.Query(q.raw)
+	if err != nil {
+		return nil, err
+	}
+
+	for j, i := range q.routed {
+		out.Queries[i] = stitch(q.original.Metrics[i].Name, queryAt(rolled, j), queryAt(raw, j))
+	}
+
+	if len(q.restIndexes) > 0 {
+		rest, err := st.Query(q.rest)
+		if err != nil {
+			return nil, err
+		}
+
+		for j, i := range q.restIndexes {
+			out.Queries[i] = queryAt(rest, j)
+		}
+	}
+
+	for i := range out.Queries {
+		if out.Queries[i] == nil {
+			out.Queries[i] = &opsee.Query{}
+		}
+	}
+
+	return out, nil
+}
+
+func queryAt(resp *opsee.QueryMetricsResponse, i int) *opsee.Query {
+	if i < len(resp.Queries) {
+		return resp.Queries[i]
+	}
+	return &opsee.Query{}
+}
+
+// stitch appends the raw results to the rolled up results of the same group,
+// naming them all after the raw metric.
+func stitch(name string, rolled, raw *opsee.Query) *opsee.Query {
+	if rolled == nil {
+		rolled = &opsee.Query{}
+	}
+
+	groups := make(map[string]*opsee.Result)
+	for _, result := range rolled.Results {
+		result.Name = name
+		groups[groupKey(result)] = result
+	}
+
+	if raw == nil {
+		return rolled
+	}
+
+	for _, result := range raw.Results {
+		if r, ok := groups[groupKey(result)]; ok {
+			r.Values = append(r.Values, result.Values...)
+			continue
+		}
+		rolled.Results = append(rolled.Results, result)
+	}
+
+	return rolled
+}
+
+// groupKey identifies a result by the tag values it was grouped by.
+func groupKey(result *opsee.Result) string {
+	var parts []string
+	for _, g := range result.GroupBy {
+		for k, v := range g.Group {
+			parts = append(parts, fmt.Sprintf("%s=%s", k, v))
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
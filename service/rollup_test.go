@@ -0,0 +1,155 @@
+package service
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	builder "github.com/dan-compton/go-kairosdb/builder"
+	opsee "github.com/opsee/basic/service"
+	"github.com/opsee/marktricks/rollup"
+	"github.com/opsee/marktricks/store"
+	opsee_types "github.com/opsee/protobuf/opseeproto/types"
+)
+
+// storeWriter writes straight to a store.
+type storeWriter struct {
+	store.Store
+}
+
+func (w storeWriter) Write(metrics []builder.Metric, done func(error)) {
+	done(w.Store.Write(metrics))
+}
+
+// rolledUpStore returns a memory store with raw points of latency every 10s
+// for two hosts since start, rolled up to minutes and hours.
+func rolledUpStore(t *testing.T, start time.Time) store.Store {
+	st := store.NewMemory()
+
+	var metrics []builder.Metric
+	for _, host := range []string{"a", "bb"} {
+		m := builder.NewMetric("latency").AddTag("host", host)
+		for i, ts := 0, start; ts.Before(time.Now()); i, ts = i+1, ts.Add(10*time.Second) {
+			m.AddDataPoint(ts.UnixNano()/int64(time.Millisecond), float64(i*len(host)))
+		}
+		metrics = append(metrics, m)
+	}
+	if err := st.Write(metrics); err != nil {
+		t.Fatal(err)
+	}
+
+	roller := rollup.New(&rollup.Config{
+		Store:       st,
+		Writer:      storeWriter{st},
+		Metrics:     []string{"latency"},
+		Resolutions: []time.Duration{time.Minute, time.Hour},
+		Lookback:    time.Since(start) + time.Hour,
+	})
+	roller.Start()
+	defer roller.Stop(time.Second)
+
+	// both resolutions are caught up in one pass each
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		resp, err := st.QueryTags(&opsee.QueryMetricsRequest{
+			StartAbsolute: opsee_types.NewTimestamp(start),
+			Metrics:       []*opsee.QueryMetric{{Name: rollup.WatermarkMetric}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tags := resp.Queries[0].Results[0].Tags["resolution"]; tags != nil && len(tags.Values) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out rolling up")
+		}
+	}
+
+	return st
+}
+
+// describeResults renders the results of a query as "group: millis=value ..."
+// lines.
+func describeResults(q *opsee.Query) []string {
+	var lines []string
+	for _, r := range q.Results {
+		line := groupKey(r) + ":"
+		for _, dp := range r.Values {
+			line += fmt.Sprintf(" %d=%v", dp.Timestamp.Millis(), dp.Value)
+		}
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func TestRouteQuery(t *testing.T) {
+	// whole seconds, since opsee_types.Timestamp drops the rest of millis
+	now := time.Now().Truncate(time.Second)
+	base := now.Add(-4 * time.Hour).Truncate(time.Hour)
+	st := rolledUpStore(t, base)
+
+	s, err := New(&Config{
+		Store: st,
+		Rollups: rollup.NewRouter(&rollup.RouterConfig{
+			Store:       st,
+			Metrics:     []string{"latency"},
+			Resolutions: []time.Duration{time.Minute, time.Hour},
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		start      time.Time
+		aggregator string
+		sampling   *opsee.Sampling
+		wantRouted bool
+	}{
+		{"aligned", base, "max", &opsee.Sampling{Value: "5", Unit: "minutes"}, true},
+		{"aligned count", base, "count", &opsee.Sampling{Value: "1", Unit: "hours"}, true},
+		{"unaligned", base.Add(30 * time.Second), "max", &opsee.Sampling{Value: "5", Unit: "minutes"}, false},
+		{"off the coarser resolution", base.Add(5 * time.Minute), "min", &opsee.Sampling{Value: "1", Unit: "hours"}, true},
+	}
+
+	for _, test := range tests {
+		in := &opsee.QueryMetricsRequest{
+			StartAbsolute: opsee_types.NewTimestamp(test.start),
+			EndAbsolute:   opsee_types.NewTimestamp(now),
+			Metrics: []*opsee.QueryMetric{{
+				Name:        "latency",
+				GroupBy:     []*opsee.GroupBy{{Name: "tag", Tags: []string{"host"}}},
+				Aggregators: []*opsee.Aggregator{{Name: test.aggregator, Sampling: test.sampling}},
+			}},
+		}
+
+		want, err := st.Query(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		routed, ok := s.routeQuery(in)
+		if ok != test.wantRouted {
+			t.Errorf("%s: routed %t, want %t", test.name, ok, test.wantRouted)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if !routed.rolled.EndAbsolute.Time().Before(now) {
+			t.Errorf("%s: rollups read until %s, nothing left for raw data", test.name, routed.rolled.EndAbsolute.Time())
+		}
+
+		got, err := s.queryRouted(st, routed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if g, w := describeResults(got.Queries[0]), describeResults(want.Queries[0]); !reflect.DeepEqual(g, w) {
+			t.Errorf("%s: routed query answered\n%s\nraw data answers\n%s", test.name, g, w)
+		}
+	}
+}
@@ -2,30 +2,88 @@ package service
 
 import (
 	"crypto/tls"
+	"fmt"
 	"net/http"
+	"sync"
+	"time"
 
 	"golang.org/x/net/context"
 
 	opsee "github.com/opsee/basic/service"
+	"github.com/opsee/marktricks/pb"
+	"github.com/opsee/marktricks/store"
 	"google.golang.org/grpc"
 
-	client "github.com/dan-compton/go-kairosdb/client"
 	"github.com/opsee/basic/grpcutil"
 	"github.com/opsee/basic/tp"
 	log "github.com/opsee/logrus"
 )
 
+type Config struct {
+	Store store.Store
+	// Cardinality reports ingest series counts, GetCardinality is unavailable
+	// if it is nil.
+	Cardinality CardinalityReporter
+	// Retention bounds how far back QueryMetrics may start, RetentionMode is
+	// what happens to queries starting earlier, clamp or reject.
+	Retention     RetentionPolicy
+	RetentionMode string
+	// CustomerTag is the series tag naming the customer queries are for,
+	// customer by default.
+	CustomerTag string
+	// Rollups routes aggregated queries to rollup series, queries always read
+	// raw data if it is nil.
+	Rollups Router
+	// Shadow compares a sample of QueryMetrics answers with another store's,
+	// nothing is compared if it is nil.
+	Shadow *ShadowConfig
+	// Ingester writes results and metrics posted over http, the routes aren't
+	// served if it is nil.
+	Ingester Ingester
+}
+
 type service struct {
-	kclient    client.Client
-	kdbAddress string
+	store         store.Store
+	cardinality   CardinalityReporter
+	retention     RetentionPolicy
+	retentionMode string
+	customerTag   string
+	rollups       Router
+	shadow        *shadow
+	ingester      Ingester
+	grpcServer    *grpc.Server
+	httpServer    *http.Server
+	serverMut     *sync.Mutex
 }
 
-func New(kcConn string) (*service, error) {
-	kc := client.NewHttpClient(kcConn)
+func New(config *Config) (*service, error) {
 	s := &service{
-		kclient:    kc,
-		kdbAddress: kcConn,
+		store:         config.Store,
+		cardinality:   config.Cardinality,
+		retention:     config.Retention,
+		retentionMode: config.RetentionMode,
+		customerTag:   config.CustomerTag,
+		rollups:       config.Rollups,
+		ingester:      config.Ingester,
+		serverMut:     &sync.Mutex{},
 	}
+
+	if config.Shadow != nil && config.Shadow.Store != nil {
+		s.shadow = newShadow(config.Shadow)
+	}
+
+	if s.customerTag == "" {
+		s.customerTag = defaultCustomerTag
+	}
+
+	switch s.retentionMode {
+	case "":
+		s.retentionMode = RetentionClamp
+	case RetentionClamp, RetentionReject:
+	default:
+		return nil, fmt.Errorf("unknown retention mode: %s", s.retentionMode)
+	}
+
 	return s, nil
 }
 
@@ -33,8 +91,10 @@ func New(kcConn string) (*service, error) {
 func (s *service) StartMux(addr, certfile, certkeyfile string) error {
 	router := tp.NewHTTPRouter(context.Background())
 	server := grpc.NewServer()
+	s.ingestRoutes(router)
 
 	opsee.RegisterMarktricksServer(server, s)
+	pb.RegisterMarktricksServer(server, s)
 	log.Infof("starting marktricks service at %s", addr)
 
 	httpServer := &http.Server{
@@ -43,5 +103,33 @@ func (s *service) StartMux(addr, certfile, certkeyfile string) error {
 		TLSConfig: &tls.Config{},
 	}
 
-	return httpServer.ListenAndServeTLS(certfile, certkeyfile)
+	s.serverMut.Lock()
+	s.grpcServer = server
+	s.httpServer = httpServer
+	s.serverMut.Unlock()
+
+	err := httpServer.ListenAndServeTLS(certfile, certkeyfile)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Stop stops accepting connections and waits up to timeout for in-flight
+// requests to finish before closing the rest.
+func (s *service) Stop(timeout time.Duration) error {
+	s.serverMut.Lock()
+	defer s.serverMut.Unlock()
+
+	if s.httpServer == nil {
+		return nil
+	}
+
+	log.Info("stopping marktricks service")
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := s.httpServer.Shutdown(ctx)
+	s.grpcServer.Stop()
+	return err
 }
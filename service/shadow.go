@@ -0,0 +1,220 @@
+package service
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	opsee "github.com/opsee/basic/service"
+	log "github.com/opsee/logrus"
+	"github.com/opsee/marktricks/store"
+)
+
+const (
+	defaultShadowTolerance   = 0.001
+	defaultShadowMaxInFlight = 4
+	maxLoggedMismatches      = 10
+)
+
+type ShadowConfig struct {
+	Store store.Store
+	// SampleRate is the fraction of QueryMetrics calls also run against Store.
+	SampleRate float64
+	// Tolerance is the largest difference allowed between two values, relative
+	// to the larger of them.
+	Tolerance float64
+	// MaxInFlight bounds concurrent shadow queries, calls sampled while that
+	// many are running are skipped.
+	MaxInFlight int
+}
+
+// ShadowStats are counts of shadow queries since start.
+type ShadowStats struct {
+	Sampled    int64 `json:"sampled"`
+	Skipped    int64 `json:"skipped"`
+	Matched    int64 `json:"matched"`
+	Mismatched int64 `json:"mismatched"`
+	Errors     int64 `json:"errors"`
+}
+
+// shadow replays a sample of queries against a second store in the background
+// and compares its answers with the ones returned to callers.
+type shadow struct {
+	config *ShadowConfig
+	sem    chan struct{}
+	stats  ShadowStats
+	mut    *sync.Mutex
+	logger *log.Entry
+}
+
+func newShadow(config *ShadowConfig) *shadow {
+	s := &shadow{
+		config: config,
+		mut:    &sync.Mutex{},
+		logger: log.WithField("service", "shadow"),
+	}
+
+	if s.config.Tolerance <= 0 {
+		s.logger.Infof("no shadow tolerance config detected, setting to %g", defaultShadowTolerance)
+		s.config.Tolerance = defaultShadowTolerance
+	}
+
+	if s.config.MaxInFlight <= 0 {
+		s.config.MaxInFlight = defaultShadowMaxInFlight
+	}
+
+	s.sem = make(chan struct{}, s.config.MaxInFlight)
+
+	return s
+}
+
+// sample reports whether a query should be shadowed.
+func (s *shadow) sample() bool {
+	return s != nil && rand.Float64() < s.config.SampleRate
+}
+
+// ShadowStats returns the shadow query counts, all zero if shadowing is off.
+func (s *service) ShadowStats() ShadowStats {
+	if s.shadow == nil {
+		return ShadowStats{}
+	}
+
+	s.shadow.mut.Lock()
+	defer s.shadow.mut.Unlock()
+	return s.shadow.stats
+}
+
+// shadowQuery runs a query against the shadow store in the background, the same
+// way it was run against the store, and compares the result with out.
+func (s *service) shadowQuery(in *opsee.QueryMetricsRequest, routed *routedQuery, out *opsee.QueryMetricsResponse) {
+	select {
+	case s.shadow.sem <- struct{}{}:
+	default:
+		s.shadow.count(func(stats *ShadowStats) { stats.Skipped++ })
+		return
+	}
+
+	go func() {
+		defer func() { <-s.shadow.sem }()
+		s.shadow.count(func(stats *ShadowStats) { stats.Sampled++ })
+
+		start := time.Now()
+		var (
+			shadowOut *opsee.QueryMetricsResponse
+			err       error
+		)
+		if routed != nil {
+			shadowOut, err = s.queryRouted(s.shadow.config.Store, routed)
+		} else {
+			shadowOut, err = s.shadow.config.Store.Query(in)
+		}
+
+		logger := s.shadow.logger.WithField("elapsed", time.Since(start))
+		if err != nil {
+			s.shadow.count(func(stats *ShadowStats) { stats.Errors++ })
+			logger.WithError(err).Warn("shadow query failed")
+			return
+		}
+
+		mismatches := diffResponses(out, shadowOut, s.shadow.config.Tolerance)
+		if len(mismatches) == 0 {
+			s.shadow.count(func(stats *ShadowStats) { stats.Matched++ })
+			return
+		}
+
+		s.shadow.count(func(stats *ShadowStats) { stats.Mismatched++ })
+		logger = logger.WithField("mismatches", len(mismatches))
+		if len(mismatches) > maxLoggedMismatches {
+			mismatches = mismatches[:maxLoggedMismatches]
+		}
+		logger.Warnf("shadow query mismatched %v: %v", in, mismatches)
+	}()
+}
+
+func (s *shadow) count(f func(*ShadowStats)) {
+	s.mut.Lock()
+	f(&s.stats)
+	s.mut.Unlock()
+}
+
+// diffResponses compares two answers to the same query point by point. Results
+// are matched by name and group, datapoints by timestamp.
+func diffResponses(want, got *opsee.QueryMetricsResponse, tolerance float64) []string {
+	var mismatches []string
+	if len(want.Queries) != len(got.Queries) {
+		return []string{fmt.Sprintf("%d queries, shadow returned %d", len(want.Queries), len(got.Queries))}
+	}
+
+	for i := range want.Queries {
+		wantResults := resultsByGroup(want.Queries[i])
+		gotResults := resultsByGroup(got.Queries[i])
+
+		for key, w := range wantResults {
+			g, ok := gotResults[key]
+			if !ok {
+				if len(w.Values) > 0 {
+					mismatches = append(mismatches, fmt.Sprintf("query %d: result %s missing from shadow", i, key))
+				}
+				continue
+			}
+			mismatches = append(mismatches, diffValues(fmt.Sprintf("query %d: result %s", i, key), w, g, tolerance)...)
+		}
+
+		for key, g := range gotResults {
+			if _, ok := wantResults[key]; !ok && len(g.Values) > 0 {
+				mismatches = append(mismatches, fmt.Sprintf("query %d: unexpected shadow result %s", i, key))
+			}
+		}
+	}
+
+	return mismatches
+}
+
+func resultsByGroup(q *opsee.Query) map[string]*opsee.Result {
+	results := make(map[string]*opsee.Result)
+	if q == nil {
+		return results
+	}
+	for _, r := range q.Results {
+		results[r.Name+"{"+groupKey(r)+"}"] = r
+	}
+	return results
+}
+
+func diffValues(prefix string, want, got *opsee.Result, tolerance float64) []string {
+	var mismatches []string
+
+	gotValues := make(map[int64]float64, len(got.Values))
+	for _, p := range got.Values {
+		gotValues[p.Timestamp.Millis()] = p.Value
+	}
+
+	for _, p := range want.Values {
+		ts := p.Timestamp.Millis()
+		v, ok := gotValues[ts]
+		if !ok {
+			mismatches = append(mismatches, fmt.Sprintf("%s: point at %d missing from shadow", prefix, ts))
+			continue
+		}
+		delete(gotValues, ts)
+
+		if !withinTolerance(p.Value, v, tolerance) {
+			mismatches = append(mismatches, fmt.Sprintf("%s: point at %d is %g, shadow returned %g", prefix, ts, p.Value, v))
+		}
+	}
+
+	for ts := range gotValues {
+		mismatches = append(mismatches, fmt.Sprintf("%s: unexpected shadow point at %d", prefix, ts))
+	}
+
+	return mismatches
+}
+
+func withinTolerance(a, b, tolerance float64) bool {
+	if a == b {
+		return true
+	}
+	return math.Abs(a-b) <= tolerance*math.Max(math.Abs(a), math.Abs(b))
+}
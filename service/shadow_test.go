@@ -0,0 +1,127 @@
+package service
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	opsee "github.com/opsee/basic/service"
+	opsee_types "github.com/opsee/protobuf/opseeproto/types"
+)
+
+// shadowMillis is where the points of shadowResult start, a minute apart.
+const shadowMillis int64 = 1500000000000
+
+func shadowResult(host string, values ...float64) *opsee.Result {
+	r := &opsee.Result{
+		Name:    "latency",
+		GroupBy: []*opsee.GroupBy{{Name: "tag", Tags: []string{"host"}, Group: map[string]string{"host": host}}},
+	}
+	for i, v := range values {
+		r.Values = append(r.Values, &opsee.Datapoint{Timestamp: opsee_types.NewTimestamp(shadowMillis + int64(i)*60000), Value: v})
+	}
+	return r
+}
+
+func shadowResponse(queries ...[]*opsee.Result) *opsee.QueryMetricsResponse {
+	resp := &opsee.QueryMetricsResponse{}
+	for _, results := range queries {
+		resp.Queries = append(resp.Queries, &opsee.Query{Results: results})
+	}
+	return resp
+}
+
+func TestDiffResponses(t *testing.T) {
+	primary := shadowResponse([]*opsee.Result{shadowResult("a", 100, 200), shadowResult("b", 10)})
+
+	tests := []struct {
+		name   string
+		shadow *opsee.QueryMetricsResponse
+		want   []string
+	}{
+		{
+			name:   "same",
+			shadow: shadowResponse([]*opsee.Result{shadowResult("b", 10), shadowResult("a", 100, 200)}),
+			want:   []string{},
+		},
+		{
+			name:   "drift within tolerance",
+			shadow: shadowResponse([]*opsee.Result{shadowResult("a", 100.5, 199), shadowResult("b", 10.05)}),
+			want:   []string{},
+		},
+		{
+			name:   "drift outside tolerance",
+			shadow: shadowResponse([]*opsee.Result{shadowResult("a", 100, 203), shadowResult("b", 9)}),
+			want: []string{
+				"query 0: result latency{host=a}: point at 1500000060000 is 200, shadow returned 203",
+				"query 0: result latency{host=b}: point at 1500000000000 is 10, shadow returned 9",
+			},
+		},
+		{
+			name:   "missing series",
+			shadow: shadowResponse([]*opsee.Result{shadowResult("a", 100, 200)}),
+			want:   []string{"query 0: result latency{host=b} missing from shadow"},
+		},
+		{
+			name:   "unexpected series",
+			shadow: shadowResponse([]*opsee.Result{shadowResult("a", 100, 200), shadowResult("b", 10), shadowResult("c", 1)}),
+			want:   []string{"query 0: unexpected shadow result latency{host=c}"},
+		},
+		{
+			name:   "empty series",
+			shadow: shadowResponse([]*opsee.Result{shadowResult("a", 100, 200), shadowResult("b", 10), shadowResult("c")}),
+			want:   []string{},
+		},
+		{
+			name:   "fewer points",
+			shadow: shadowResponse([]*opsee.Result{shadowResult("a", 100), shadowResult("b", 10)}),
+			want:   []string{"query 0: result latency{host=a}: point at 1500000060000 missing from shadow"},
+		},
+		{
+			name:   "more points",
+			shadow: shadowResponse([]*opsee.Result{shadowResult("a", 100, 200), shadowResult("b", 10, 20)}),
+			want:   []string{"query 0: result latency{host=b}: unexpected shadow point at 1500000060000"},
+		},
+		{
+			name:   "fewer queries",
+			shadow: shadowResponse(),
+			want:   []string{"1 queries, shadow returned 0"},
+		},
+		{
+			name:   "more queries",
+			shadow: shadowResponse([]*opsee.Result{shadowResult("a", 100, 200), shadowResult("b", 10)}, nil),
+			want:   []string{"1 queries, shadow returned 2"},
+		},
+	}
+
+	for _, test := range tests {
+		got := append([]string{}, diffResponses(primary, test.shadow, 0.01)...)
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got mismatches %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestWithinTolerance(t *testing.T) {
+	tests := []struct {
+		a, b, tolerance float64
+		want            bool
+	}{
+		{0, 0, 0, true},
+		{1, 1, 0, true},
+		{1, 1.001, 0, false},
+		{100, 101, 0.01, true},
+		{101, 100, 0.01, true},
+		{100, 102, 0.01, false},
+		{-100, -101, 0.01, true},
+		{-1, 1, 0.5, false},
+		{0, 0.001, 0.01, false},
+	}
+
+	for _, test := range tests {
+		if got := withinTolerance(test.a, test.b, test.tolerance); got != test.want {
+			t.Errorf("%g and %g within %g: got %t, want %t", test.a, test.b, test.tolerance, got, test.want)
+		}
+	}
+}
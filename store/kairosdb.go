@@ -0,0 +1,253 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	builder "github.com/dan-compton/go-kairosdb/builder"
+	"github.com/hashicorp/go-multierror"
+	opsee "github.com/opsee/basic/service"
+)
+
+const (
+	KdbDatapointsPath = "api/v1/datapoints"
+	KdbQueryPath      = "api/v1/datapoints/query"
+	KdbQueryTagsPath  = "api/v1/datapoints/query/tags"
+	KdbDeletePath     = "api/v1/datapoints/delete"
+	KdbHealthPath     = "api/v1/health/check"
+
+	kdbTimeout           = time.Minute
+	defaultGzipThreshold = 1000
+)
+
+type KairosDBConfig struct {
+	Address string
+	// GzipThreshold is the fewest datapoints a write is gzipped for, negative
+	// to never gzip writes.
+	GzipThreshold int
+	// DisableGzipQueries stops asking for gzipped query responses.
+	DisableGzipQueries bool
+}
+
+// kairosDB stores series in kairosdb through its http api.
+type kairosDB struct {
+	config *KairosDBConfig
+	http   *http.Client
+}
+
+func NewKairosDB(config *KairosDBConfig) *kairosDB {
+	k := &kairosDB{
+		config: config,
+		// responses are only gzipped when asked for below, and decoded there
+		http: &http.Client{
+			Timeout:   kdbTimeout,
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, DisableCompression: true},
+		},
+	}
+
+	if k.config.GzipThreshold == 0 {
+		k.config.GzipThreshold = defaultGzipThreshold
+	}
+
+	return k
+}
+
+// Write streams metrics to kairosdb as they are encoded, gzipped if there are
+// at least GzipThreshold datapoints, so a batch is never held encoded in
+// memory.
+func (k *kairosDB) Write(metrics []builder.Metric) error {
+	points := 0
+	for _, m := range metrics {
+		points += len(m.GetDataPoints())
+	}
+	gzipped := k.config.GzipThreshold >= 0 && points >= k.config.GzipThreshold
+
+	pr, pw := io.Pipe()
+	encodeErr := make(chan error, 1)
+	go func() {
+		err := encodeMetrics(pw, metrics, gzipped)
+		encodeErr <- err
+		pw.CloseWithError(err)
+	}()
+
+	hreq, err := http.NewRequest("POST", fmt.Sprintf("%s/%s", k.config.Address, KdbDatapointsPath), pr)
+	if err != nil {
+		pr.Close()
+		return err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	if gzipped {
+		// kairosdb inflates datapoints posted as application/gzip
+		hreq.Header.Set("Content-Type", "application/gzip")
+	}
+
+	resp, err := k.http.Do(hreq)
+	pr.Close()
+
+	// invalid metrics fail the request, but aren't a transport error. The
+	// encoder only fails writing if the request was given up on.
+	if eerr := <-encodeErr; eerr != nil && eerr != io.ErrClosedPipe {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return eerr
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		out := &opsee.QueryMetricsResponse{}
+		json.NewDecoder(resp.Body).Decode(out)
+		return &StatusError{StatusCode: resp.StatusCode, Errors: out.Errors}
+	}
+	ioutil.ReadAll(resp.Body)
+
+	return nil
+}
+
+// encodeMetrics writes metrics to w as a json array.
+func encodeMetrics(w io.Writer, metrics []builder.Metric, gzipped bool) error {
+	var gz *gzip.Writer
+	if gzipped {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+	bw := bufio.NewWriter(w)
+
+	bw.WriteString("[")
+	for i, m := range metrics {
+		b, err := m.Build()
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			bw.WriteString(",")
+		}
+		bw.Write(b)
+	}
+	bw.WriteString("]")
+
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if gz != nil {
+		return gz.Close()
+	}
+	return nil
+}
+
+func (k *kairosDB) Query(in *opsee.QueryMetricsRequest) (*opsee.QueryMetricsResponse, error) {
+	return k.query(KdbQueryPath, in)
+}
+
+func (k *kairosDB) QueryTags(in *opsee.QueryMetricsRequest) (*opsee.QueryMetricsResponse, error) {
+	return k.query(KdbQueryTagsPath, in)
+}
+
+func (k *kairosDB) Delete(in *opsee.QueryMetricsRequest) error {
+	resp, err := k.post(KdbDeletePath, in)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		out := &opsee.QueryMetricsResponse{}
+		json.NewDecoder(resp.Body).Decode(out)
+		return &StatusError{StatusCode: resp.StatusCode, Errors: out.Errors}
+	}
+
+	return nil
+}
+
+func (k *kairosDB) Healthy() error {
+	resp, err := k.http.Get(fmt.Sprintf("%s/%s", k.config.Address, KdbHealthPath))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &StatusError{StatusCode: resp.StatusCode}
+	}
+
+	return nil
+}
+
+func (k *kairosDB) post(path string, in *opsee.QueryMetricsRequest) (*http.Response, error) {
+	b, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+
+	hreq, err := http.NewRequest("POST", fmt.Sprintf("%s/%s", k.config.Address, path), bytes.NewBuffer(b))
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	if !k.config.DisableGzipQueries {
+		hreq.Header.Set("Accept-Encoding", "gzip")
+	}
+
+	resp, err := k.http.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		resp.Body = &gzipBody{Reader: gz, body: resp.Body}
+	}
+
+	return resp, nil
+}
+
+// gzipBody decodes a gzipped response body, closing both when done.
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (g *gzipBody) Close() error {
+	g.Reader.Close()
+	return g.body.Close()
+}
+
+func (k *kairosDB) query(path string, in *opsee.QueryMetricsRequest) (*opsee.QueryMetricsResponse, error) {
+	resp, err := k.post(path, in)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	out := &opsee.QueryMetricsResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return nil, fmt.Errorf("kairosdb returned status %d: %s", resp.StatusCode, err)
+	}
+
+	// handle errors field
+	if len(out.Errors) > 0 {
+		var errs error
+		for _, e := range out.Errors {
+			errs = multierror.Append(errs, errors.New(e))
+		}
+		return nil, errs
+	}
+
+	return out, nil
+}
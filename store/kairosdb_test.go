@@ -0,0 +1,175 @@
+package store
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	builder "github.com/dan-compton/go-kairosdb/builder"
+	opsee "github.com/opsee/basic/service"
+	opsee_types "github.com/opsee/protobuf/opseeproto/types"
+)
+
+// benchMetrics returns n metrics of a point each, tagged like extracted ones.
+func benchMetrics(n int) []builder.Metric {
+	metrics := make([]builder.Metric, n)
+	for i := range metrics {
+		metrics[i] = builder.NewMetric("http.request_latency").
+			AddTag("customer", "customer-1").
+			AddTag("check", fmt.Sprintf("check-%d", i%50)).
+			AddTag("target", fmt.Sprintf("i-%d", i)).
+			AddDataPoint(testMillis+int64(i), 12.5)
+	}
+	return metrics
+}
+
+func TestKairosDBWrite(t *testing.T) {
+	tests := []struct {
+		name          string
+		gzipThreshold int
+		points        int
+		status        int
+		wantType      string
+		wantErr       error
+	}{
+		{name: "under the threshold", gzipThreshold: 10, points: 9, status: http.StatusNoContent, wantType: "application/json"},
+		{name: "at the threshold", gzipThreshold: 10, points: 10, status: http.StatusNoContent, wantType: "application/gzip"},
+		{name: "default threshold", points: defaultGzipThreshold, status: http.StatusNoContent, wantType: "application/gzip"},
+		{name: "never gzipped", gzipThreshold: -1, points: 2000, status: http.StatusNoContent, wantType: "application/json"},
+		{
+			name:          "rejected",
+			gzipThreshold: 10,
+			points:        10,
+			status:        http.StatusBadRequest,
+			wantType:      "application/gzip",
+			wantErr:       &StatusError{StatusCode: http.StatusBadRequest, Errors: []string{"metric[0].name may not be empty"}},
+		},
+	}
+
+	for _, test := range tests {
+		var (
+			contentType, contentEncoding, path string
+			body                               []interface{}
+			decodeErr                          error
+		)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path, contentType, contentEncoding = r.URL.Path, r.Header.Get("Content-Type"), r.Header.Get("Content-Encoding")
+
+			var reader io.Reader = r.Body
+			if contentType == "application/gzip" {
+				gz, err := gzip.NewReader(r.Body)
+				if err != nil {
+					decodeErr = err
+					return
+				}
+				reader = gz
+			}
+			decodeErr = json.NewDecoder(reader).Decode(&body)
+
+			w.WriteHeader(test.status)
+			if test.status != http.StatusNoContent {
+				fmt.Fprint(w, `{"errors": ["metric[0].name may not be empty"]}`)
+			}
+		}))
+
+		metrics := benchMetrics(test.points)
+		k := NewKairosDB(&KairosDBConfig{Address: server.URL, GzipThreshold: test.gzipThreshold})
+		err := k.Write(metrics)
+		server.Close()
+
+		if !reflect.DeepEqual(err, test.wantErr) {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.wantErr)
+		}
+		if path != "/"+KdbDatapointsPath || contentType != test.wantType || contentEncoding != "" {
+			t.Errorf("%s: got %s with content type %q and encoding %q, want content type %q", test.name, path, contentType, contentEncoding, test.wantType)
+		}
+		if decodeErr != nil {
+			t.Errorf("%s: undecodable body: %s", test.name, decodeErr)
+			continue
+		}
+
+		var want []interface{}
+		b, _ := json.Marshal(metrics)
+		json.Unmarshal(b, &want)
+		if !reflect.DeepEqual(body, want) {
+			t.Errorf("%s: got a body of %d metrics, want the %d written", test.name, len(body), len(want))
+		}
+	}
+}
+
+func TestKairosDBQuery(t *testing.T) {
+	const response = `{"queries": [{"sample_size": 2, "results": [{
+		"name": "latency",
+		"group_by": [{"name": "tag", "tags": ["host"], "group": {"host": "a"}}],
+		"values": [[1500000000000, 1], [1500000060000, 2.5]]
+	}]}]}`
+
+	for _, disableGzip := range []bool{false, true} {
+		var acceptEncoding string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			acceptEncoding = r.Header.Get("Accept-Encoding")
+			if acceptEncoding != "gzip" {
+				fmt.Fprint(w, response)
+				return
+			}
+
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			fmt.Fprint(gz, response)
+			gz.Close()
+		}))
+
+		k := NewKairosDB(&KairosDBConfig{Address: server.URL, DisableGzipQueries: disableGzip})
+		out, err := k.Query(&opsee.QueryMetricsRequest{
+			Metrics:       []*opsee.QueryMetric{{Name: "latency"}},
+			StartAbsolute: opsee_types.NewTimestamp(testMillis),
+		})
+		server.Close()
+		if err != nil {
+			t.Errorf("gzip disabled %t: %s", disableGzip, err)
+			continue
+		}
+
+		if wantEncoding := map[bool]string{false: "gzip", true: ""}[disableGzip]; acceptEncoding != wantEncoding {
+			t.Errorf("gzip disabled %t: got Accept-Encoding %q, want %q", disableGzip, acceptEncoding, wantEncoding)
+		}
+		if got, want := describeQuery(out.Queries[0]), []string{"host=a: 0=1 60=2.5"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("gzip disabled %t: got results %q, want %q", disableGzip, got, want)
+		}
+	}
+}
+
+func BenchmarkKairosDBWrite(b *testing.B) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	for _, bench := range []struct {
+		name          string
+		gzipThreshold int
+	}{
+		{"json", -1},
+		{"gzip", 1},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			k := NewKairosDB(&KairosDBConfig{Address: server.URL, GzipThreshold: bench.gzipThreshold})
+			metrics := benchMetrics(1000)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := k.Write(metrics); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
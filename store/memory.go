@@ -0,0 +1,466 @@
+package store
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	builder "github.com/dan-compton/go-kairosdb/builder"
+	opsee "github.com/opsee/basic/service"
+	opsee_types "github.com/opsee/protobuf/opseeproto/types"
+)
+
+var samplingMillis = map[string]int64{
+	"milliseconds": 1,
+	"seconds":      1000,
+	"minutes":      60 * 1000,
+	"hours":        60 * 60 * 1000,
+	"days":         24 * 60 * 60 * 1000,
+	"weeks":        7 * 24 * 60 * 60 * 1000,
+}
+
+type memoryPoint struct {
+	timestamp int64
+	value     float64
+	expires   int64
+}
+
+type memorySeries struct {
+	name   string
+	tags   map[string]string
+	points []memoryPoint
+}
+
+// memory keeps series in memory, answering queries the way kairosdb does for
+// the aggregators avg, sum, min, max, count, first and last. It is meant for
+// running marktricks without kairosdb, e.g. in development and tests.
+type memory struct {
+	series map[string]*memorySeries
+	mut    *sync.RWMutex
+}
+
+func NewMemory() *memory {
+	return &memory{
+		series: make(map[string]*memorySeries),
+		mut:    &sync.RWMutex{},
+	}
+}
+
+func (s *memory) Write(metrics []builder.Metric) error {
+	var errs []string
+	for i, m := range metrics {
+		if m.GetName() == "" {
+			errs = append(errs, fmt.Sprintf("metric[%d].name may not be empty", i))
+		}
+		if len(m.GetTags()) == 0 {
+			errs = append(errs, fmt.Sprintf("metric[%d](name=%s).tags count must be greater than or equal to 1", i, m.GetName()))
+		}
+		for _, dp := range m.GetDataPoints() {
+			if _, err := dataPointValue(dp); err != nil {
+				errs = append(errs, fmt.Sprintf("metric[%d](name=%s): %s", i, m.GetName(), err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return &StatusError{StatusCode: http.StatusBadRequest, Errors: errs}
+	}
+
+	now := nowMillis()
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	for _, m := range metrics {
+		key := SeriesKey(m.GetName(), m.GetTags())
+		series, ok := s.series[key]
+		if !ok {
+			tags := make(map[string]string, len(m.GetTags()))
+			for k, v := range m.GetTags() {
+				tags[k] = v
+			}
+			series = &memorySeries{name: m.GetName(), tags: tags}
+			s.series[key] = series
+		}
+
+		var expires int64
+		if m.GetTTL() > 0 {
+			expires = now + m.GetTTL()*1000
+		}
+
+		for _, dp := range m.GetDataPoints() {
+			value, _ := dataPointValue(dp)
+			series.insert(memoryPoint{timestamp: dp.Timestamp(), value: value, expires: expires})
+		}
+	}
+
+	return nil
+}
+
+func (s *memory) Query(in *opsee.QueryMetricsRequest) (*opsee.QueryMetricsResponse, error) {
+	start, end := queryRange(in)
+	now := nowMillis()
+
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+
+	out := &opsee.QueryMetricsResponse{}
+	for _, qm := range in.Metrics {
+		groups := make(map[string]*opsee.Result)
+		points := make(map[string][]memoryPoint)
+		tagSets := make(map[string]map[string]map[string]bool)
+
+		for _, series := range s.matching(qm) {
+			inRange := series.between(start, end, now)
+			if len(inRange) == 0 {
+				continue
+			}
+
+			key, groupBy := groupOf(qm, series)
+			if _, ok := groups[key]; !ok {
+				groups[key] = &opsee.Result{Name: qm.Name, GroupBy: groupBy}
+				tagSets[key] = make(map[string]map[string]bool)
+			}
+			points[key] = append(points[key], inRange...)
+			addTagSet(tagSets[key], series.tags)
+		}
+
+		query := &opsee.Query{}
+		for _, key := range sortedKeys(groups) {
+			result := groups[key]
+			result.Tags = tagLists(tagSets[key])
+
+			ps := points[key]
+			sort.Sort(byTimestamp(ps))
+			for _, agg := range qm.Aggregators {
+				var err error
+				if ps, err = aggregate(ps, agg, start); err != nil {
+					return nil, err
+				}
+			}
+			if qm.Limit > 0 && int64(len(ps)) > qm.Limit {
+				ps = ps[:qm.Limit]
+			}
+
+			for _, p := range ps {
+				result.Values = append(result.Values, &opsee.Datapoint{
+					Timestamp: opsee_types.NewTimestamp(p.timestamp),
+					Value:     p.value,
+				})
+			}
+			query.Results = append(query.Results, result)
+		}
+
+		// kairosdb answers a query matching nothing with an empty result
+		if len(query.Results) == 0 {
+			query.Results = []*opsee.Result{{Name: qm.Name, Tags: map[string]*opsee.StringList{}}}
+		}
+		out.Queries = append(out.Queries, query)
+	}
+
+	return out, nil
+}
+
+func (s *memory) QueryTags(in *opsee.QueryMetricsRequest) (*opsee.QueryMetricsResponse, error) {
+	start, end := queryRange(in)
+	now := nowMillis()
+
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+
+	out := &opsee.QueryMetricsResponse{}
+	for _, qm := range in.Metrics {
+		tagSet := make(map[string]map[string]bool)
+		for _, series := range s.matching(qm) {
+			if len(series.between(start, end, now)) > 0 {
+				addTagSet(tagSet, series.tags)
+			}
+		}
+
+		out.Queries = append(out.Queries, &opsee.Query{
+			Results: []*opsee.Result{{Name: qm.Name, Tags: tagLists(tagSet)}},
+		})
+	}
+
+	return out, nil
+}
+
+func (s *memory) Delete(in *opsee.QueryMetricsRequest) error {
+	start, end := queryRange(in)
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	for _, qm := range in.Metrics {
+		for _, series := range s.matching(qm) {
+			kept := series.points[:0]
+			for _, p := range series.points {
+				if p.timestamp < start || p.timestamp > end {
+					kept = append(kept, p)
+				}
+			}
+			series.points = kept
+
+			if len(series.points) == 0 {
+				delete(s.series, SeriesKey(series.name, series.tags))
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *memory) Healthy() error {
+	return nil
+}
+
+// matching returns the series of a query metric's name whose tags match its
+// tag filters.
+func (s *memory) matching(qm *opsee.QueryMetric) []*memorySeries {
+	var matched []*memorySeries
+	for _, series := range s.series {
+		if series.name != qm.Name {
+			continue
+		}
+
+		ok := true
+		for tag, list := range qm.Tags {
+			if list == nil || len(list.Values) == 0 {
+				continue
+			}
+			if !contains(list.Values, series.tags[tag]) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			matched = append(matched, series)
+		}
+	}
+	return matched
+}
+
+// insert adds a point in timestamp order, replacing any at the same timestamp.
+func (s *memorySeries) insert(p memoryPoint) {
+	i := sort.Search(len(s.points), func(i int) bool { return s.points[i].timestamp >= p.timestamp })
+	if i < len(s.points) && s.points[i].timestamp == p.timestamp {
+		s.points[i] = p
+		return
+	}
+
+	s.points = append(s.points, memoryPoint{})
+	copy(s.points[i+1:], s.points[i:])
+	s.points[i] = p
+}
+
+// between returns the unexpired points in [start, end].
+func (s *memorySeries) between(start, end, now int64) []memoryPoint {
+	var points []memoryPoint
+	for _, p := range s.points {
+		if p.timestamp < start || p.timestamp > end {
+			continue
+		}
+		if p.expires > 0 && p.expires <= now {
+			continue
+		}
+		points = append(points, p)
+	}
+	return points
+}
+
+// groupOf returns the key and group_by a series is grouped under by its query
+// metric's tag grouper, if any.
+func groupOf(qm *opsee.QueryMetric, series *memorySeries) (string, []*opsee.GroupBy) {
+	for _, gb := range qm.GroupBy {
+		if gb.Name != "tag" {
+			continue
+		}
+
+		group := make(map[string]string)
+		var parts []string
+		for _, tag := range gb.Tags {
+			if v, ok := series.tags[tag]; ok {
+				group[tag] = v
+				parts = append(parts, tag+"="+v)
+			}
+		}
+		sort.Strings(parts)
+
+		return strings.Join(parts, ","), []*opsee.GroupBy{{Name: "tag", Tags: gb.Tags, Group: group}}
+	}
+
+	return "", nil
+}
+
+// aggregate applies a range aggregator to points sorted by timestamp. Buckets
+// start at start, or at multiples of the sampling if it is aligned.
+func aggregate(points []memoryPoint, agg *opsee.Aggregator, start int64) ([]memoryPoint, error) {
+	if agg.Sampling == nil {
+		return nil, &StatusError{StatusCode: http.StatusBadRequest, Errors: []string{fmt.Sprintf("aggregator %s needs a sampling", agg.Name)}}
+	}
+
+	value, err := strconv.ParseInt(agg.Sampling.Value, 10, 64)
+	unit, ok := samplingMillis[agg.Sampling.Unit]
+	if err != nil || !ok || value <= 0 {
+		return nil, &StatusError{StatusCode: http.StatusBadRequest, Errors: []string{fmt.Sprintf("unsupported sampling %s %s", agg.Sampling.Value, agg.Sampling.Unit)}}
+	}
+
+	size, origin := value*unit, start
+	if agg.AlignSampling {
+		origin = 0
+	}
+
+	var (
+		out     []memoryPoint
+		bucket  []float64
+		current int64
+	)
+	flush := func() error {
+		if len(bucket) == 0 {
+			return nil
+		}
+		v, err := reduce(agg.Name, bucket)
+		if err != nil {
+			return err
+		}
+		out = append(out, memoryPoint{timestamp: current, value: v})
+		bucket = bucket[:0]
+		return nil
+	}
+
+	for _, p := range points {
+		b := origin + floorDiv(p.timestamp-origin, size)*size
+		if len(bucket) > 0 && b != current {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+		current = b
+		bucket = append(bucket, p.value)
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+func reduce(name string, values []float64) (float64, error) {
+	switch name {
+	case "avg", "sum":
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+		}
+		if name == "avg" {
+			return sum / float64(len(values)), nil
+		}
+		return sum, nil
+	case "min":
+		min := math.Inf(1)
+		for _, v := range values {
+			min = math.Min(min, v)
+		}
+		return min, nil
+	case "max":
+		max := math.Inf(-1)
+		for _, v := range values {
+			max = math.Max(max, v)
+		}
+		return max, nil
+	case "count":
+		return float64(len(values)), nil
+	case "first":
+		return values[0], nil
+	case "last":
+		return values[len(values)-1], nil
+	}
+
+	return 0, &StatusError{StatusCode: http.StatusBadRequest, Errors: []string{fmt.Sprintf("unsupported aggregator %s", name)}}
+}
+
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+// queryRange returns a query's time range in milliseconds, inclusive of its
+// end, which defaults to now.
+func queryRange(in *opsee.QueryMetricsRequest) (int64, int64) {
+	var start, end int64 = 0, nowMillis()
+	if in.StartAbsolute != nil {
+		start = in.StartAbsolute.Millis()
+	}
+	if in.EndAbsolute != nil {
+		end = in.EndAbsolute.Millis()
+	}
+	return start, end
+}
+
+func dataPointValue(dp builder.DataPoint) (float64, error) {
+	if v, err := dp.Float64Value(); err == nil {
+		return v, nil
+	}
+	v, err := dp.Int64Value()
+	if err != nil {
+		return 0, fmt.Errorf("datapoint value must be a number")
+	}
+	return float64(v), nil
+}
+
+func addTagSet(set map[string]map[string]bool, tags map[string]string) {
+	for k, v := range tags {
+		if set[k] == nil {
+			set[k] = make(map[string]bool)
+		}
+		set[k][v] = true
+	}
+}
+
+func tagLists(set map[string]map[string]bool) map[string]*opsee.StringList {
+	lists := make(map[string]*opsee.StringList, len(set))
+	for k, values := range set {
+		list := &opsee.StringList{}
+		for v := range values {
+			list.Values = append(list.Values, v)
+		}
+		sort.Strings(list.Values)
+		lists[k] = list
+	}
+	return lists
+}
+
+func sortedKeys(groups map[string]*opsee.Result) []string {
+	keys := make([]string, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+type byTimestamp []memoryPoint
+
+func (b byTimestamp) Len() int           { return len(b) }
+func (b byTimestamp) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byTimestamp) Less(i, j int) bool { return b[i].timestamp < b[j].timestamp }
@@ -0,0 +1,230 @@
+package store
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	builder "github.com/dan-compton/go-kairosdb/builder"
+	opsee "github.com/opsee/basic/service"
+	opsee_types "github.com/opsee/protobuf/opseeproto/types"
+)
+
+// testMillis is minute aligned, so aggregating from it and aligned to the
+// sampling give the same buckets.
+const testMillis int64 = 1500000000000
+
+func testMemory(t *testing.T) *memory {
+	metric := func(host, customer string) builder.Metric {
+		return builder.NewMetric("latency").AddTag("host", host).AddTag("customer", customer)
+	}
+
+	s := NewMemory()
+	err := s.Write([]builder.Metric{
+		metric("a", "c1").AddDataPoint(testMillis, 1).AddDataPoint(testMillis+30000, 3).AddDataPoint(testMillis+60000, 5),
+		metric("b", "c1").AddDataPoint(testMillis+10000, 10),
+		metric("c", "c2").AddDataPoint(testMillis+20000, 100),
+		builder.NewMetric("errors").AddTag("host", "a").AddDataPoint(testMillis, 7),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// describeQuery renders a query's results as "group: seconds=value ..." lines,
+// seconds counted from testMillis.
+func describeQuery(q *opsee.Query) []string {
+	lines := []string{}
+	for _, r := range q.Results {
+		var group []string
+		for _, gb := range r.GroupBy {
+			for k, v := range gb.Group {
+				group = append(group, k+"="+v)
+			}
+		}
+		sort.Strings(group)
+
+		values := []string{}
+		for _, dp := range r.Values {
+			values = append(values, fmt.Sprintf("%d=%v", (dp.Timestamp.Millis()-testMillis)/1000, dp.Value))
+		}
+		lines = append(lines, strings.Join(group, ",")+": "+strings.Join(values, " "))
+	}
+	return lines
+}
+
+func TestMemoryQuery(t *testing.T) {
+	perMinute := func(name string) *opsee.Aggregator {
+		return &opsee.Aggregator{Name: name, Sampling: &opsee.Sampling{Value: "1", Unit: "minutes"}}
+	}
+
+	tests := []struct {
+		name    string
+		metric  *opsee.QueryMetric
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:   "raw",
+			metric: &opsee.QueryMetric{Name: "latency"},
+			want:   []string{": 0=1 10=10 20=100 30=3 60=5"},
+		},
+		{
+			name:   "tag filter",
+			metric: &opsee.QueryMetric{Name: "latency", Tags: map[string]*opsee.StringList{"host": {Values: []string{"a"}}}},
+			want:   []string{": 0=1 30=3 60=5"},
+		},
+		{
+			name: "tag filters",
+			metric: &opsee.QueryMetric{Name: "latency", Tags: map[string]*opsee.StringList{
+				"host":     {Values: []string{"a", "c"}},
+				"customer": {Values: []string{"c2"}},
+			}},
+			want: []string{": 20=100"},
+		},
+		{
+			name:   "empty tag filter",
+			metric: &opsee.QueryMetric{Name: "latency", Tags: map[string]*opsee.StringList{"host": {}}},
+			want:   []string{": 0=1 10=10 20=100 30=3 60=5"},
+		},
+		{
+			name:   "nothing matched",
+			metric: &opsee.QueryMetric{Name: "latency", Tags: map[string]*opsee.StringList{"host": {Values: []string{"z"}}}},
+			want:   []string{": "},
+		},
+		{
+			name:   "sum",
+			metric: &opsee.QueryMetric{Name: "latency", Aggregators: []*opsee.Aggregator{perMinute("sum")}},
+			want:   []string{": 0=114 60=5"},
+		},
+		{
+			name:   "avg",
+			metric: &opsee.QueryMetric{Name: "latency", Aggregators: []*opsee.Aggregator{perMinute("avg")}},
+			want:   []string{": 0=28.5 60=5"},
+		},
+		{
+			name: "min max count first last",
+			metric: &opsee.QueryMetric{Name: "latency", Aggregators: []*opsee.Aggregator{
+				perMinute("min"), perMinute("max"), perMinute("count"), perMinute("first"), perMinute("last"),
+			}},
+			want: []string{": 0=1 60=1"},
+		},
+		{
+			name: "larger sampling",
+			metric: &opsee.QueryMetric{Name: "latency", Aggregators: []*opsee.Aggregator{
+				{Name: "max", Sampling: &opsee.Sampling{Value: "2", Unit: "minutes"}, AlignSampling: true},
+			}},
+			want: []string{": 0=100"},
+		},
+		{
+			name: "grouped",
+			metric: &opsee.QueryMetric{
+				Name:        "latency",
+				GroupBy:     []*opsee.GroupBy{{Name: "tag", Tags: []string{"customer"}}},
+				Aggregators: []*opsee.Aggregator{perMinute("sum")},
+			},
+			want: []string{"customer=c1: 0=14 60=5", "customer=c2: 0=100"},
+		},
+		{
+			name:   "limit",
+			metric: &opsee.QueryMetric{Name: "latency", Limit: 2},
+			want:   []string{": 0=1 10=10"},
+		},
+		{
+			name:    "no sampling",
+			metric:  &opsee.QueryMetric{Name: "latency", Aggregators: []*opsee.Aggregator{{Name: "sum"}}},
+			wantErr: true,
+		},
+		{
+			name:    "unsupported aggregator",
+			metric:  &opsee.QueryMetric{Name: "latency", Aggregators: []*opsee.Aggregator{perMinute("percentile")}},
+			wantErr: true,
+		},
+	}
+
+	s := testMemory(t)
+	for _, test := range tests {
+		out, err := s.Query(&opsee.QueryMetricsRequest{
+			Metrics:       []*opsee.QueryMetric{test.metric},
+			StartAbsolute: opsee_types.NewTimestamp(testMillis),
+			EndAbsolute:   opsee_types.NewTimestamp(testMillis + 120000),
+		})
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %t", test.name, err, test.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got := describeQuery(out.Queries[0]); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got results %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMemoryQueryTags(t *testing.T) {
+	s := testMemory(t)
+	out, err := s.QueryTags(&opsee.QueryMetricsRequest{
+		Metrics:       []*opsee.QueryMetric{{Name: "latency", Tags: map[string]*opsee.StringList{"customer": {Values: []string{"c1"}}}}},
+		StartAbsolute: opsee_types.NewTimestamp(testMillis),
+		EndAbsolute:   opsee_types.NewTimestamp(testMillis + 120000),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]*opsee.StringList{
+		"host":     {Values: []string{"a", "b"}},
+		"customer": {Values: []string{"c1"}},
+	}
+	if got := out.Queries[0].Results[0].Tags; !reflect.DeepEqual(got, want) {
+		t.Errorf("got tags %v, want %v", got, want)
+	}
+}
+
+func TestMemoryTTL(t *testing.T) {
+	// whole seconds, since opsee_types.Timestamp drops the rest of millis
+	now := nowMillis() / 1000 * 1000
+
+	s := NewMemory()
+	err := s.Write([]builder.Metric{
+		builder.NewMetric("latency").AddTag("host", "a").AddTTL(1).AddDataPoint(now, 1),
+		builder.NewMetric("latency").AddTag("host", "b").AddDataPoint(now, 2),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host string
+		now  int64
+		want int
+	}{
+		{"a", now, 1},
+		{"a", now + 999, 1},
+		{"a", now + 2000, 0},
+		{"b", now + 2000, 1},
+	}
+
+	for _, test := range tests {
+		series := s.series[SeriesKey("latency", map[string]string{"host": test.host})]
+		if got := len(series.between(now, now, test.now)); got != test.want {
+			t.Errorf("host %s at now+%d: got %d points, want %d", test.host, test.now-now, got, test.want)
+		}
+	}
+
+	out, err := s.Query(&opsee.QueryMetricsRequest{
+		Metrics:       []*opsee.QueryMetric{{Name: "latency"}},
+		StartAbsolute: opsee_types.NewTimestamp(now),
+		EndAbsolute:   opsee_types.NewTimestamp(now),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(out.Queries[0].Results[0].Values); got != 2 {
+		t.Errorf("got %d unexpired points, want 2", got)
+	}
+}
@@ -0,0 +1,57 @@
+// Package store is where marktricks keeps series. Queries and their results
+// take the shape of kairosdb's query api, which every Store answers.
+package store
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	builder "github.com/dan-compton/go-kairosdb/builder"
+	opsee "github.com/opsee/basic/service"
+)
+
+type Store interface {
+	// Write stores every datapoint of metrics.
+	Write(metrics []builder.Metric) error
+
+	// Query returns the datapoints of each metric of a query, one opsee.Query
+	// per metric in the same order.
+	Query(in *opsee.QueryMetricsRequest) (*opsee.QueryMetricsResponse, error)
+
+	// QueryTags returns the tag names and values of each metric of a query
+	// with datapoints in its time range.
+	QueryTags(in *opsee.QueryMetricsRequest) (*opsee.QueryMetricsResponse, error)
+
+	// Delete removes the datapoints a query matches.
+	Delete(in *opsee.QueryMetricsRequest) error
+
+	// Healthy returns why the store can't take writes, or nil if it can.
+	Healthy() error
+}
+
+// StatusError is returned when a store rejects a request with a non-2xx status.
+type StatusError struct {
+	StatusCode int
+	Errors     []string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("store returned status %d: %s", e.StatusCode, strings.Join(e.Errors, ", "))
+}
+
+// SeriesKey identifies a series by its metric name and sorted tags.
+func SeriesKey(name string, tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys)+1)
+	parts = append(parts, name)
+	for _, k := range keys {
+		parts = append(parts, k+"="+tags[k])
+	}
+	return strings.Join(parts, ",")
+}
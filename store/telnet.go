@@ -0,0 +1,231 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	builder "github.com/dan-compton/go-kairosdb/builder"
+	log "github.com/opsee/logrus"
+)
+
+const (
+	defaultTelnetPoolSize = 4
+	defaultTelnetTimeout  = 30 * time.Second
+	// minTelnetChunk is the fewest metrics worth writing on a connection of
+	// their own.
+	minTelnetChunk = 100
+)
+
+type TelnetConfig struct {
+	// KairosDBConfig configures the http api, used for everything but
+	// writes.
+	KairosDBConfig
+	// TelnetAddress is kairosdb's telnet listener, host:port.
+	TelnetAddress string
+	// PoolSize is how many connections are kept open. A batch is split
+	// across up to PoolSize of them, and writes wait for a free one.
+	PoolSize int
+	// Timeout bounds dialing and each write, including kairosdb's reply.
+	Timeout time.Duration
+}
+
+// kairosDBTelnet writes to kairosdb with its line protocol over pooled
+// connections, skipping the json encoding and request per batch of the http
+// api. The protocol has no acknowledgements, so each write ends with a version
+// command and waits for its reply, which kairosdb sends once it has parsed
+// every line before it. Metrics with a TTL, or names and tags the protocol
+// can't carry, are written over http, so it is no faster with retention.
+type kairosDBTelnet struct {
+	*kairosDB
+	config *TelnetConfig
+	conns  chan *telnetConn
+	logger *log.Entry
+}
+
+type telnetConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+func NewKairosDBTelnet(config *TelnetConfig) *kairosDBTelnet {
+	k := &kairosDBTelnet{
+		kairosDB: NewKairosDB(&config.KairosDBConfig),
+		config:   config,
+		logger:   log.WithField("store", "kairosdb-telnet"),
+	}
+
+	if k.config.PoolSize <= 0 {
+		k.logger.Infof("no pool size config detected, setting to %d", defaultTelnetPoolSize)
+		k.config.PoolSize = defaultTelnetPoolSize
+	}
+
+	if k.config.Timeout <= 0 {
+		k.config.Timeout = defaultTelnetTimeout
+	}
+
+	// connections are dialed when first used, and again after failing
+	k.conns = make(chan *telnetConn, k.config.PoolSize)
+	for i := 0; i < k.config.PoolSize; i++ {
+		k.conns <- nil
+	}
+
+	return k
+}
+
+func (k *kairosDBTelnet) Write(metrics []builder.Metric) error {
+	var lines, viaHTTP []builder.Metric
+	for _, m := range metrics {
+		if m.GetTTL() > 0 || !telnetSafe(m) {
+			viaHTTP = append(viaHTTP, m)
+			continue
+		}
+		lines = append(lines, m)
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mut  sync.Mutex
+		werr error
+	)
+	for _, chunk := range telnetChunks(lines, k.config.PoolSize) {
+		wg.Add(1)
+		go func(chunk []builder.Metric) {
+			defer wg.Done()
+			if err := k.writeLines(chunk); err != nil {
+				mut.Lock()
+				werr = err
+				mut.Unlock()
+			}
+		}(chunk)
+	}
+
+	if len(viaHTTP) > 0 {
+		if err := k.kairosDB.Write(viaHTTP); err != nil {
+			mut.Lock()
+			werr = err
+			mut.Unlock()
+		}
+	}
+
+	wg.Wait()
+	return werr
+}
+
+// writeLines writes metrics on the next free connection and waits for kairosdb
+// to have read them.
+func (k *kairosDBTelnet) writeLines(metrics []builder.Metric) error {
+	tc := <-k.conns
+	defer func() { k.conns <- tc }()
+
+	if tc == nil {
+		conn, err := net.DialTimeout("tcp", k.config.TelnetAddress, k.config.Timeout)
+		if err != nil {
+			return err
+		}
+		tc = &telnetConn{conn: conn, reader: bufio.NewReader(conn), writer: bufio.NewWriter(conn)}
+	}
+
+	err := tc.write(metrics, time.Now().Add(k.config.Timeout))
+	if err != nil {
+		k.logger.WithError(err).Warn("telnet write failed, reconnecting")
+		tc.conn.Close()
+		tc = nil
+	}
+	return err
+}
+
+func (tc *telnetConn) write(metrics []builder.Metric, deadline time.Time) error {
+	if err := tc.conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+
+	for _, m := range metrics {
+		tags := telnetTags(m.GetTags())
+		for _, dp := range m.GetDataPoints() {
+			value, err := telnetValue(dp)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(tc.writer, "putm %s %d %s%s\n", m.GetName(), dp.Timestamp(), value, tags)
+		}
+	}
+
+	tc.writer.WriteString("version\n")
+	if err := tc.writer.Flush(); err != nil {
+		return err
+	}
+
+	_, err := tc.reader.ReadString('\n')
+	return err
+}
+
+// telnetChunks splits metrics into at most n chunks of at least minTelnetChunk
+// metrics.
+func telnetChunks(metrics []builder.Metric, n int) [][]builder.Metric {
+	size := (len(metrics) + n - 1) / n
+	if size < minTelnetChunk {
+		size = minTelnetChunk
+	}
+
+	var chunks [][]builder.Metric
+	for len(metrics) > 0 {
+		if size > len(metrics) {
+			size = len(metrics)
+		}
+		chunks = append(chunks, metrics[:size])
+		metrics = metrics[size:]
+	}
+	return chunks
+}
+
+// telnetSafe reports whether a metric fits on lines, which are split on spaces
+// and tags on their first =. Anything else is left to the http api to write or
+// reject.
+func telnetSafe(m builder.Metric) bool {
+	if m.GetName() == "" || strings.ContainsAny(m.GetName(), " \t\r\n") {
+		return false
+	}
+	for k, v := range m.GetTags() {
+		if k == "" || v == "" || strings.ContainsAny(k, " \t\r\n=") || strings.ContainsAny(v, " \t\r\n") {
+			return false
+		}
+	}
+	for _, dp := range m.GetDataPoints() {
+		if _, err := telnetValue(dp); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func telnetTags(tags map[string]string) string {
+	var b bytes.Buffer
+	for k, v := range tags {
+		b.WriteString(" ")
+		b.WriteString(k)
+		b.WriteString("=")
+		b.WriteString(v)
+	}
+	return b.String()
+}
+
+// telnetValue formats a datapoint like its json encoding, so kairosdb stores
+// the same type whichever api wrote it. kairosdb's line parser takes values
+// with a decimal point as doubles and doesn't accept exponents.
+func telnetValue(dp builder.DataPoint) (string, error) {
+	if v, err := dp.Int64Value(); err == nil {
+		return strconv.FormatInt(v, 10), nil
+	}
+	v, err := dp.Float64Value()
+	if err != nil {
+		return "", fmt.Errorf("datapoint value must be a number")
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64), nil
+}
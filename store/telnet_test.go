@@ -0,0 +1,185 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	builder "github.com/dan-compton/go-kairosdb/builder"
+)
+
+// telnetServer reads lines from its connections, answering version commands
+// the way kairosdb does.
+type telnetServer struct {
+	net.Listener
+	mut   sync.Mutex
+	lines []string
+	conns int
+	// hangUp closes the connection at the next version command instead of
+	// answering it.
+	hangUp bool
+}
+
+func fakeTelnet(tb testing.TB) *telnetServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	s := &telnetServer{Listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.mut.Lock()
+			s.conns++
+			s.mut.Unlock()
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *telnetServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		version := strings.HasPrefix(line, "version")
+		s.mut.Lock()
+		s.lines = append(s.lines, strings.TrimSuffix(line, "\n"))
+		hangUp := version && s.hangUp
+		if hangUp {
+			s.hangUp = false
+		}
+		s.mut.Unlock()
+
+		if hangUp {
+			return
+		}
+		if version {
+			conn.Write([]byte("KairosDB 1.1.1\n"))
+		}
+	}
+}
+
+// received returns the lines read so far and forgets them.
+func (s *telnetServer) received() []string {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	lines := s.lines
+	s.lines = nil
+	return lines
+}
+
+func TestKairosDBTelnetWrite(t *testing.T) {
+	l := fakeTelnet(t)
+	defer l.Close()
+
+	var viaHTTP []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var metrics []struct {
+			Name string `json:"name"`
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(b, &metrics)
+		for _, m := range metrics {
+			viaHTTP = append(viaHTTP, m.Name)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	k := NewKairosDBTelnet(&TelnetConfig{
+		KairosDBConfig: KairosDBConfig{Address: server.URL},
+		TelnetAddress:  l.Addr().String(),
+		PoolSize:       1,
+	})
+	err := k.Write([]builder.Metric{
+		builder.NewMetric("requests").AddTag("host", "a").AddDataPoint(testMillis, 5).AddDataPoint(testMillis+1000, int64(7)),
+		builder.NewMetric("latency").AddTag("host", "b").AddDataPoint(testMillis, 0.25),
+		builder.NewMetric("bytes").AddDataPoint(testMillis, 1e21),
+		builder.NewMetric("retained").AddTag("host", "a").AddTTL(60).AddDataPoint(testMillis, 1),
+		builder.NewMetric("spaced").AddTag("host", "a b").AddDataPoint(testMillis, 1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"putm requests 1500000000000 5 host=a",
+		"putm requests 1500000001000 7 host=a",
+		"putm latency 1500000000000 0.25 host=b",
+		"putm bytes 1500000000000 1000000000000000000000",
+		"version",
+	}
+	if got := l.received(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got lines %q, want %q", got, want)
+	}
+	if want := []string{"retained", "spaced"}; !reflect.DeepEqual(viaHTTP, want) {
+		t.Errorf("wrote %q over http, want %q", viaHTTP, want)
+	}
+}
+
+func TestKairosDBTelnetReconnect(t *testing.T) {
+	l := fakeTelnet(t)
+	defer l.Close()
+
+	k := NewKairosDBTelnet(&TelnetConfig{TelnetAddress: l.Addr().String(), PoolSize: 1})
+	metrics := []builder.Metric{builder.NewMetric("requests").AddDataPoint(testMillis, 5)}
+
+	// a dropped connection fails the write, and the next one redials
+	l.mut.Lock()
+	l.hangUp = true
+	l.mut.Unlock()
+	if err := k.Write(metrics); err == nil {
+		t.Error("got no error when the connection was dropped")
+	}
+	l.received()
+
+	for i := 0; i < 2; i++ {
+		if err := k.Write(metrics); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"putm requests 1500000000000 5", "version", "putm requests 1500000000000 5", "version"}
+	if got := l.received(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got lines %q after reconnecting, want %q", got, want)
+	}
+
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if l.conns != 2 {
+		t.Errorf("dialed %d connections, want the dropped one redialed once", l.conns)
+	}
+}
+
+func BenchmarkKairosDBTelnetWrite(b *testing.B) {
+	l := fakeTelnet(b)
+	defer l.Close()
+
+	k := NewKairosDBTelnet(&TelnetConfig{TelnetAddress: l.Addr().String(), PoolSize: 4})
+	metrics := benchMetrics(1000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := k.Write(metrics); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,522 @@
+package worker
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/opsee/basic/schema"
+	log "github.com/opsee/logrus"
+)
+
+const (
+	archiveExt              = ".pb.gz"
+	archiveIndex            = "index.jsonl"
+	archiveDayLayout        = "2006-01-02"
+	archiveUnknownCustomer  = "unknown"
+	archiveFlushInterval    = 10 * time.Second
+	defaultArchiveFileBytes = 64 << 20
+	defaultArchiveFileAge   = time.Hour
+	defaultArchiveOpenFiles = 256
+)
+
+var errArchiveStopped = errors.New("archive is stopped")
+
+type ArchiveConfig struct {
+	// Dir belongs to one worker, files not in an index are taken to be its own.
+	Dir string
+	// Files are rotated once they have FileBytes compressed bytes or have been
+	// open for FileAge, and the least recently written are rotated to keep at
+	// most MaxOpenFiles open.
+	FileBytes    int64
+	FileAge      time.Duration
+	MaxOpenFiles int
+}
+
+// ArchiveIndexEntry is a line of a day's index, the time range of the results
+// in a rotated file.
+type ArchiveIndexEntry struct {
+	File    string    `json:"file"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Results int       `json:"results"`
+	Bytes   int64     `json:"bytes"`
+}
+
+type ArchiveStats struct {
+	Archived  int64 `json:"archived"`
+	Failed    int64 `json:"failed"`
+	OpenFiles int   `json:"open_files"`
+}
+
+// archive keeps the raw check results the worker receives so they can be
+// reprocessed, see ReadResults. Results are appended as gzipped, length
+// delimited protobufs to files under Dir/<customer id>/<day>/, partitioned by
+// the results' timestamps in UTC. When a file is rotated its time range is
+// appended to the day's index, so replays only read the files they need;
+// files not in an index are still being written.
+type archive struct {
+	config   *ArchiveConfig
+	mut      *sync.Mutex
+	files    map[string]*archiveFile
+	stopped  bool
+	stopChan chan struct{}
+	doneChan chan struct{}
+	archived int64
+	failed   int64
+	logger   *log.Entry
+}
+
+type archiveFile struct {
+	dir     string
+	file    *os.File
+	counter *countingWriter
+	gz      *gzip.Writer
+	opened  time.Time
+	written time.Time
+	entry   ArchiveIndexEntry
+}
+
+func NewArchive(config *ArchiveConfig) (*archive, error) {
+	a := &archive{
+		config:   config,
+		mut:      &sync.Mutex{},
+		files:    make(map[string]*archiveFile),
+		stopChan: make(chan struct{}),
+		doneChan: make(chan struct{}),
+		logger:   log.WithField("archive", config.Dir),
+	}
+
+	if a.config.FileBytes <= 0 {
+		a.config.FileBytes = defaultArchiveFileBytes
+	}
+
+	if a.config.FileAge <= 0 {
+		a.config.FileAge = defaultArchiveFileAge
+	}
+
+	if a.config.MaxOpenFiles <= 0 {
+		a.config.MaxOpenFiles = defaultArchiveOpenFiles
+	}
+
+	if err := os.MkdirAll(a.config.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	if err := a.recover(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (a *archive) Start() {
+	go a.loop()
+}
+
+// Archive appends a check result to its customer's file for its day.
+func (a *archive) Archive(result *schema.CheckResult) error {
+	ts := time.Now().UTC()
+	if result.Timestamp != nil {
+		ts = result.Timestamp.Time().UTC()
+	}
+	dir := filepath.Join(a.config.Dir, archiveCustomer(result.CustomerId), ts.Format(archiveDayLayout))
+
+	a.mut.Lock()
+	defer a.mut.Unlock()
+
+	err := a.append(dir, ts, result)
+	if err != nil {
+		atomic.AddInt64(&a.failed, 1)
+		return err
+	}
+
+	atomic.AddInt64(&a.archived, 1)
+	return nil
+}
+
+// append writes a result to the open file of dir. The caller must hold a.mut.
+func (a *archive) append(dir string, ts time.Time, result *schema.CheckResult) error {
+	if a.stopped {
+		return errArchiveStopped
+	}
+
+	f, ok := a.files[dir]
+	if !ok {
+		var err error
+		if f, err = a.open(dir); err != nil {
+			return err
+		}
+	}
+
+	if err := WriteDelimited(f.gz, result); err != nil {
+		// the file can't be trusted past this point
+		a.rotate(f)
+		return err
+	}
+
+	f.written = time.Now()
+	f.entry.Results++
+	if f.entry.Start.IsZero() || ts.Before(f.entry.Start) {
+		f.entry.Start = ts
+	}
+	if ts.After(f.entry.End) {
+		f.entry.End = ts
+	}
+
+	if f.counter.n >= a.config.FileBytes {
+		a.rotate(f)
+	}
+
+	return nil
+}
+
+// open starts a new file in dir, rotating the least recently written file if
+// too many are open. The caller must hold a.mut.
+func (a *archive) open(dir string) (*archiveFile, error) {
+	if len(a.files) >= a.config.MaxOpenFiles {
+		var lru *archiveFile
+		for _, f := range a.files {
+			if lru == nil || f.written.Before(lru.written) {
+				lru = f
+			}
+		}
+		a.rotate(lru)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	name := fmt.Sprintf("%020d%s", time.Now().UnixNano(), archiveExt)
+	file, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	counter := &countingWriter{w: file}
+	f := &archiveFile{
+		dir:     dir,
+		file:    file,
+		counter: counter,
+		gz:      gzip.NewWriter(counter),
+		opened:  time.Now(),
+		entry:   ArchiveIndexEntry{File: name},
+	}
+	a.files[dir] = f
+
+	return f, nil
+}
+
+// rotate closes a file and adds it to its day's index. The caller must hold
+// a.mut.
+func (a *archive) rotate(f *archiveFile) {
+	delete(a.files, f.dir)
+
+	if err := f.gz.Close(); err != nil {
+		a.logger.WithError(err).Errorf("failed to finish archive file %s", f.file.Name())
+	}
+	if err := f.file.Sync(); err != nil {
+		a.logger.WithError(err).Errorf("failed to sync archive file %s", f.file.Name())
+	}
+	if err := f.file.Close(); err != nil {
+		a.logger.WithError(err).Errorf("failed to close archive file %s", f.file.Name())
+	}
+
+	if f.entry.Results == 0 {
+		os.Remove(f.file.Name())
+		return
+	}
+
+	f.entry.Bytes = f.counter.n
+	if err := appendIndex(f.dir, &f.entry); err != nil {
+		a.logger.WithError(err).Errorf("failed to index archive file %s", f.file.Name())
+	}
+}
+
+// loop flushes open files so little is lost in a crash, and rotates those that
+// have been open for FileAge.
+func (a *archive) loop() {
+	defer close(a.doneChan)
+
+	ticker := time.NewTicker(archiveFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			a.mut.Lock()
+			for _, f := range a.files {
+				if time.Since(f.opened) >= a.config.FileAge {
+					a.rotate(f)
+					continue
+				}
+				if err := f.gz.Flush(); err != nil {
+					a.logger.WithError(err).Errorf("failed to flush archive file %s", f.file.Name())
+				}
+			}
+			a.mut.Unlock()
+
+		case <-a.stopChan:
+			return
+		}
+	}
+}
+
+// Stop rotates every open file. Results archived after Stop are rejected.
+func (a *archive) Stop(timeout time.Duration) error {
+	a.mut.Lock()
+	if a.stopped {
+		a.mut.Unlock()
+		return nil
+	}
+	a.stopped = true
+	for _, f := range a.files {
+		a.rotate(f)
+	}
+	a.mut.Unlock()
+
+	close(a.stopChan)
+	select {
+	case <-a.doneChan:
+	case <-time.After(timeout):
+		return errors.New("timed out stopping archive")
+	}
+
+	a.logger.Info("stopped")
+	return nil
+}
+
+func (a *archive) Stats() ArchiveStats {
+	a.mut.Lock()
+	open := len(a.files)
+	a.mut.Unlock()
+
+	return ArchiveStats{
+		Archived:  atomic.LoadInt64(&a.archived),
+		Failed:    atomic.LoadInt64(&a.failed),
+		OpenFiles: open,
+	}
+}
+
+// recover indexes the files left open by a crash. Their last results may have
+// been lost, so they're indexed with the results that can still be read, or
+// removed if there are none.
+func (a *archive) recover() error {
+	// files are removed, so walk the directories before looking in them
+	var dirs []string
+	err := filepath.Walk(a.config.Dir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.IsDir() {
+			dirs = append(dirs, path)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		entries, err := readIndex(dir)
+		if err != nil {
+			return err
+		}
+		indexed := make(map[string]bool)
+		for _, e := range entries {
+			indexed[e.File] = true
+		}
+
+		names, err := archiveFileNames(dir)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			if indexed[name] {
+				continue
+			}
+
+			entry, err := scanArchiveFile(filepath.Join(dir, name))
+			if err != nil {
+				a.logger.WithError(err).Warnf("recovered %d results from truncated archive file %s", entry.Results, name)
+			}
+			if entry.Results == 0 {
+				os.Remove(filepath.Join(dir, name))
+				continue
+			}
+			if err := appendIndex(dir, entry); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func scanArchiveFile(path string) (*ArchiveIndexEntry, error) {
+	entry := &ArchiveIndexEntry{File: filepath.Base(path)}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return entry, err
+	}
+	defer f.Close()
+
+	// results without a timestamp were archived at the time they arrived,
+	// which the file's last write is the closest to
+	received := time.Now().UTC()
+	if fi, err := f.Stat(); err == nil {
+		entry.Bytes = fi.Size()
+		received = fi.ModTime().UTC()
+	}
+
+	err = ReadResults(f, ResultsDelimited, func(result *schema.CheckResult) error {
+		ts := received
+		if result.Timestamp != nil {
+			ts = result.Timestamp.Time().UTC()
+		}
+		entry.Results++
+		if entry.Start.IsZero() || ts.Before(entry.Start) {
+			entry.Start = ts
+		}
+		if ts.After(entry.End) {
+			entry.End = ts
+		}
+		return nil
+	})
+
+	return entry, err
+}
+
+// ArchivedFiles lists the indexed archive files under dir, e.g. an archive or a
+// customer's directory in one, holding results between start and end, zero for
+// unbounded, oldest first.
+func ArchivedFiles(dir string, start, end time.Time) ([]string, error) {
+	var files []string
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.IsDir() {
+			return err
+		}
+
+		entries, err := readIndex(path)
+		if err != nil {
+			return err
+		}
+
+		sort.Sort(indexByStart(entries))
+		for _, e := range entries {
+			if !start.IsZero() && e.End.Before(start) {
+				continue
+			}
+			if !end.IsZero() && !e.Start.Before(end) {
+				continue
+			}
+			files = append(files, filepath.Join(path, e.File))
+		}
+
+		return nil
+	})
+
+	return files, err
+}
+
+func readIndex(dir string) ([]*ArchiveIndexEntry, error) {
+	f, err := os.Open(filepath.Join(dir, archiveIndex))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []*ArchiveIndexEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		entry := &ArchiveIndexEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			// most likely a torn write from a crash, recover reindexes the file
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+func appendIndex(dir string, entry *ArchiveIndexEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	f, err := os.OpenFile(filepath.Join(dir, archiveIndex), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func archiveFileNames(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, fi := range infos {
+		if !fi.IsDir() && strings.HasSuffix(fi.Name(), archiveExt) {
+			names = append(names, fi.Name())
+		}
+	}
+	return names, nil
+}
+
+// archiveCustomer is the directory of a customer's results, customer ids that
+// aren't safe as one are archived as unknown.
+func archiveCustomer(id string) string {
+	if id == "" || strings.HasPrefix(id, ".") || strings.ContainsAny(id, `/\`) {
+		return archiveUnknownCustomer
+	}
+	return id
+}
+
+type indexByStart []*ArchiveIndexEntry
+
+func (s indexByStart) Len() int           { return len(s) }
+func (s indexByStart) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s indexByStart) Less(i, j int) bool { return s[i].Start.Before(s[j].Start) }
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,91 @@
+package worker
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opsee/basic/schema"
+	opsee_types "github.com/opsee/protobuf/opseeproto/types"
+)
+
+// writeArchiveFile writes results to an archive file that was never indexed,
+// as if the worker writing it had crashed.
+func writeArchiveFile(t *testing.T, dir string, results ...*schema.CheckResult) string {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "00000000000000000001"+archiveExt)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	for _, result := range results {
+		if err := WriteDelimited(gz, result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestArchiveRecover(t *testing.T) {
+	day := testTime.UTC().Format(archiveDayLayout)
+	timed := &schema.CheckResult{CustomerId: "customer-1", CheckId: "check-1", Timestamp: opsee_types.NewTimestamp(testTime)}
+	untimed := &schema.CheckResult{CheckId: "check-2"}
+
+	tests := []struct {
+		name        string
+		dir         string
+		results     []*schema.CheckResult
+		wantResults int
+	}{
+		{"timestamped", filepath.Join("customer-1", day), []*schema.CheckResult{timed, timed}, 2},
+		{"only invalid results", filepath.Join(archiveUnknownCustomer, day), []*schema.CheckResult{untimed}, 1},
+		{"empty", filepath.Join("customer-2", day), nil, 0},
+	}
+
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "archive")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		path := writeArchiveFile(t, filepath.Join(dir, test.dir), test.results...)
+		if _, err := NewArchive(&ArchiveConfig{Dir: dir}); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		files, err := ArchivedFiles(dir, time.Time{}, time.Time{})
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if test.wantResults == 0 {
+			if _, err := os.Stat(path); !os.IsNotExist(err) || len(files) != 0 {
+				t.Errorf("%s: kept an archive file without results, indexed %v", test.name, files)
+			}
+			continue
+		}
+		if len(files) != 1 || files[0] != path {
+			t.Errorf("%s: got archived files %v, want %s", test.name, files, path)
+			continue
+		}
+
+		entries, err := readIndex(filepath.Dir(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entries[0].Results != test.wantResults || entries[0].Start.IsZero() {
+			t.Errorf("%s: indexed %d results from %s, want %d", test.name, entries[0].Results, entries[0].Start, test.wantResults)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package worker
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	builder "github.com/dan-compton/go-kairosdb/builder"
+	log "github.com/opsee/logrus"
+	"github.com/opsee/marktricks/store"
+)
+
+const (
+	// CardinalityDrop drops points that would create a series over the limit.
+	CardinalityDrop = "drop"
+	// CardinalityCollapse replaces the limited tags' values with
+	// CollapsedTagValue, dropping the point if that is still a new series.
+	CardinalityCollapse = "collapse"
+	// CardinalityStrip removes the limited tags, dropping the point if that is
+	// still a new series.
+	CardinalityStrip = "strip"
+
+	CollapsedTagValue = "other"
+
+	defaultCardinalityWindow = 24 * time.Hour
+	defaultCustomerTag       = "customer"
+)
+
+type CardinalityConfig struct {
+	// Window is how long a series counts towards the limits after its last point.
+	Window time.Duration
+	// CustomerLimit and MetricLimit are the most distinct series a customer may
+	// have, in total and per metric. Zero is unlimited.
+	CustomerLimit int
+	MetricLimit   int
+	// Action is one of drop, collapse or strip.
+	Action string
+	// Tags are the tags collapsed or stripped from points over a limit.
+	Tags []string
+	// CustomerTag is the tag series are counted per customer by.
+	CustomerTag string
+}
+
+// CustomerCardinality is the number of distinct series a customer wrote
+// within the window, and how many points were dropped or limited since start.
+type CustomerCardinality struct {
+	CustomerId string
+	Series     int
+	Metrics    map[string]int
+	Dropped    int64
+	Limited    int64
+}
+
+type customerSeries struct {
+	series  map[string]*seenSeries
+	metrics map[string]int
+	dropped int64
+	limited int64
+}
+
+type seenSeries struct {
+	metric string
+	seen   time.Time
+}
+
+// cardinalityGuard tracks distinct tag combinations per customer and metric
+// over a sliding window, and keeps points that would create series past the
+// configured limits out of kairosdb.
+type cardinalityGuard struct {
+	config     *CardinalityConfig
+	customers  map[string]*customerSeries
+	lastExpire time.Time
+	mut        *sync.Mutex
+	logger     *log.Entry
+}
+
+func NewCardinalityGuard(config *CardinalityConfig) (*cardinalityGuard, error) {
+	g := &cardinalityGuard{
+		config:     config,
+		customers:  make(map[string]*customerSeries),
+		lastExpire: time.Now(),
+		mut:        &sync.Mutex{},
+		logger:     log.WithField("guard", "cardinality"),
+	}
+
+	if g.config.Window <= 0 {
+		g.logger.Infof("no cardinality window config detected, setting to %s", defaultCardinalityWindow)
+		g.config.Window = defaultCardinalityWindow
+	}
+
+	if g.config.CustomerTag == "" {
+		g.config.CustomerTag = defaultCustomerTag
+	}
+
+	switch g.config.Action {
+	case "":
+		g.config.Action = CardinalityDrop
+	case CardinalityDrop, CardinalityCollapse, CardinalityStrip:
+	default:
+		return nil, fmt.Errorf("unknown cardinality action: %s", g.config.Action)
+	}
+
+	return g, nil
+}
+
+// Guard returns the metrics that may be written, after applying the limit
+// action to those that would create a series over a limit.
+func (g *cardinalityGuard) Guard(metrics []builder.Metric) []builder.Metric {
+	now := time.Now()
+
+	g.mut.Lock()
+	defer g.mut.Unlock()
+
+	if now.Sub(g.lastExpire) > g.config.Window/10 {
+		g.expire(now)
+	}
+
+	guarded := make([]builder.Metric, 0, len(metrics))
+	for _, m := range metrics {
+		var (
+			name = m.GetName()
+			tags = m.GetTags()
+			c    = g.customer(tags[g.config.CustomerTag])
+			key  = store.SeriesKey(name, tags)
+		)
+
+		if s, ok := c.series[key]; ok {
+			s.seen = now
+			guarded = append(guarded, m)
+			continue
+		}
+
+		if !g.overLimit(c, name) {
+			c.add(key, name, now)
+			guarded = append(guarded, m)
+			continue
+		}
+
+		if g.config.Action == CardinalityDrop {
+			c.dropped++
+			continue
+		}
+
+		for _, tag := range g.config.Tags {
+			if _, ok := tags[tag]; !ok {
+				continue
+			}
+			if g.config.Action == CardinalityCollapse {
+				tags[tag] = CollapsedTagValue
+			} else {
+				delete(tags, tag)
+			}
+		}
+
+		// points without the limited tags, or whose limited series is new,
+		// would still add a series over the limit
+		key = store.SeriesKey(name, tags)
+		s, ok := c.series[key]
+		if !ok {
+			c.dropped++
+			continue
+		}
+		s.seen = now
+		c.limited++
+		guarded = append(guarded, m)
+	}
+
+	return guarded
+}
+
+// Cardinality returns the series counts for customerID, or for every customer
+// if customerID is empty, ordered by customer id.
+func (g *cardinalityGuard) Cardinality(customerID string) []*CustomerCardinality {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+
+	var counts []*CustomerCardinality
+	for id, c := range g.customers {
+		if customerID != "" && id != customerID {
+			continue
+		}
+
+		count := &CustomerCardinality{
+			CustomerId: id,
+			Series:     len(c.series),
+			Metrics:    make(map[string]int, len(c.metrics)),
+			Dropped:    c.dropped,
+			Limited:    c.limited,
+		}
+		for name, n := range c.metrics {
+			count.Metrics[name] = n
+		}
+		counts = append(counts, count)
+	}
+
+	sort.Sort(byCustomerId(counts))
+	return counts
+}
+
+func (g *cardinalityGuard) overLimit(c *customerSeries, metric string) bool {
+	if g.config.CustomerLimit > 0 && len(c.series) >= g.config.CustomerLimit {
+		return true
+	}
+	return g.config.MetricLimit > 0 && c.metrics[metric] >= g.config.MetricLimit
+}
+
+func (g *cardinalityGuard) customer(id string) *customerSeries {
+	c, ok := g.customers[id]
+	if !ok {
+		c = &customerSeries{
+			series:  make(map[string]*seenSeries),
+			metrics: make(map[string]int),
+		}
+		g.customers[id] = c
+	}
+	return c
+}
+
+// expire forgets series that haven't had a point within the window.
+func (g *cardinalityGuard) expire(now time.Time) {
+	cutoff := now.Add(-g.config.Window)
+	for id, c := range g.customers {
+		for key, s := range c.series {
+			if s.seen.Before(cutoff) {
+				delete(c.series, key)
+				if c.metrics[s.metric]--; c.metrics[s.metric] <= 0 {
+					delete(c.metrics, s.metric)
+				}
+			}
+		}
+		if len(c.series) == 0 && c.dropped == 0 && c.limited == 0 {
+			delete(g.customers, id)
+		}
+	}
+	g.lastExpire = now
+}
+
+func (c *customerSeries) add(key, metric string, now time.Time) {
+	c.series[key] = &seenSeries{metric: metric, seen: now}
+	c.metrics[metric]++
+}
+
+type byCustomerId []*CustomerCardinality
+
+func (b byCustomerId) Len() int           { return len(b) }
+func (b byCustomerId) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byCustomerId) Less(i, j int) bool { return b[i].CustomerId < b[j].CustomerId }
@@ -0,0 +1,148 @@
+package worker
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	builder "github.com/dan-compton/go-kairosdb/builder"
+)
+
+// guardMetric returns a point of name for customer-1 with tags given as
+// alternating names and values.
+func guardMetric(name string, tags ...string) builder.Metric {
+	m := builder.NewMetric(name).AddTag("customer", "customer-1").AddDataPoint(testTime.UnixNano()/1e6, 1)
+	for i := 0; i+1 < len(tags); i += 2 {
+		m.AddTag(tags[i], tags[i+1])
+	}
+	return m
+}
+
+func TestCardinalityGuard(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      *CardinalityConfig
+		metrics     []builder.Metric
+		want        []string
+		wantSeries  int
+		wantDropped int64
+		wantLimited int64
+	}{
+		{
+			name:   "drop",
+			config: &CardinalityConfig{CustomerLimit: 2, Action: CardinalityDrop, Tags: []string{"target"}},
+			metrics: []builder.Metric{
+				guardMetric("latency", "target", "a"),
+				guardMetric("latency", "target", "b"),
+				guardMetric("latency", "target", "c"),
+				guardMetric("latency", "host", "x"),
+				guardMetric("latency", "target", "a"),
+			},
+			want: []string{
+				"latency 1500000000000 1 customer=customer-1,target=a",
+				"latency 1500000000000 1 customer=customer-1,target=a",
+				"latency 1500000000000 1 customer=customer-1,target=b",
+			},
+			wantSeries:  2,
+			wantDropped: 2,
+		},
+		{
+			name:   "collapse",
+			config: &CardinalityConfig{CustomerLimit: 2, Action: CardinalityCollapse, Tags: []string{"target"}},
+			metrics: []builder.Metric{
+				guardMetric("latency", "target", "a"),
+				guardMetric("latency", "target", CollapsedTagValue),
+				guardMetric("latency", "target", "c"),
+				guardMetric("latency", "target", "d"),
+				guardMetric("latency", "host", "x"),
+			},
+			want: []string{
+				"latency 1500000000000 1 customer=customer-1,target=a",
+				"latency 1500000000000 1 customer=customer-1,target=other",
+				"latency 1500000000000 1 customer=customer-1,target=other",
+				"latency 1500000000000 1 customer=customer-1,target=other",
+			},
+			wantSeries:  2,
+			wantDropped: 1,
+			wantLimited: 2,
+		},
+		{
+			name:   "collapse to a new series",
+			config: &CardinalityConfig{CustomerLimit: 2, Action: CardinalityCollapse, Tags: []string{"target"}},
+			metrics: []builder.Metric{
+				guardMetric("latency", "target", "a"),
+				guardMetric("latency", "target", "b"),
+				guardMetric("latency", "target", "c"),
+				guardMetric("latency", "host", "x"),
+			},
+			want: []string{
+				"latency 1500000000000 1 customer=customer-1,target=a",
+				"latency 1500000000000 1 customer=customer-1,target=b",
+			},
+			wantSeries:  2,
+			wantDropped: 2,
+		},
+		{
+			name:   "strip",
+			config: &CardinalityConfig{CustomerLimit: 2, Action: CardinalityStrip, Tags: []string{"target"}},
+			metrics: []builder.Metric{
+				guardMetric("latency", "target", "a"),
+				guardMetric("latency"),
+				guardMetric("latency", "target", "c"),
+				guardMetric("latency", "host", "x"),
+				guardMetric("latency", "host", "x", "target", "d"),
+			},
+			want: []string{
+				"latency 1500000000000 1 customer=customer-1",
+				"latency 1500000000000 1 customer=customer-1",
+				"latency 1500000000000 1 customer=customer-1,target=a",
+			},
+			wantSeries:  2,
+			wantDropped: 2,
+			wantLimited: 1,
+		},
+		{
+			name:   "metric limit",
+			config: &CardinalityConfig{MetricLimit: 1, Action: CardinalityDrop},
+			metrics: []builder.Metric{
+				guardMetric("latency", "target", "a"),
+				guardMetric("errors", "target", "a"),
+				guardMetric("latency", "target", "b"),
+			},
+			want: []string{
+				"errors 1500000000000 1 customer=customer-1,target=a",
+				"latency 1500000000000 1 customer=customer-1,target=a",
+			},
+			wantSeries:  2,
+			wantDropped: 1,
+		},
+	}
+
+	for _, test := range tests {
+		g, err := NewCardinalityGuard(test.config)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		in := append([]builder.Metric(nil), test.metrics...)
+		guarded := g.Guard(test.metrics)
+		if got := describe(guarded); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got metrics\n%s\nwant\n%s", test.name, strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+		}
+		for i := range in {
+			if test.metrics[i] != in[i] {
+				t.Errorf("%s: Guard changed metrics[%d] of its argument", test.name, i)
+			}
+		}
+
+		counts := g.Cardinality("customer-1")
+		if len(counts) != 1 {
+			t.Fatalf("%s: got %d customers, want 1", test.name, len(counts))
+		}
+		c := counts[0]
+		if c.Series != test.wantSeries || c.Dropped != test.wantDropped || c.Limited != test.wantLimited {
+			t.Errorf("%s: got series=%d dropped=%d limited=%d, want series=%d dropped=%d limited=%d",
+				test.name, c.Series, c.Dropped, c.Limited, test.wantSeries, test.wantDropped, test.wantLimited)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package worker
+
+import (
+	"fmt"
+
+	builder "github.com/dan-compton/go-kairosdb/builder"
+	"github.com/opsee/basic/schema"
+)
+
+// cloudwatchExtractor extracts every metric from cloudwatch check responses
+// under its namespace, with its unit, statistic and tags, and counts the
+// errors the bastion reported fetching them.
+type cloudwatchExtractor struct{}
+
+func NewCloudWatchExtractor() *cloudwatchExtractor {
+	return &cloudwatchExtractor{}
+}
+
+func (e *cloudwatchExtractor) Extract(result *schema.CheckResult, resp *schema.CheckResponse, tags map[string]string) ([]builder.Metric, error) {
+	reply, ok := resp.Reply.(*schema.CheckResponse_CloudwatchResponse)
+	if !ok || reply.CloudwatchResponse == nil {
+		return nil, fmt.Errorf("cloudwatch extractor got a %T reply", resp.Reply)
+	}
+
+	var (
+		metrics []builder.Metric
+		cw      = reply.CloudwatchResponse
+	)
+
+	for _, m := range cw.Metrics {
+		ts := result.Timestamp.Millis()
+		if m.Timestamp != nil {
+			ts = m.Timestamp.Millis()
+		}
+
+		nm := builder.NewMetric(CloudWatchMetricName(cw.Namespace, m.Name)).AddDataPoint(ts, m.Value)
+		addTags(nm, tags)
+		addTags(nm, map[string]string{
+			"unit":      m.Unit,
+			"statistic": m.Statistic,
+		})
+		addMetricTags(nm, tags, m.Tags)
+		metrics = append(metrics, nm)
+	}
+
+	// count errors reported by the bastion rather than dropping them
+	if len(cw.Errors) > 0 {
+		nm := builder.NewMetric(CloudWatchMetricName(cw.Namespace, "errors")).AddDataPoint(result.Timestamp.Millis(), len(cw.Errors))
+		addTags(nm, tags)
+		metrics = append(metrics, nm)
+	}
+
+	return metrics, nil
+}
+
+// CloudWatchMetricName namespaces a cloudwatch metric, e.g. cloudwatch.AWS/RDS.CPUUtilization
+func CloudWatchMetricName(namespace, name string) string {
+	if namespace == "" {
+		return fmt.Sprintf("cloudwatch.%s", name)
+	}
+	return fmt.Sprintf("cloudwatch.%s.%s", namespace, name)
+}
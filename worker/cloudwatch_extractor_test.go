@@ -0,0 +1,93 @@
+package worker
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opsee/basic/schema"
+	opsee_types "github.com/opsee/protobuf/opseeproto/types"
+)
+
+func TestCloudWatchExtractorExtract(t *testing.T) {
+	tags := map[string]string{"check": "check-1", "customer": "customer-1"}
+
+	tests := []struct {
+		name    string
+		reply   interface{}
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "metrics",
+			reply: &schema.CheckResponse_CloudwatchResponse{CloudwatchResponse: &schema.CloudWatchResponse{
+				Namespace: "AWS/RDS",
+				Metrics: []*schema.Metric{
+					{
+						Name:      "CPUUtilization",
+						Value:     42.5,
+						Unit:      "Percent",
+						Statistic: "Average",
+						Timestamp: opsee_types.NewTimestamp(testTime.Add(-time.Minute)),
+						Tags:      []*schema.Tag{{Name: "DBInstanceIdentifier", Value: "db-1"}, {Name: "customer", Value: "other"}},
+					},
+					{Name: "FreeableMemory", Value: 1024},
+				},
+			}},
+			want: []string{
+				"cloudwatch.AWS/RDS.CPUUtilization 1499999940000 42.5 DBInstanceIdentifier=db-1,check=check-1,customer=customer-1,statistic=Average,unit=Percent",
+				"cloudwatch.AWS/RDS.FreeableMemory 1500000000000 1024 check=check-1,customer=customer-1",
+			},
+		},
+		{
+			name: "no namespace",
+			reply: &schema.CheckResponse_CloudwatchResponse{CloudwatchResponse: &schema.CloudWatchResponse{
+				Metrics: []*schema.Metric{{Name: "Latency", Value: 0.25}},
+			}},
+			want: []string{
+				"cloudwatch.Latency 1500000000000 0.25 check=check-1,customer=customer-1",
+			},
+		},
+		{
+			name: "errors",
+			reply: &schema.CheckResponse_CloudwatchResponse{CloudwatchResponse: &schema.CloudWatchResponse{
+				Namespace: "AWS/ELB",
+				Errors:    []*opsee_types.Error{{ErrorCode: "Throttling"}, {ErrorCode: "AccessDenied"}},
+			}},
+			want: []string{
+				"cloudwatch.AWS/ELB.errors 1500000000000 2 check=check-1,customer=customer-1",
+			},
+		},
+		{
+			name:    "wrong reply type",
+			reply:   &schema.CheckResponse_HttpResponse{HttpResponse: &schema.HttpResponse{}},
+			want:    []string{},
+			wantErr: true,
+		},
+		{
+			name:    "empty reply",
+			reply:   &schema.CheckResponse_CloudwatchResponse{},
+			want:    []string{},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		resp := &schema.CheckResponse{Target: &schema.Target{Id: "a"}}
+		switch reply := test.reply.(type) {
+		case *schema.CheckResponse_HttpResponse:
+			resp.Reply = reply
+		case *schema.CheckResponse_CloudwatchResponse:
+			resp.Reply = reply
+		}
+
+		metrics, err := NewCloudWatchExtractor().Extract(testResult(resp), resp, tags)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %t", test.name, err, test.wantErr)
+		}
+		if got := describe(metrics); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got metrics\n%s\nwant\n%s", test.name, strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+		}
+	}
+}
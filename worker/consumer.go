@@ -1,37 +1,57 @@
 package worker
 
 import (
+	"errors"
 	"time"
 
 	"github.com/nsqio/go-nsq"
-	"github.com/opsee/basic/schema"
 	log "github.com/opsee/logrus"
 )
 
+type Consumer interface {
+	AddHandler(handlerFunc func(msg *nsq.Message) error)
+	Start() error
+	Info()
+	Stop(timeout time.Duration) error
+}
+
 type nsqConsumer struct {
-	config      *ConsumerConfig
-	consumer    *nsq.Consumer
-	eventChan   chan *schema.CheckResult
-	stopChan    chan struct{}
-	stoppedChan chan struct{}
-	logger      *log.Entry
+	config   *ConsumerConfig
+	consumer *nsq.Consumer
+	logger   *log.Entry
 }
 
+// ConsumerConfig configures a consumer of one topic. The consumer discovers
+// nsqds through LookupdAddresses when any are given, and otherwise connects
+// directly to NSQDAddresses.
 type ConsumerConfig struct {
 	Topic            string
 	Channel          string
 	LookupdAddresses []string
+	NSQDAddresses    []string
 	NSQConfig        *nsq.Config
 	HandlerCount     int
 }
 
+var (
+	errNoNSQAddresses = errors.New("no nsqlookupd or nsqd addresses configured")
+	errStopTimeout    = errors.New("timed out waiting for in-flight messages")
+)
+
 func NewConsumer(config *ConsumerConfig) (*nsqConsumer, error) {
 	c := &nsqConsumer{
-		config:      config,
-		stopChan:    make(chan struct{}, 1),
-		stoppedChan: make(chan struct{}, 1),
-		eventChan:   make(chan *schema.CheckResult),
-		logger:      log.WithField("consumer", "nsq"),
+		config: config,
+		logger: log.WithFields(log.Fields{
+			"consumer": "nsq",
+			"topic":    config.Topic,
+			"channel":  config.Channel,
+		}),
+	}
+
+	if c.config.NSQConfig == nil {
+		c.logger.Info("no nsq config detected, setting max_in_flight to 4")
+		c.config.NSQConfig = nsq.NewConfig()
+		c.config.NSQConfig.MaxInFlight = 4
 	}
 
 	var err error
@@ -50,32 +70,39 @@ func NewConsumer(config *ConsumerConfig) (*nsqConsumer, error) {
 }
 
 func (c *nsqConsumer) Start() error {
-	if c.config.NSQConfig == nil {
-		c.logger.Info("no nsq config detected, setting max_in_flight to 4")
-		c.config.NSQConfig = nsq.NewConfig()
-		c.config.NSQConfig.MaxInFlight = 4
+	if len(c.config.LookupdAddresses) > 0 {
+		return c.consumer.ConnectToNSQLookupds(c.config.LookupdAddresses)
+	}
+
+	if len(c.config.NSQDAddresses) > 0 {
+		c.logger.Info("no nsqlookupd addresses configured, connecting to nsqds directly")
+		return c.consumer.ConnectToNSQDs(c.config.NSQDAddresses)
 	}
 
-	return c.consumer.ConnectToNSQLookupds(c.config.LookupdAddresses)
+	return errNoNSQAddresses
 }
 
 func (c *nsqConsumer) Info() {
 	stats := c.consumer.Stats()
 	isStarved := c.consumer.IsStarved()
-	log.Infof("(NSQ) Received:%d, Finished:%d, Requeued:%d, Connections: %d, Starved: %t", stats.MessagesReceived, stats.MessagesFinished, stats.MessagesRequeued, stats.Connections, isStarved)
+	c.logger.Infof("(NSQ) Received:%d, Finished:%d, Requeued:%d, Connections: %d, Starved: %t", stats.MessagesReceived, stats.MessagesFinished, stats.MessagesRequeued, stats.Connections, isStarved)
 }
 
-func (c *nsqConsumer) Stop() {
+// Stop stops receiving new messages and waits up to timeout for the handlers
+// to respond to the messages already in flight.
+func (c *nsqConsumer) Stop(timeout time.Duration) error {
 	c.logger.Info("stopping")
-	defer close(c.stopChan)
-	defer close(c.stoppedChan)
+	c.consumer.Stop()
 
-	c.stopChan <- struct{}{}
 	select {
-	case <-c.stoppedChan:
-	case <-time.After(5 * time.Second):
+	case <-c.consumer.StopChan:
+	case <-time.After(timeout):
+		c.logger.Warn("timed out waiting for in-flight messages")
+		return errStopTimeout
 	}
+
 	c.logger.Info("stopped")
+	return nil
 }
 
 func (c *nsqConsumer) AddHandler(handlerFunc func(msg *nsq.Message) error) {
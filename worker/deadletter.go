@@ -0,0 +1,118 @@
+package worker
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/nsqio/go-nsq"
+	log "github.com/opsee/logrus"
+	"github.com/opsee/marktricks/pb"
+)
+
+// DeadLetterSink stores messages that will never be written to kairosdb.
+type DeadLetterSink interface {
+	Put(letter *pb.DeadLetter) error
+}
+
+type nsqDeadLetterSink struct {
+	producer *nsq.Producer
+	topic    string
+}
+
+// NewNSQDeadLetterSink publishes dead letters as protobufs to an nsq topic.
+func NewNSQDeadLetterSink(nsqdAddr, topic string) (*nsqDeadLetterSink, error) {
+	producer, err := nsq.NewProducer(nsqdAddr, nsq.NewConfig())
+	if err != nil {
+		return nil, err
+	}
+
+	return &nsqDeadLetterSink{
+		producer: producer,
+		topic:    topic,
+	}, nil
+}
+
+func (s *nsqDeadLetterSink) Put(letter *pb.DeadLetter) error {
+	b, err := proto.Marshal(letter)
+	if err != nil {
+		return err
+	}
+
+	return s.producer.Publish(s.topic, b)
+}
+
+type fileDeadLetterSink struct {
+	file *os.File
+	mut  *sync.Mutex
+}
+
+// NewFileDeadLetterSink appends dead letters to a local file as length
+// delimited protobufs, see ReadDeadLetters.
+func NewFileDeadLetterSink(path string) (*fileDeadLetterSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileDeadLetterSink{
+		file: f,
+		mut:  &sync.Mutex{},
+	}, nil
+}
+
+func (s *fileDeadLetterSink) Put(letter *pb.DeadLetter) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if err := WriteDelimited(s.file, letter); err != nil {
+		return err
+	}
+
+	return s.file.Sync()
+}
+
+func (s *fileDeadLetterSink) Close() error {
+	return s.file.Close()
+}
+
+// ReadDeadLetters calls fn with every dead letter written to r by a file sink.
+func ReadDeadLetters(r io.Reader, fn func(*pb.DeadLetter) error) error {
+	br := bufio.NewReader(r)
+	for {
+		letter := &pb.DeadLetter{}
+		err := ReadDelimited(br, letter)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := fn(letter); err != nil {
+			return err
+		}
+	}
+}
+
+type logDeadLetterSink struct {
+	logger *log.Entry
+}
+
+// NewLogDeadLetterSink only logs dead letters, for when no other sink is configured.
+func NewLogDeadLetterSink() *logDeadLetterSink {
+	return &logDeadLetterSink{
+		logger: log.WithField("sink", "deadletter"),
+	}
+}
+
+func (s *logDeadLetterSink) Put(letter *pb.DeadLetter) error {
+	s.logger.WithFields(log.Fields{
+		"reason":   letter.Reason,
+		"attempts": letter.Attempts,
+		"bytes":    len(letter.Body),
+	}).Error("dropping dead letter")
+	return nil
+}
@@ -0,0 +1,58 @@
+package worker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/gogo/protobuf/proto"
+)
+
+// maxDelimitedBytes bounds the messages ReadDelimited accepts, well above any
+// check result nsq would deliver.
+const maxDelimitedBytes = 64 << 20
+
+// WriteDelimited writes msg to w prefixed with its varint encoded length, the
+// same framing as the java protobuf writeDelimitedTo.
+func WriteDelimited(w io.Writer, msg proto.Message) error {
+	b, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	var size [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(size[:], uint64(len(b)))
+	if _, err := w.Write(size[:n]); err != nil {
+		return err
+	}
+
+	_, err = w.Write(b)
+	return err
+}
+
+// ReadDelimited reads the next length prefixed message from r into msg. It
+// returns io.EOF when r is exhausted between messages, and an error if the
+// message is longer than maxDelimitedBytes.
+func ReadDelimited(r *bufio.Reader, msg proto.Message) error {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+
+	if size > maxDelimitedBytes {
+		return fmt.Errorf("message of %d bytes is longer than %d", size, maxDelimitedBytes)
+	}
+
+	// the buffer grows as the message is read rather than trusting the prefix
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(size)); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	return proto.Unmarshal(buf.Bytes(), msg)
+}
@@ -0,0 +1,167 @@
+package worker
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+
+	builder "github.com/dan-compton/go-kairosdb/builder"
+	"github.com/hashicorp/go-multierror"
+	"github.com/opsee/basic/schema"
+	log "github.com/opsee/logrus"
+)
+
+// Extractor turns one check response, of the reply type it is registered for,
+// into metric points carrying at least tags, the series tags mapped for the
+// response. The result is passed along for its ids and timestamp; it has
+// already passed ValidateResult.
+type Extractor interface {
+	Extract(result *schema.CheckResult, resp *schema.CheckResponse, tags map[string]string) ([]builder.Metric, error)
+}
+
+// ExtractorFunc adapts a function to an Extractor.
+type ExtractorFunc func(result *schema.CheckResult, resp *schema.CheckResponse, tags map[string]string) ([]builder.Metric, error)
+
+func (f ExtractorFunc) Extract(result *schema.CheckResult, resp *schema.CheckResponse, tags map[string]string) ([]builder.Metric, error) {
+	return f(result, resp, tags)
+}
+
+// registry maps CheckResponse reply types to the extractor for them.
+type registry struct {
+	extractors map[reflect.Type]Extractor
+	tags       *tagMapper
+	mut        *sync.RWMutex
+	logger     *log.Entry
+}
+
+// NewRegistry returns an empty registry that tags points using mapper.
+func NewRegistry(mapper *tagMapper) *registry {
+	return &registry{
+		extractors: make(map[reflect.Type]Extractor),
+		tags:       mapper,
+		mut:        &sync.RWMutex{},
+		logger:     log.WithField("extractor", "registry"),
+	}
+}
+
+// Register sets the extractor for responses whose reply has the same type as
+// reply, e.g. &schema.CheckResponse_HttpResponse{}.
+func (r *registry) Register(reply interface{}, extractor Extractor) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.extractors[reflect.TypeOf(reply)] = extractor
+}
+
+// Extract returns the availability metrics for result and its responses, and
+// every metric the registered extractors produce for its responses. Responses
+// with no registered extractor are skipped, as are the points of responses
+// missing a required tag. An error from one response doesn't stop the others,
+// the metrics extracted are returned alongside the errors.
+func (r *registry) Extract(result *schema.CheckResult) ([]builder.Metric, error) {
+	var (
+		metrics []builder.Metric
+		errs    error
+	)
+
+	ctags, err := r.tags.Tags(result, nil)
+	if err != nil {
+		errs = multierror.Append(errs, err)
+	} else {
+		metrics = append(metrics, checkAvailability(result, ctags)...)
+	}
+
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+
+	for _, resp := range result.Responses {
+		tags, err := r.tags.Tags(result, resp)
+		if err != nil {
+			errs = multierror.Append(errs, err)
+			continue
+		}
+
+		metrics = append(metrics, targetAvailability(result, resp, tags)...)
+
+		if resp.Reply == nil {
+			// failed responses carry no reply, availability covers them
+			continue
+		}
+
+		extractor, ok := r.extractors[reflect.TypeOf(resp.Reply)]
+		if !ok {
+			r.logger.Debugf("unsupported check type: %T", resp.Reply)
+			continue
+		}
+
+		m, err := extractor.Extract(result, resp, tags)
+		if err != nil {
+			errs = multierror.Append(errs, err)
+		}
+		metrics = append(metrics, m...)
+	}
+
+	return metrics, errs
+}
+
+// checkAvailability derives a pass/fail gauge and response counts for the
+// check as a whole.
+func checkAvailability(result *schema.CheckResult, tags map[string]string) []builder.Metric {
+	var metrics []builder.Metric
+	for name, value := range map[string]int{
+		"check.passing":           boolValue(result.Passing),
+		"check.responses.passing": result.PassingCount(),
+		"check.responses.failing": result.FailingCount(),
+	} {
+		nm := builder.NewMetric(name).AddDataPoint(result.Timestamp.Millis(), value)
+		addTags(nm, tags)
+		metrics = append(metrics, nm)
+	}
+	return metrics
+}
+
+// targetAvailability derives a pass/fail gauge and an error counter for the
+// target of a single response.
+func targetAvailability(result *schema.CheckResult, resp *schema.CheckResponse, tags map[string]string) []builder.Metric {
+	ts := result.Timestamp.Millis()
+
+	pm := builder.NewMetric("target.passing").AddDataPoint(ts, boolValue(resp.Passing))
+	addTags(pm, tags)
+	metrics := []builder.Metric{pm}
+
+	if resp.Error != "" {
+		em := builder.NewMetric("target.errors").AddDataPoint(ts, 1)
+		addTags(em, tags)
+		em.AddTag("error_type", classifyError(resp.Error))
+		metrics = append(metrics, em)
+	}
+
+	return metrics
+}
+
+// classifyError buckets a check response error into a coarse category so error
+// mixes can be charted without exploding the error_type tag.
+func classifyError(e string) string {
+	e = strings.ToLower(e)
+	switch {
+	case strings.Contains(e, "timeout") || strings.Contains(e, "deadline exceeded"):
+		return "timeout"
+	case strings.Contains(e, "connection refused"):
+		return "connection_refused"
+	case strings.Contains(e, "connection reset"):
+		return "connection_reset"
+	case strings.Contains(e, "no such host") || strings.Contains(e, "lookup "):
+		return "dns"
+	case strings.Contains(e, "tls") || strings.Contains(e, "x509") || strings.Contains(e, "certificate"):
+		return "tls"
+	default:
+		return "other"
+	}
+}
+
+// boolValue converts a pass/fail state into a 1/0 gauge value.
+func boolValue(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
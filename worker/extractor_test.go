@@ -0,0 +1,177 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	builder "github.com/dan-compton/go-kairosdb/builder"
+	"github.com/opsee/basic/schema"
+	opsee_types "github.com/opsee/protobuf/opseeproto/types"
+)
+
+var testTime = time.Unix(1500000000, 0)
+
+func testResult(responses ...*schema.CheckResponse) *schema.CheckResult {
+	return &schema.CheckResult{
+		CustomerId: "customer-1",
+		CheckId:    "check-1",
+		Timestamp:  opsee_types.NewTimestamp(testTime),
+		Responses:  responses,
+	}
+}
+
+// describe renders metrics as sorted "name timestamp value tags" lines so they
+// can be compared regardless of the order they were extracted in.
+func describe(metrics []builder.Metric) []string {
+	lines := []string{}
+	for _, m := range metrics {
+		var tags []string
+		for k, v := range m.GetTags() {
+			tags = append(tags, k+"="+v)
+		}
+		sort.Strings(tags)
+
+		for _, dp := range m.GetDataPoints() {
+			lines = append(lines, fmt.Sprintf("%s %d %v %s", m.GetName(), dp.Timestamp(), dataPointValue(dp), strings.Join(tags, ",")))
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func TestRegistryExtract(t *testing.T) {
+	fake := ExtractorFunc(func(result *schema.CheckResult, resp *schema.CheckResponse, tags map[string]string) ([]builder.Metric, error) {
+		m := builder.NewMetric("fake").AddDataPoint(result.Timestamp.Millis(), 1)
+		addTags(m, tags)
+		if resp.Error == "fail extraction" {
+			return []builder.Metric{m}, errors.New("extraction failed")
+		}
+		return []builder.Metric{m}, nil
+	})
+
+	httpReply := &schema.CheckResponse_HttpResponse{HttpResponse: &schema.HttpResponse{}}
+	cloudwatchReply := &schema.CheckResponse_CloudwatchResponse{CloudwatchResponse: &schema.CloudWatchResponse{}}
+
+	tests := []struct {
+		name    string
+		result  *schema.CheckResult
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "availability",
+			result: testResult(
+				&schema.CheckResponse{Target: &schema.Target{Id: "a"}, Passing: true},
+				&schema.CheckResponse{Target: &schema.Target{Id: "b"}, Error: "dial tcp: i/o timeout"},
+			),
+			want: []string{
+				"check.passing 1500000000000 0 check=check-1,customer=customer-1",
+				"check.responses.failing 1500000000000 1 check=check-1,customer=customer-1",
+				"check.responses.passing 1500000000000 1 check=check-1,customer=customer-1",
+				"target.errors 1500000000000 1 check=check-1,customer=customer-1,error_type=timeout,target=b",
+				"target.passing 1500000000000 0 check=check-1,customer=customer-1,target=b",
+				"target.passing 1500000000000 1 check=check-1,customer=customer-1,target=a",
+			},
+		},
+		{
+			name:   "registered reply",
+			result: testResult(&schema.CheckResponse{Target: &schema.Target{Id: "a"}, Passing: true, Reply: httpReply}),
+			want: []string{
+				"check.passing 1500000000000 0 check=check-1,customer=customer-1",
+				"check.responses.failing 1500000000000 0 check=check-1,customer=customer-1",
+				"check.responses.passing 1500000000000 1 check=check-1,customer=customer-1",
+				"fake 1500000000000 1 check=check-1,customer=customer-1,target=a",
+				"target.passing 1500000000000 1 check=check-1,customer=customer-1,target=a",
+			},
+		},
+		{
+			name:   "nil reply",
+			result: testResult(&schema.CheckResponse{Target: &schema.Target{Id: "a"}, Passing: true}),
+			want: []string{
+				"check.passing 1500000000000 0 check=check-1,customer=customer-1",
+				"check.responses.failing 1500000000000 0 check=check-1,customer=customer-1",
+				"check.responses.passing 1500000000000 1 check=check-1,customer=customer-1",
+				"target.passing 1500000000000 1 check=check-1,customer=customer-1,target=a",
+			},
+		},
+		{
+			name:   "unregistered reply",
+			result: testResult(&schema.CheckResponse{Target: &schema.Target{Id: "a"}, Passing: true, Reply: cloudwatchReply}),
+			want: []string{
+				"check.passing 1500000000000 0 check=check-1,customer=customer-1",
+				"check.responses.failing 1500000000000 0 check=check-1,customer=customer-1",
+				"check.responses.passing 1500000000000 1 check=check-1,customer=customer-1",
+				"target.passing 1500000000000 1 check=check-1,customer=customer-1,target=a",
+			},
+		},
+		{
+			name:   "extractor error",
+			result: testResult(&schema.CheckResponse{Target: &schema.Target{Id: "a"}, Error: "fail extraction", Reply: httpReply}),
+			want: []string{
+				"check.passing 1500000000000 0 check=check-1,customer=customer-1",
+				"check.responses.failing 1500000000000 1 check=check-1,customer=customer-1",
+				"check.responses.passing 1500000000000 0 check=check-1,customer=customer-1",
+				"fake 1500000000000 1 check=check-1,customer=customer-1,target=a",
+				"target.errors 1500000000000 1 check=check-1,customer=customer-1,error_type=other,target=a",
+				"target.passing 1500000000000 0 check=check-1,customer=customer-1,target=a",
+			},
+			wantErr: true,
+		},
+		{
+			name: "missing required tag",
+			result: &schema.CheckResult{
+				CheckId:   "check-1",
+				Timestamp: opsee_types.NewTimestamp(testTime),
+				Responses: []*schema.CheckResponse{{Target: &schema.Target{Id: "a"}, Reply: httpReply}},
+			},
+			want:    []string{},
+			wantErr: true,
+		},
+	}
+
+	mapper, err := NewTagMapper(DefaultTagRules())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRegistry(mapper)
+	r.Register(&schema.CheckResponse_HttpResponse{}, fake)
+
+	for _, test := range tests {
+		metrics, err := r.Extract(test.result)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %t", test.name, err, test.wantErr)
+		}
+		if got := describe(metrics); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got metrics\n%s\nwant\n%s", test.name, strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+		}
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err  string
+		want string
+	}{
+		{"dial tcp 10.0.0.1:80: i/o timeout", "timeout"},
+		{"context deadline exceeded", "timeout"},
+		{"Client.Timeout exceeded while awaiting headers", "timeout"},
+		{"dial tcp 10.0.0.1:80: getsockopt: connection refused", "connection_refused"},
+		{"read tcp 10.0.0.1:80: connection reset by peer", "connection_reset"},
+		{"dial tcp: lookup example.invalid: no such host", "dns"},
+		{"x509: certificate signed by unknown authority", "tls"},
+		{"remote error: tls: handshake failure", "tls"},
+		{"unexpected EOF", "other"},
+		{"", "other"},
+	}
+
+	for _, test := range tests {
+		if got := classifyError(test.err); got != test.want {
+			t.Errorf("classifyError(%q) = %s, want %s", test.err, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,380 @@
+package worker
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	builder "github.com/dan-compton/go-kairosdb/builder"
+	log "github.com/opsee/logrus"
+	"github.com/opsee/marktricks/store"
+)
+
+const (
+	defaultSinkQueueSize  = 1000
+	defaultSinkMaxRetries = 5
+	defaultSinkRetryDelay = 5 * time.Second
+	maxSinkRetryDelay     = 5 * time.Minute
+)
+
+var (
+	errNoSinks     = errors.New("at least one sink is required")
+	errSinkStopped = errors.New("sink is stopped")
+)
+
+type SinkConfig struct {
+	Name   string
+	Store  store.Store
+	Writer *BatchWriterConfig
+	// Messages are acknowledged once every Primary sink has written their
+	// metrics, and requeued if any of them failed. Other sinks are written in
+	// the background and never hold up or fail a message.
+	Primary bool
+	// QueueSize is how many batches a sink buffers before dropping new ones
+	// (or blocking, for primary sinks).
+	QueueSize int
+	// MaxRetries is how many times a non-primary sink retries a batch that
+	// failed with a retryable error, waiting RetryDelay doubled each attempt.
+	// Primary sinks leave retries to nsq.
+	MaxRetries int
+	RetryDelay time.Duration
+}
+
+type FanoutConfig struct {
+	Sinks []*SinkConfig
+}
+
+// SinkStats are counts of metrics and batches handled by a sink since start.
+type SinkStats struct {
+	Written       int64     `json:"written"`
+	Failed        int64     `json:"failed"`
+	Retried       int64     `json:"retried"`
+	Dropped       int64     `json:"dropped"`
+	Queued        int       `json:"queued"`
+	LastWritten   time.Time `json:"last_written"`
+	LagMillis     int64     `json:"lag_ms"`
+	SpoolSegments int       `json:"spool_segments"`
+	SpoolBytes    int64     `json:"spool_bytes"`
+	// Blocked is how many times a primary sink's full queue held up a write.
+	Blocked int64 `json:"blocked"`
+}
+
+// fanoutWriter writes every batch to each of several sinks, each with its own
+// queue, batch writer and spool, so a slow or failing sink only falls behind
+// on its own.
+type fanoutWriter struct {
+	sinks   []*sink
+	primary int
+	logger  *log.Entry
+}
+
+type sinkBatch struct {
+	metrics  []builder.Metric
+	queued   time.Time
+	attempts int
+	done     func(error)
+}
+
+type sink struct {
+	config       *SinkConfig
+	writer       *batchWriter
+	queue        chan *sinkBatch
+	stopChan     chan struct{}
+	stoppedChan  chan struct{}
+	stoppingChan chan struct{}
+	stopped      bool
+	stats        SinkStats
+	mut          *sync.Mutex
+	logger       *log.Entry
+}
+
+func NewFanoutWriter(config *FanoutConfig) (*fanoutWriter, error) {
+	w := &fanoutWriter{
+		logger: log.WithField("writer", "fanout"),
+	}
+
+	if len(config.Sinks) == 0 {
+		return nil, errNoSinks
+	}
+
+	for _, sc := range config.Sinks {
+		if sc.Primary {
+			w.primary++
+		}
+	}
+	if w.primary == 0 {
+		w.logger.Infof("no primary sink configured, using %s", config.Sinks[0].Name)
+		config.Sinks[0].Primary = true
+		w.primary = 1
+	}
+
+	for _, sc := range config.Sinks {
+		w.sinks = append(w.sinks, newSink(sc))
+	}
+
+	return w, nil
+}
+
+func newSink(config *SinkConfig) *sink {
+	s := &sink{
+		config:       config,
+		writer:       NewBatchWriter(config.Store, config.Writer),
+		stopChan:     make(chan struct{}, 1),
+		stoppedChan:  make(chan struct{}, 1),
+		stoppingChan: make(chan struct{}),
+		mut:          &sync.Mutex{},
+		logger:       log.WithField("sink", config.Name),
+	}
+
+	if s.config.QueueSize <= 0 {
+		s.logger.Infof("no queue size config detected, setting to %d", defaultSinkQueueSize)
+		s.config.QueueSize = defaultSinkQueueSize
+	}
+
+	if s.config.MaxRetries < 0 {
+		s.config.MaxRetries = 0
+	} else if s.config.MaxRetries == 0 {
+		s.config.MaxRetries = defaultSinkMaxRetries
+	}
+
+	if s.config.RetryDelay <= 0 {
+		s.config.RetryDelay = defaultSinkRetryDelay
+	}
+
+	s.queue = make(chan *sinkBatch, s.config.QueueSize)
+
+	return s
+}
+
+func (w *fanoutWriter) Start() {
+	for _, s := range w.sinks {
+		s.writer.Start()
+		go s.run()
+	}
+}
+
+// Write queues metrics for every sink. done is called exactly once, after every
+// primary sink has written the metrics or one of them failed.
+func (w *fanoutWriter) Write(metrics []builder.Metric, done func(error)) {
+	var (
+		mut       sync.Mutex
+		remaining = w.primary
+		firstErr  error
+	)
+	primaryDone := func(err error) {
+		mut.Lock()
+		defer mut.Unlock()
+
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		remaining--
+		if remaining == 0 {
+			done(firstErr)
+		}
+	}
+
+	now := time.Now()
+	for _, s := range w.sinks {
+		if s.config.Primary {
+			if err := s.enqueue(&sinkBatch{metrics: metrics, queued: now, done: primaryDone}); err != nil {
+				primaryDone(err)
+			}
+		} else {
+			s.offer(&sinkBatch{metrics: metrics, queued: now})
+		}
+	}
+}
+
+// Stop flushes every sink, waiting up to timeout for all of them.
+func (w *fanoutWriter) Stop(timeout time.Duration) error {
+	w.logger.Info("stopping")
+
+	var (
+		wg   sync.WaitGroup
+		mut  sync.Mutex
+		serr error
+	)
+	for _, s := range w.sinks {
+		wg.Add(1)
+		go func(s *sink) {
+			defer wg.Done()
+			if err := s.stop(timeout); err != nil {
+				s.logger.WithError(err).Error("failed to stop sink cleanly")
+				mut.Lock()
+				serr = err
+				mut.Unlock()
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	w.logger.Info("stopped")
+	return serr
+}
+
+// Stats returns the stats of each sink by name.
+func (w *fanoutWriter) Stats() map[string]SinkStats {
+	stats := make(map[string]SinkStats, len(w.sinks))
+	for _, s := range w.sinks {
+		stats[s.config.Name] = s.snapshot()
+	}
+	return stats
+}
+
+// SpoolDepth returns the total segments and bytes spooled by all sinks.
+func (w *fanoutWriter) SpoolDepth() (int, int64) {
+	var (
+		segments int
+		bytes    int64
+	)
+	for _, s := range w.sinks {
+		if s.config.Writer.Spool != nil {
+			n, b := s.config.Writer.Spool.Depth()
+			segments += n
+			bytes += b
+		}
+	}
+	return segments, bytes
+}
+
+// enqueue waits for room in the sink's queue, failing once the sink is
+// stopped. The batch's done is only called if it was queued.
+func (s *sink) enqueue(b *sinkBatch) error {
+	s.mut.Lock()
+	if s.stopped {
+		s.mut.Unlock()
+		return errSinkStopped
+	}
+	select {
+	case s.queue <- b:
+		s.mut.Unlock()
+		return nil
+	default:
+	}
+	s.stats.Blocked++
+	s.mut.Unlock()
+
+	select {
+	case s.queue <- b:
+		return nil
+	case <-s.stoppingChan:
+		return errSinkStopped
+	}
+}
+
+// offer queues a batch if there's room and drops it otherwise, counting the
+// dropped metrics.
+func (s *sink) offer(b *sinkBatch) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	reason := "sink is stopped"
+	if !s.stopped {
+		select {
+		case s.queue <- b:
+			return
+		default:
+		}
+		reason = "queue is full"
+	}
+
+	s.stats.Dropped += int64(len(b.metrics))
+	s.logger.Warnf("dropped batch of %d metrics, %s, %d dropped since start", len(b.metrics), reason, s.stats.Dropped)
+}
+
+func (s *sink) run() {
+	for {
+		select {
+		case b := <-s.queue:
+			s.write(b)
+
+		case <-s.stopChan:
+			for len(s.queue) > 0 {
+				s.write(<-s.queue)
+			}
+			s.stoppedChan <- struct{}{}
+			return
+		}
+	}
+}
+
+func (s *sink) write(b *sinkBatch) {
+	s.writer.Write(b.metrics, func(err error) {
+		s.written(b, err)
+	})
+}
+
+// written records the outcome of writing a batch, and schedules a retry if it
+// failed and may succeed later.
+func (s *sink) written(b *sinkBatch, err error) {
+	s.mut.Lock()
+	switch {
+	case err == nil:
+		s.stats.Written += int64(len(b.metrics))
+		s.stats.LastWritten = time.Now()
+		s.stats.LagMillis = int64(time.Since(b.queued) / time.Millisecond)
+
+	case !s.config.Primary && IsRetryable(err) && b.attempts < s.config.MaxRetries && !s.stopped:
+		b.attempts++
+		s.stats.Retried += int64(len(b.metrics))
+		s.mut.Unlock()
+
+		delay := backoff(s.config.RetryDelay, maxSinkRetryDelay, uint16(b.attempts))
+		s.logger.WithError(err).Warnf("failed to write batch of %d metrics, retrying in %s", len(b.metrics), delay)
+		time.AfterFunc(delay, func() { s.offer(b) })
+		return
+
+	default:
+		s.stats.Failed += int64(len(b.metrics))
+	}
+	s.mut.Unlock()
+
+	if err != nil && !s.config.Primary {
+		s.logger.WithError(err).Errorf("failed to write batch of %d metrics", len(b.metrics))
+	}
+
+	if b.done != nil {
+		b.done(err)
+	}
+}
+
+func (s *sink) stop(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	s.mut.Lock()
+	if s.stopped {
+		s.mut.Unlock()
+		return nil
+	}
+	s.stopped = true
+	s.mut.Unlock()
+	close(s.stoppingChan)
+
+	s.stopChan <- struct{}{}
+	select {
+	case <-s.stoppedChan:
+	case <-time.After(timeout):
+		return errStopTimeout
+	}
+
+	// batches that raced stopping into the queue are failed, rather than
+	// left without an answer
+	for len(s.queue) > 0 {
+		s.written(<-s.queue, errSinkStopped)
+	}
+
+	return s.writer.Stop(deadline.Sub(time.Now()))
+}
+
+func (s *sink) snapshot() SinkStats {
+	s.mut.Lock()
+	stats := s.stats
+	s.mut.Unlock()
+
+	stats.Queued = len(s.queue)
+	if s.config.Writer.Spool != nil {
+		stats.SpoolSegments, stats.SpoolBytes = s.config.Writer.Spool.Depth()
+	}
+	return stats
+}
@@ -0,0 +1,299 @@
+package worker
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	builder "github.com/dan-compton/go-kairosdb/builder"
+	opsee "github.com/opsee/basic/service"
+	"github.com/opsee/marktricks/store"
+)
+
+var (
+	errUnavailable = &store.StatusError{StatusCode: http.StatusServiceUnavailable}
+	errRejected    = &store.StatusError{StatusCode: http.StatusBadRequest}
+)
+
+// fakeStore records the batches written to it. fail, if set, decides the
+// outcome of each write, and writes wait while block is set.
+type fakeStore struct {
+	mut     sync.Mutex
+	batches [][]builder.Metric
+	fail    func(metrics []builder.Metric) error
+	block   chan struct{}
+	healthy error
+}
+
+func (s *fakeStore) Write(metrics []builder.Metric) error {
+	s.mut.Lock()
+	block, fail := s.block, s.fail
+	s.mut.Unlock()
+
+	if block != nil {
+		<-block
+	}
+	if fail != nil {
+		if err := fail(metrics); err != nil {
+			return err
+		}
+	}
+
+	s.mut.Lock()
+	s.batches = append(s.batches, metrics)
+	s.mut.Unlock()
+	return nil
+}
+
+func (s *fakeStore) written() int {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	n := 0
+	for _, b := range s.batches {
+		n += len(b)
+	}
+	return n
+}
+
+func (s *fakeStore) Query(in *opsee.QueryMetricsRequest) (*opsee.QueryMetricsResponse, error) {
+	return &opsee.QueryMetricsResponse{}, nil
+}
+
+func (s *fakeStore) QueryTags(in *opsee.QueryMetricsRequest) (*opsee.QueryMetricsResponse, error) {
+	return &opsee.QueryMetricsResponse{}, nil
+}
+
+func (s *fakeStore) Delete(in *opsee.QueryMetricsRequest) error {
+	return nil
+}
+
+func (s *fakeStore) Healthy() error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.healthy
+}
+
+// waitFor polls cond until it holds, failing the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// writeBatch writes n metrics and returns a channel receiving their outcome.
+func writeBatch(w Writer, n int) chan error {
+	metrics := make([]builder.Metric, n)
+	for i := range metrics {
+		metrics[i] = builder.NewMetric("latency").AddTag("customer", "customer-1").AddDataPoint(testTime.UnixNano()/1e6, i)
+	}
+
+	done := make(chan error, 1)
+	w.Write(metrics, func(err error) { done <- err })
+	return done
+}
+
+func testSink(name string, st store.Store, primary bool) *SinkConfig {
+	return &SinkConfig{
+		Name:       name,
+		Store:      st,
+		Writer:     &BatchWriterConfig{BatchSize: 1, FlushInterval: 5 * time.Millisecond},
+		Primary:    primary,
+		RetryDelay: time.Millisecond,
+	}
+}
+
+func TestFanoutSinkIsolation(t *testing.T) {
+	primary := &fakeStore{}
+	failing := &fakeStore{fail: func([]builder.Metric) error { return errRejected }}
+	stuck := &fakeStore{block: make(chan struct{})}
+
+	w, err := NewFanoutWriter(&FanoutConfig{Sinks: []*SinkConfig{
+		testSink("primary", primary, true),
+		testSink("failing", failing, false),
+		testSink("stuck", stuck, false),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Start()
+
+	// neither a failing nor a stuck secondary sink holds up or fails a write
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-writeBatch(w, 2):
+			if err != nil {
+				t.Fatalf("write %d failed: %s", i, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("write %d waited on a secondary sink", i)
+		}
+	}
+
+	waitFor(t, "the failing sink to give up", func() bool { return w.Stats()["failing"].Failed == 6 })
+	close(stuck.block)
+	if err := w.Stop(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := w.Stats()
+	if s := stats["primary"]; s.Written != 6 || s.Failed != 0 || primary.written() != 6 {
+		t.Errorf("primary sink: got %+v, wrote %d, want 6 written", s, primary.written())
+	}
+	if s := stats["failing"]; s.Written != 0 || s.Retried != 0 || failing.written() != 0 {
+		t.Errorf("failing sink: got %+v, wrote %d, want 6 failed without retries", s, failing.written())
+	}
+	if s := stats["stuck"]; s.Written != 6 || stuck.written() != 6 {
+		t.Errorf("stuck sink: got %+v, wrote %d, want 6 written once unstuck", s, stuck.written())
+	}
+}
+
+func TestFanoutPrimaryFailure(t *testing.T) {
+	failing := &fakeStore{fail: func([]builder.Metric) error { return errUnavailable }}
+	w, err := NewFanoutWriter(&FanoutConfig{Sinks: []*SinkConfig{
+		testSink("ok", &fakeStore{}, true),
+		testSink("failing", failing, true),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Start()
+	defer w.Stop(time.Second)
+
+	// primary sinks leave retries to nsq
+	if err := <-writeBatch(w, 2); err != errUnavailable {
+		t.Errorf("got %v, want the failing primary's error", err)
+	}
+	if s := w.Stats()["failing"]; s.Retried != 0 || s.Failed != 2 {
+		t.Errorf("failing primary sink: got %+v, want 2 failed without retries", s)
+	}
+}
+
+func TestFanoutRetry(t *testing.T) {
+	var (
+		mut      sync.Mutex
+		attempts int
+	)
+	flaky := &fakeStore{fail: func([]builder.Metric) error {
+		mut.Lock()
+		defer mut.Unlock()
+		if attempts++; attempts <= 2 {
+			return errUnavailable
+		}
+		return nil
+	}}
+
+	secondary := testSink("flaky", flaky, false)
+	secondary.MaxRetries = 3
+	limited := testSink("limited", &fakeStore{fail: func([]builder.Metric) error { return errUnavailable }}, false)
+	limited.MaxRetries = 2
+
+	w, err := NewFanoutWriter(&FanoutConfig{Sinks: []*SinkConfig{
+		testSink("primary", &fakeStore{}, true),
+		secondary,
+		limited,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Start()
+	defer w.Stop(time.Second)
+
+	if err := <-writeBatch(w, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "the flaky sink to write", func() bool { return w.Stats()["flaky"].Written == 3 })
+	if s := w.Stats()["flaky"]; s.Retried != 6 || s.Failed != 0 {
+		t.Errorf("flaky sink: got %+v, want 3 metrics retried twice", s)
+	}
+
+	waitFor(t, "the limited sink to give up", func() bool { return w.Stats()["limited"].Failed == 3 })
+	if s := w.Stats()["limited"]; s.Retried != 6 || s.Written != 0 {
+		t.Errorf("limited sink: got %+v, want 3 metrics retried twice, then failed", s)
+	}
+}
+
+func TestFanoutDrops(t *testing.T) {
+	stuck := &fakeStore{block: make(chan struct{})}
+	secondary := testSink("stuck", stuck, false)
+	secondary.QueueSize = 1
+
+	w, err := NewFanoutWriter(&FanoutConfig{Sinks: []*SinkConfig{
+		testSink("primary", &fakeStore{}, true),
+		secondary,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Start()
+
+	const batches = 20
+	for i := 0; i < batches; i++ {
+		if err := <-writeBatch(w, 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dropped := w.Stats()["stuck"].Dropped
+	if dropped == 0 {
+		t.Error("a full queue dropped nothing")
+	}
+
+	close(stuck.block)
+	if err := w.Stop(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	s := w.Stats()["stuck"]
+	if s.Written+s.Dropped != 2*batches || int64(stuck.written()) != s.Written {
+		t.Errorf("stuck sink: got %+v, wrote %d, want every metric written or dropped", s, stuck.written())
+	}
+	if s.Dropped != dropped {
+		t.Errorf("stuck sink: dropped %d more metrics while stopping", s.Dropped-dropped)
+	}
+}
+
+func TestFanoutWriteAfterStop(t *testing.T) {
+	secondary := &fakeStore{}
+	w, err := NewFanoutWriter(&FanoutConfig{Sinks: []*SinkConfig{
+		testSink("primary", &fakeStore{}, true),
+		testSink("secondary", secondary, false),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Start()
+	if err := w.Stop(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-writeBatch(w, 2):
+		if err != errSinkStopped {
+			t.Errorf("got %v, want %v", err, errSinkStopped)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write after stop blocked")
+	}
+	if s := w.Stats()["secondary"]; s.Dropped != 2 {
+		t.Errorf("secondary sink: got %+v, want 2 dropped", s)
+	}
+}
+
+func TestNewFanoutWriter(t *testing.T) {
+	if _, err := NewFanoutWriter(&FanoutConfig{}); err != errNoSinks {
+		t.Errorf("got %v without sinks, want %v", err, errNoSinks)
+	}
+
+	sinks := []*SinkConfig{testSink("a", &fakeStore{}, false), testSink("b", &fakeStore{}, false)}
+	if _, err := NewFanoutWriter(&FanoutConfig{Sinks: sinks}); err != nil {
+		t.Fatal(err)
+	}
+	if !sinks[0].Primary || sinks[1].Primary {
+		t.Errorf("got primaries %t, %t, want only the first sink", sinks[0].Primary, sinks[1].Primary)
+	}
+}
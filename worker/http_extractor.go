@@ -0,0 +1,97 @@
+package worker
+
+import (
+	"fmt"
+
+	builder "github.com/dan-compton/go-kairosdb/builder"
+	"github.com/opsee/basic/schema"
+	log "github.com/opsee/logrus"
+)
+
+const HTTPMetricPrefix = "http."
+
+// httpExtractor extracts the response shape and every allowed metric from
+// http check responses, each under the http. prefix.
+type httpExtractor struct {
+	allow  map[string]bool
+	deny   map[string]bool
+	logger *log.Entry
+}
+
+// NewHTTPExtractor only extracts metrics named in allow, or every metric if
+// allow is empty, and never those named in deny.
+func NewHTTPExtractor(allow, deny []string) *httpExtractor {
+	e := &httpExtractor{
+		allow:  make(map[string]bool),
+		deny:   make(map[string]bool),
+		logger: log.WithField("extractor", "http"),
+	}
+	for _, name := range allow {
+		e.allow[name] = true
+	}
+	for _, name := range deny {
+		e.deny[name] = true
+	}
+	return e
+}
+
+func (e *httpExtractor) allowed(name string) bool {
+	if name == "" || e.deny[name] {
+		return false
+	}
+	return len(e.allow) == 0 || e.allow[name]
+}
+
+func (e *httpExtractor) Extract(result *schema.CheckResult, resp *schema.CheckResponse, tags map[string]string) ([]builder.Metric, error) {
+	reply, ok := resp.Reply.(*schema.CheckResponse_HttpResponse)
+	if !ok || reply.HttpResponse == nil {
+		return nil, fmt.Errorf("http extractor got a %T reply", resp.Reply)
+	}
+
+	var (
+		metrics []builder.Metric
+		hr      = reply.HttpResponse
+		ts      = result.Timestamp.Millis()
+	)
+
+	shape := map[string]int{
+		HTTPMetricPrefix + "response_size": len(hr.Body),
+		HTTPMetricPrefix + "header_count":  len(hr.Headers),
+	}
+	if hr.Code > 0 {
+		shape[HTTPMetricPrefix+"status_code"] = int(hr.Code)
+	}
+	for name, value := range shape {
+		nm := builder.NewMetric(name).AddDataPoint(ts, value)
+		addTags(nm, tags)
+		addTags(nm, map[string]string{
+			"host": hr.Host,
+		})
+		if hr.Code > 0 {
+			nm.AddTag("code", fmt.Sprintf("%d", hr.Code))
+			nm.AddTag("code_class", fmt.Sprintf("%dxx", hr.Code/100))
+		}
+		metrics = append(metrics, nm)
+	}
+
+	for _, m := range hr.Metrics {
+		if !e.allowed(m.Name) {
+			e.logger.Debugf("unsupported metric type: %s", m.Name)
+			continue
+		}
+
+		nm := builder.NewMetric(HTTPMetricPrefix+m.Name).AddDataPoint(ts, m.Value)
+		addTags(nm, tags)
+		addMetricTags(nm, tags, m.Tags)
+		metrics = append(metrics, nm)
+
+		// existing dashboards query the unprefixed latency series
+		if m.Name == "request_latency" {
+			lm := builder.NewMetric("request_latency").AddDataPoint(ts, m.Value)
+			addTags(lm, tags)
+			metrics = append(metrics, lm)
+		}
+	}
+
+	return metrics, nil
+}
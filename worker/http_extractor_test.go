@@ -0,0 +1,107 @@
+package worker
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/opsee/basic/schema"
+)
+
+func TestHTTPExtractorExtract(t *testing.T) {
+	tags := map[string]string{"check": "check-1", "customer": "customer-1"}
+
+	tests := []struct {
+		name    string
+		allow   []string
+		deny    []string
+		reply   interface{}
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "response shape",
+			reply: &schema.CheckResponse_HttpResponse{HttpResponse: &schema.HttpResponse{
+				Code:    503,
+				Body:    "oops",
+				Headers: []*schema.Header{{Name: "Content-Type"}, {Name: "Server"}},
+				Host:    "example.com",
+			}},
+			want: []string{
+				"http.header_count 1500000000000 2 check=check-1,code=503,code_class=5xx,customer=customer-1,host=example.com",
+				"http.response_size 1500000000000 4 check=check-1,code=503,code_class=5xx,customer=customer-1,host=example.com",
+				"http.status_code 1500000000000 503 check=check-1,code=503,code_class=5xx,customer=customer-1,host=example.com",
+			},
+		},
+		{
+			name:  "no status code",
+			reply: &schema.CheckResponse_HttpResponse{HttpResponse: &schema.HttpResponse{}},
+			want: []string{
+				"http.header_count 1500000000000 0 check=check-1,customer=customer-1",
+				"http.response_size 1500000000000 0 check=check-1,customer=customer-1",
+			},
+		},
+		{
+			name: "metrics",
+			deny: []string{"secret"},
+			reply: &schema.CheckResponse_HttpResponse{HttpResponse: &schema.HttpResponse{
+				Metrics: []*schema.Metric{
+					{Name: "request_latency", Value: 12.5, Tags: []*schema.Tag{{Name: "route", Value: "/a"}, {Name: "check", Value: "other"}}},
+					{Name: "secret", Value: 1},
+					{Name: "", Value: 1},
+				},
+			}},
+			want: []string{
+				"http.header_count 1500000000000 0 check=check-1,customer=customer-1",
+				"http.request_latency 1500000000000 12.5 check=check-1,customer=customer-1,route=/a",
+				"http.response_size 1500000000000 0 check=check-1,customer=customer-1",
+				"request_latency 1500000000000 12.5 check=check-1,customer=customer-1",
+			},
+		},
+		{
+			name:  "allow list",
+			allow: []string{"cache_hits"},
+			reply: &schema.CheckResponse_HttpResponse{HttpResponse: &schema.HttpResponse{
+				Metrics: []*schema.Metric{
+					{Name: "cache_hits", Value: 3},
+					{Name: "request_latency", Value: 12.5},
+				},
+			}},
+			want: []string{
+				"http.cache_hits 1500000000000 3 check=check-1,customer=customer-1",
+				"http.header_count 1500000000000 0 check=check-1,customer=customer-1",
+				"http.response_size 1500000000000 0 check=check-1,customer=customer-1",
+			},
+		},
+		{
+			name:    "wrong reply type",
+			reply:   &schema.CheckResponse_CloudwatchResponse{CloudwatchResponse: &schema.CloudWatchResponse{}},
+			want:    []string{},
+			wantErr: true,
+		},
+		{
+			name:    "empty reply",
+			reply:   &schema.CheckResponse_HttpResponse{},
+			want:    []string{},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		resp := &schema.CheckResponse{Target: &schema.Target{Id: "a"}}
+		switch reply := test.reply.(type) {
+		case *schema.CheckResponse_HttpResponse:
+			resp.Reply = reply
+		case *schema.CheckResponse_CloudwatchResponse:
+			resp.Reply = reply
+		}
+
+		metrics, err := NewHTTPExtractor(test.allow, test.deny).Extract(testResult(resp), resp, tags)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %t", test.name, err, test.wantErr)
+		}
+		if got := describe(metrics); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got metrics\n%s\nwant\n%s", test.name, strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+		}
+	}
+}
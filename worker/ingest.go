@@ -0,0 +1,223 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	builder "github.com/dan-compton/go-kairosdb/builder"
+	"github.com/opsee/basic/schema"
+	log "github.com/opsee/logrus"
+)
+
+var (
+	errNoDataPoints = errors.New("metric has no datapoints")
+	errNoTimestamp  = errors.New("metric has no timestamp")
+	errBadValue     = errors.New("metric value must be a finite number")
+)
+
+// Writer writes metrics, calling done once they've been written or failed.
+type Writer interface {
+	Write(metrics []builder.Metric, done func(error))
+}
+
+type IngesterConfig struct {
+	Extractors *registry
+	// TagMapper tags metrics ingested for a scope, see IngestScoped.
+	TagMapper *tagMapper
+	// Guard and Retention are skipped if nil.
+	Guard     *cardinalityGuard
+	Retention *retentionPolicy
+	Writer    Writer
+	// CustomerTag is set on raw metrics to the customer they're ingested for.
+	CustomerTag string
+	// Archive keeps every check result ingested, valid or not, if set.
+	Archive *archive
+}
+
+// ingester is the path from a check result or raw metrics to the writer:
+// extraction, the cardinality guard and retention.
+type ingester struct {
+	config *IngesterConfig
+	logger *log.Entry
+}
+
+func NewIngester(config *IngesterConfig) *ingester {
+	i := &ingester{
+		config: config,
+		logger: log.WithField("worker", "ingester"),
+	}
+
+	if i.config.CustomerTag == "" {
+		i.config.CustomerTag = defaultCustomerTag
+	}
+
+	return i
+}
+
+// IngestResult archives a check result, then extracts its metrics and writes
+// them. It returns an error without writing anything if the result is
+// invalid, otherwise how many metrics are being written, and done is called
+// once they have been.
+func (i *ingester) IngestResult(result *schema.CheckResult, done func(error)) (int, error) {
+	i.archive(result)
+	return i.ingest(result, done)
+}
+
+// RetryResult is IngestResult for a result that was ingested before, e.g. a
+// requeued message, which was archived then.
+func (i *ingester) RetryResult(result *schema.CheckResult, done func(error)) (int, error) {
+	return i.ingest(result, done)
+}
+
+func (i *ingester) ingest(result *schema.CheckResult, done func(error)) (int, error) {
+	if err := ValidateResult(result); err != nil {
+		return 0, err
+	}
+
+	metrics, err := i.config.Extractors.Extract(result)
+	if err != nil {
+		i.logger.WithFields(log.Fields{
+			"customer_id": result.CustomerId,
+			"check_id":    result.CheckId,
+			"bastion_id":  result.BastionId,
+		}).WithError(err).Warn("failed to extract some metrics")
+	}
+
+	return i.write(metrics, done), nil
+}
+
+// IngestMetrics writes metrics for a customer, tagging them with its id.
+// Like IngestResult, nothing is written if any of them is invalid.
+func (i *ingester) IngestMetrics(customerID string, metrics []builder.Metric, done func(error)) (int, error) {
+	for _, m := range metrics {
+		if err := validateMetric(m); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, m := range metrics {
+		m.AddTag(i.config.CustomerTag, customerID)
+	}
+
+	return i.write(metrics, done), nil
+}
+
+// IngestScoped writes metrics reported on behalf of scope, e.g. a customer's
+// bastion, tagged from the scope by the tag rules like the metrics of a check
+// result, plus the metrics' own tags. It returns an error without writing
+// anything if the scope has no customer, otherwise how many metrics are being
+// written and an error for each metric that was rejected, or nil.
+func (i *ingester) IngestScoped(scope *schema.CheckResult, metrics []*schema.Metric, done func(error)) (int, []error, error) {
+	tags, err := i.config.TagMapper.ScopeTags(scope, i.config.CustomerTag)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var (
+		errs  = make([]error, len(metrics))
+		valid []builder.Metric
+	)
+	for j, m := range metrics {
+		nm, err := scopedMetric(m, tags)
+		if err != nil {
+			errs[j] = err
+			continue
+		}
+		valid = append(valid, nm)
+	}
+
+	return i.write(valid, done), errs, nil
+}
+
+// scopedMetric converts a metric to a series tagged with tags, which its own
+// tags may add to but not override.
+func scopedMetric(m *schema.Metric, tags map[string]string) (builder.Metric, error) {
+	if m == nil {
+		return nil, errors.New("metric is null")
+	}
+	if m.Timestamp == nil {
+		return nil, errNoTimestamp
+	}
+	if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+		return nil, errBadValue
+	}
+
+	nm := builder.NewMetric(m.Name).AddDataPoint(m.Timestamp.Millis(), m.Value)
+	addTags(nm, tags)
+	for _, t := range m.Tags {
+		if t == nil {
+			continue
+		}
+		if _, ok := tags[t.Name]; ok {
+			return nil, fmt.Errorf("tag %s is set by the tag rules", t.Name)
+		}
+		nm.AddTag(t.Name, t.Value)
+	}
+
+	if err := validateMetric(nm); err != nil {
+		return nil, err
+	}
+	return nm, nil
+}
+
+// archive keeps result in the archive, if there is one.
+func (i *ingester) archive(result *schema.CheckResult) {
+	if i.config.Archive == nil {
+		return
+	}
+	if err := i.config.Archive.Archive(result); err != nil {
+		i.logger.WithFields(log.Fields{
+			"customer_id": result.CustomerId,
+			"check_id":    result.CheckId,
+		}).WithError(err).Error("failed to archive check result")
+	}
+}
+
+func (i *ingester) write(metrics []builder.Metric, done func(error)) int {
+	if i.config.Guard != nil {
+		metrics = i.config.Guard.Guard(metrics)
+	}
+	if i.config.Retention != nil {
+		i.config.Retention.Apply(metrics)
+	}
+	if len(metrics) == 0 {
+		done(nil)
+		return 0
+	}
+
+	i.config.Writer.Write(metrics, done)
+	return len(metrics)
+}
+
+// validateMetric checks what the builder would reject, so one bad metric is
+// rejected on its own rather than failing the batch it's written in.
+func validateMetric(m builder.Metric) error {
+	if m.GetName() == "" {
+		return builder.ErrorMetricNameInvalid
+	}
+
+	for k, v := range m.GetTags() {
+		if k == "" {
+			return builder.ErrorTagNameInvalid
+		}
+		if v == "" {
+			return fmt.Errorf("tag %s has no value", k)
+		}
+	}
+
+	if len(m.GetDataPoints()) == 0 {
+		return errNoDataPoints
+	}
+
+	for _, dp := range m.GetDataPoints() {
+		if _, err := dp.Float64Value(); err == nil {
+			continue
+		}
+		if _, err := dp.Int64Value(); err != nil {
+			return fmt.Errorf("datapoint at %d has a non-numeric value", dp.Timestamp())
+		}
+	}
+
+	return nil
+}
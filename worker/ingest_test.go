@@ -0,0 +1,170 @@
+package worker
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	builder "github.com/dan-compton/go-kairosdb/builder"
+	"github.com/opsee/basic/schema"
+	opsee_types "github.com/opsee/protobuf/opseeproto/types"
+)
+
+type writerFunc func(metrics []builder.Metric, done func(error))
+
+func (f writerFunc) Write(metrics []builder.Metric, done func(error)) {
+	f(metrics, done)
+}
+
+func TestIngestScoped(t *testing.T) {
+	ts := opsee_types.NewTimestamp(testTime)
+
+	tests := []struct {
+		name         string
+		scope        *schema.CheckResult
+		metrics      []*schema.Metric
+		limit        int
+		wantAccepted int
+		wantErrs     []bool
+		want         []string
+		wantErr      bool
+	}{
+		{
+			name:  "customer scope",
+			scope: &schema.CheckResult{CustomerId: "customer-1", BastionId: "bastion-1"},
+			metrics: []*schema.Metric{
+				{Name: "queue_depth", Value: 3, Timestamp: ts, Tags: []*schema.Tag{{Name: "queue", Value: "a"}}},
+				{Name: "queue_depth", Value: 1},
+				{Name: "queue_depth", Value: 1, Timestamp: ts, Tags: []*schema.Tag{{Name: "customer", Value: "other"}}},
+			},
+			wantAccepted: 1,
+			wantErrs:     []bool{false, true, true},
+			want:         []string{"queue_depth 1500000000000 3 customer=customer-1,queue=a"},
+		},
+		{
+			name:  "check scope",
+			scope: &schema.CheckResult{CustomerId: "customer-1", CheckId: "check-1"},
+			metrics: []*schema.Metric{
+				{Name: "queue_depth", Value: 3, Timestamp: ts},
+			},
+			wantAccepted: 1,
+			wantErrs:     []bool{false},
+			want:         []string{"queue_depth 1500000000000 3 check=check-1,customer=customer-1"},
+		},
+		{
+			name:  "guarded",
+			scope: &schema.CheckResult{CustomerId: "customer-1"},
+			metrics: []*schema.Metric{
+				{Name: "queue_depth", Value: 3, Timestamp: ts, Tags: []*schema.Tag{{Name: "queue", Value: "a"}}},
+				{Name: "queue_depth", Value: 1, Timestamp: ts, Tags: []*schema.Tag{{Name: "queue", Value: "b"}}},
+			},
+			limit:        1,
+			wantAccepted: 1,
+			wantErrs:     []bool{false, false},
+			want:         []string{"queue_depth 1500000000000 3 customer=customer-1,queue=a"},
+		},
+		{
+			name:    "no customer",
+			scope:   &schema.CheckResult{CheckId: "check-1"},
+			metrics: []*schema.Metric{{Name: "queue_depth", Value: 3, Timestamp: ts}},
+			want:    []string{},
+			wantErr: true,
+		},
+	}
+
+	mapper, err := NewTagMapper(DefaultTagRules())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range tests {
+		var written []builder.Metric
+		config := &IngesterConfig{
+			TagMapper: mapper,
+			Writer: writerFunc(func(metrics []builder.Metric, done func(error)) {
+				written = append(written, metrics...)
+				done(nil)
+			}),
+		}
+		if test.limit > 0 {
+			if config.Guard, err = NewCardinalityGuard(&CardinalityConfig{CustomerLimit: test.limit}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		accepted, errs, err := NewIngester(config).IngestScoped(test.scope, test.metrics, func(error) {})
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %t", test.name, err, test.wantErr)
+			continue
+		}
+		if accepted != test.wantAccepted {
+			t.Errorf("%s: got %d accepted, want %d", test.name, accepted, test.wantAccepted)
+		}
+
+		var gotErrs []bool
+		for _, err := range errs {
+			gotErrs = append(gotErrs, err != nil)
+		}
+		if !reflect.DeepEqual(gotErrs, test.wantErrs) {
+			t.Errorf("%s: got metric errors %v, want %v", test.name, errs, test.wantErrs)
+		}
+		if got := describe(written); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got metrics\n%s\nwant\n%s", test.name, strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+		}
+	}
+}
+
+func TestIngestResultArchivesOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive, err := NewArchive(&ArchiveConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive.Start()
+	defer archive.Stop(time.Second)
+
+	mapper, err := NewTagMapper(DefaultTagRules())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every write fails, as if kairosdb were gone until the message is
+	// dead-lettered
+	ingester := NewIngester(&IngesterConfig{
+		Extractors: NewRegistry(mapper),
+		TagMapper:  mapper,
+		Archive:    archive,
+		Writer: writerFunc(func(metrics []builder.Metric, done func(error)) {
+			done(errors.New("kairosdb is unavailable"))
+		}),
+	})
+
+	result := testResult(&schema.CheckResponse{Target: &schema.Target{Id: "a"}, Passing: true})
+	if _, err := ingester.IngestResult(result, func(error) {}); err != nil {
+		t.Fatal(err)
+	}
+	for attempt := 1; attempt < 3; attempt++ {
+		if _, err := ingester.RetryResult(result, func(error) {}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := archive.Stats().Archived; got != 1 {
+		t.Errorf("got %d results archived after 3 failed deliveries, want 1", got)
+	}
+
+	if _, err := ingester.IngestResult(&schema.CheckResult{CheckId: "check-2"}, func(error) {}); err == nil {
+		t.Fatal("ingested a result without a customer")
+	}
+	if got := archive.Stats().Archived; got != 2 {
+		t.Errorf("got %d results archived with an invalid one, want 2", got)
+	}
+}
@@ -0,0 +1,149 @@
+package worker
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	log "github.com/opsee/logrus"
+	"github.com/opsee/marktricks/pb"
+	"github.com/opsee/marktricks/store"
+	opsee_types "github.com/opsee/protobuf/opseeproto/types"
+)
+
+const (
+	defaultMaxAttempts  = 10
+	defaultBaseDelay    = 5 * time.Second
+	defaultMaxDelay     = 5 * time.Minute
+	maxBackoffExponent  = 16
+	deadLetterRetryWait = time.Minute
+)
+
+// IsRetryable reports whether a failed store write may succeed if tried again.
+// Transport failures and server side errors are retryable, anything the store or
+// the builder rejected outright is not.
+func IsRetryable(err error) bool {
+	switch e := err.(type) {
+	case nil:
+		return false
+	case *store.StatusError:
+		return e.StatusCode >= http.StatusInternalServerError ||
+			e.StatusCode == http.StatusTooManyRequests ||
+			e.StatusCode == http.StatusRequestTimeout
+	case *url.Error:
+		return true
+	case net.Error:
+		return true
+	}
+	return false
+}
+
+type ResponderConfig struct {
+	MaxAttempts uint16
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	DeadLetters DeadLetterSink
+}
+
+// responder finishes, requeues or dead-letters an nsq message once the outcome
+// of writing its metrics is known.
+type responder struct {
+	config *ResponderConfig
+	logger *log.Entry
+}
+
+func NewResponder(config *ResponderConfig) *responder {
+	r := &responder{
+		config: config,
+		logger: log.WithField("responder", "nsq"),
+	}
+
+	if r.config.MaxAttempts == 0 {
+		r.logger.Infof("no max attempts config detected, setting to %d", defaultMaxAttempts)
+		r.config.MaxAttempts = defaultMaxAttempts
+	}
+
+	if r.config.BaseDelay <= 0 {
+		r.config.BaseDelay = defaultBaseDelay
+	}
+
+	if r.config.MaxDelay <= 0 {
+		r.config.MaxDelay = defaultMaxDelay
+	}
+
+	if r.config.DeadLetters == nil {
+		r.logger.Info("no dead letter sink detected, dead letters will only be logged")
+		r.config.DeadLetters = NewLogDeadLetterSink()
+	}
+
+	return r
+}
+
+// Respond acknowledges msg given the error from writing its metrics.
+func (r *responder) Respond(msg *nsq.Message, err error) {
+	if err == nil {
+		msg.Finish()
+		return
+	}
+
+	logger := r.logger.WithFields(log.Fields{
+		"attempts": msg.Attempts,
+		"error":    err.Error(),
+	})
+
+	if IsRetryable(err) && msg.Attempts < r.config.MaxAttempts {
+		delay := r.Delay(msg.Attempts)
+		logger.Warnf("requeueing message in %s", delay)
+		msg.RequeueWithoutBackoff(delay)
+		return
+	}
+
+	r.DeadLetter(msg, err.Error())
+}
+
+// DeadLetter diverts msg to the dead letter sink with reason attached and finishes it.
+func (r *responder) DeadLetter(msg *nsq.Message, reason string) {
+	letter := &pb.DeadLetter{
+		Body:      msg.Body,
+		Reason:    reason,
+		Attempts:  int32(msg.Attempts),
+		Timestamp: opsee_types.NewTimestamp(time.Now()),
+	}
+
+	if err := r.config.DeadLetters.Put(letter); err != nil {
+		// keep the message around rather than losing it
+		r.logger.WithError(err).Error("failed to store dead letter, requeueing")
+		msg.RequeueWithoutBackoff(deadLetterRetryWait)
+		return
+	}
+
+	r.logger.WithFields(log.Fields{
+		"attempts": msg.Attempts,
+		"reason":   reason,
+	}).Warn("message diverted to dead letters")
+	msg.Finish()
+}
+
+// Delay is the exponential backoff before the given attempt is retried.
+func (r *responder) Delay(attempts uint16) time.Duration {
+	return backoff(r.config.BaseDelay, r.config.MaxDelay, attempts)
+}
+
+// backoff doubles base for each attempt after the first, up to max.
+func backoff(base, max time.Duration, attempts uint16) time.Duration {
+	exp := uint(0)
+	if attempts > 1 {
+		exp = uint(attempts - 1)
+	}
+	if exp > maxBackoffExponent {
+		exp = maxBackoffExponent
+	}
+
+	delay := base * time.Duration(1<<exp)
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
@@ -0,0 +1,146 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/opsee/marktricks/pb"
+	"github.com/opsee/marktricks/store"
+)
+
+// messageLog records how messages were acknowledged.
+type messageLog []string
+
+func (l *messageLog) OnFinish(m *nsq.Message) {
+	*l = append(*l, "finish")
+}
+
+func (l *messageLog) OnRequeue(m *nsq.Message, delay time.Duration, backoff bool) {
+	*l = append(*l, fmt.Sprintf("requeue %s", delay))
+}
+
+func (l *messageLog) OnTouch(m *nsq.Message) {}
+
+type deadLetterFunc func(letter *pb.DeadLetter) error
+
+func (f deadLetterFunc) Put(letter *pb.DeadLetter) error {
+	return f(letter)
+}
+
+func TestRespond(t *testing.T) {
+	errDeadLetters := errors.New("dead letters unavailable")
+
+	tests := []struct {
+		name          string
+		attempts      uint16
+		err           error
+		deadLetterErr error
+		want          []string
+		wantLetter    string
+	}{
+		{name: "written", attempts: 1, want: []string{"finish"}},
+		{name: "retryable", attempts: 1, err: errUnavailable, want: []string{"requeue 1s"}},
+		{name: "backed off", attempts: 3, err: &url.Error{Op: "Post", Err: errors.New("refused")}, want: []string{"requeue 4s"}},
+		{name: "capped delay", attempts: 9, err: &net.OpError{Op: "dial", Err: errors.New("refused")}, want: []string{"requeue 1m0s"}},
+		{name: "out of attempts", attempts: 10, err: errUnavailable, want: []string{"finish"}, wantLetter: errUnavailable.Error()},
+		{name: "permanent", attempts: 1, err: errRejected, want: []string{"finish"}, wantLetter: errRejected.Error()},
+		{name: "invalid", attempts: 1, err: errors.New("no timestamp"), want: []string{"finish"}, wantLetter: "no timestamp"},
+		{
+			name:          "dead letters unavailable",
+			attempts:      1,
+			err:           errRejected,
+			deadLetterErr: errDeadLetters,
+			want:          []string{"requeue 1m0s"},
+			wantLetter:    errRejected.Error(),
+		},
+	}
+
+	for _, test := range tests {
+		var letters []*pb.DeadLetter
+		r := NewResponder(&ResponderConfig{
+			BaseDelay: time.Second,
+			MaxDelay:  time.Minute,
+			DeadLetters: deadLetterFunc(func(letter *pb.DeadLetter) error {
+				letters = append(letters, letter)
+				return test.deadLetterErr
+			}),
+		})
+
+		var acks messageLog
+		msg := nsq.NewMessage(nsq.MessageID{}, []byte("result"))
+		msg.Attempts = test.attempts
+		msg.Delegate = &acks
+
+		r.Respond(msg, test.err)
+		if !reflect.DeepEqual([]string(acks), test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, acks, test.want)
+		}
+
+		if test.wantLetter == "" {
+			if len(letters) != 0 {
+				t.Errorf("%s: got dead letters %v, want none", test.name, letters)
+			}
+			continue
+		}
+		if len(letters) != 1 {
+			t.Errorf("%s: got %d dead letters, want 1", test.name, len(letters))
+			continue
+		}
+		letter := letters[0]
+		if letter.Reason != test.wantLetter || string(letter.Body) != "result" || letter.Attempts != int32(test.attempts) || letter.Timestamp == nil {
+			t.Errorf("%s: got dead letter %+v, want the message with reason %q", test.name, letter, test.wantLetter)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts uint16
+		want     time.Duration
+	}{
+		{0, time.Second},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{5, 16 * time.Second},
+		{7, time.Minute},
+		{1000, time.Minute},
+	}
+
+	for _, test := range tests {
+		if got := backoff(time.Second, time.Minute, test.attempts); got != test.want {
+			t.Errorf("attempt %d: got %s, want %s", test.attempts, got, test.want)
+		}
+	}
+
+	if got, want := backoff(time.Second, time.Duration(1<<62), 1000), time.Second<<maxBackoffExponent; got != want {
+		t.Errorf("got %s past the max exponent, want %s", got, want)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errUnavailable, true},
+		{&store.StatusError{StatusCode: 429}, true},
+		{&store.StatusError{StatusCode: 408}, true},
+		{errRejected, false},
+		{&url.Error{Op: "Post", Err: errors.New("refused")}, true},
+		{&net.OpError{Op: "dial", Err: errors.New("refused")}, true},
+		{errors.New("invalid metric"), false},
+	}
+
+	for _, test := range tests {
+		if got := IsRetryable(test.err); got != test.want {
+			t.Errorf("%v: got retryable %t, want %t", test.err, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package worker
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/gogo/protobuf/jsonpb"
+	"github.com/opsee/basic/schema"
+)
+
+const (
+	// ResultsDelimited is check results framed like WriteDelimited.
+	ResultsDelimited = "delimited"
+	// ResultsJSON is one jsonpb encoded check result per line.
+	ResultsJSON = "json"
+)
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// ReadResults calls fn with each check result read from r, in format. r is
+// decompressed first if it is gzipped.
+func ReadResults(r io.Reader, format string, fn func(*schema.CheckResult) error) error {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		br = bufio.NewReader(gz)
+	}
+
+	switch format {
+	case ResultsDelimited:
+		for {
+			result := &schema.CheckResult{}
+			err := ReadDelimited(br, result)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			if err := fn(result); err != nil {
+				return err
+			}
+		}
+
+	case ResultsJSON:
+		for line := 1; ; line++ {
+			b, err := br.ReadBytes('\n')
+			if len(bytes.TrimSpace(b)) > 0 {
+				result := &schema.CheckResult{}
+				if err := jsonpb.Unmarshal(bytes.NewReader(b), result); err != nil {
+					return fmt.Errorf("line %d: %s", line, err)
+				}
+
+				if err := fn(result); err != nil {
+					return err
+				}
+			}
+
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return fmt.Errorf("unknown results format: %s", format)
+}
@@ -0,0 +1,76 @@
+package worker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	builder "github.com/dan-compton/go-kairosdb/builder"
+)
+
+type RetentionConfig struct {
+	// Default is how long points are kept for customers without an override,
+	// zero keeps them forever.
+	Default time.Duration
+	// Customers overrides Default by customer id.
+	Customers map[string]time.Duration
+	// CustomerTag is the tag a point's customer is read from.
+	CustomerTag string
+}
+
+// retentionPolicy sets how long each customer's points are kept, enforced by
+// kairosdb through datapoint TTLs.
+type retentionPolicy struct {
+	config *RetentionConfig
+}
+
+func NewRetentionPolicy(config *RetentionConfig) *retentionPolicy {
+	p := &retentionPolicy{
+		config: config,
+	}
+
+	if p.config.CustomerTag == "" {
+		p.config.CustomerTag = defaultCustomerTag
+	}
+
+	return p
+}
+
+// Retention returns how long customerID's points are kept, zero is forever.
+func (p *retentionPolicy) Retention(customerID string) time.Duration {
+	if r, ok := p.config.Customers[customerID]; ok {
+		return r
+	}
+	return p.config.Default
+}
+
+// Apply sets the TTL of each metric to its customer's retention.
+func (p *retentionPolicy) Apply(metrics []builder.Metric) {
+	for _, m := range metrics {
+		r := p.Retention(m.GetTags()[p.config.CustomerTag])
+		if r <= 0 {
+			continue
+		}
+
+		ttl := int64(r / time.Second)
+		if ttl < 1 {
+			ttl = 1
+		}
+		m.AddTTL(ttl)
+	}
+}
+
+// ParseRetention parses a duration as time.ParseDuration does, with a d
+// suffix for days, e.g. 90d.
+func ParseRetention(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || days < 0 {
+			return 0, fmt.Errorf("invalid retention: %s", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,350 @@
+package worker
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	builder "github.com/dan-compton/go-kairosdb/builder"
+	log "github.com/opsee/logrus"
+)
+
+const (
+	segmentExt            = ".spool"
+	defaultSegmentBytes   = 8 << 20
+	defaultSpoolMaxBytes  = 1 << 30
+	defaultSpoolMaxAge    = 24 * time.Hour
+	maxSpooledBatchLength = 64 << 20
+)
+
+var errReplayStopped = errors.New("spool replay stopped")
+
+type SpoolConfig struct {
+	Dir          string
+	MaxBytes     int64
+	MaxAge       time.Duration
+	SegmentBytes int64
+}
+
+// spool is an append-only, on-disk queue of metric batches for when kairosdb
+// can't take writes. Batches are appended as json lines to segment files named
+// by creation time, and replayed oldest segment first. The oldest segments are
+// dropped when the spool grows past MaxBytes or they are older than MaxAge.
+type spool struct {
+	config  *SpoolConfig
+	mut     *sync.Mutex
+	current *os.File
+	size    int64
+	logger  *log.Entry
+}
+
+// spooledMetric mirrors the json kairosdb's builder emits for a metric.
+type spooledMetric struct {
+	Name       string              `json:"name"`
+	Type       string              `json:"type,omitempty"`
+	Tags       map[string]string   `json:"tags,omitempty"`
+	DataPoints []builder.DataPoint `json:"datapoints,omitempty"`
+	TTL        int64               `json:"ttl,omitempty"`
+}
+
+func NewSpool(config *SpoolConfig) (*spool, error) {
+	s := &spool{
+		config: config,
+		mut:    &sync.Mutex{},
+		logger: log.WithField("spool", config.Dir),
+	}
+
+	if s.config.MaxBytes <= 0 {
+		s.config.MaxBytes = defaultSpoolMaxBytes
+	}
+
+	if s.config.MaxAge <= 0 {
+		s.config.MaxAge = defaultSpoolMaxAge
+	}
+
+	if s.config.SegmentBytes <= 0 {
+		s.config.SegmentBytes = defaultSegmentBytes
+	}
+
+	if err := os.MkdirAll(s.config.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	segments, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, seg := range segments {
+		s.size += seg.size
+	}
+
+	if len(segments) > 0 {
+		s.logger.Infof("found %d spooled segments (%d bytes) to replay", len(segments), s.size)
+	}
+
+	return s, nil
+}
+
+// Append durably writes a batch of metrics to the spool.
+func (s *spool) Append(metrics []builder.Metric) error {
+	b, err := json.Marshal(metrics)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if s.current == nil {
+		name := filepath.Join(s.config.Dir, fmt.Sprintf("%020d%s", time.Now().UnixNano(), segmentExt))
+		s.current, err = os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := s.current.Write(b); err != nil {
+		return err
+	}
+
+	if err := s.current.Sync(); err != nil {
+		return err
+	}
+
+	s.size += int64(len(b))
+
+	if fi, err := s.current.Stat(); err == nil && fi.Size() >= s.config.SegmentBytes {
+		s.rotate()
+	}
+
+	s.enforceBounds()
+
+	return nil
+}
+
+// Replay pushes spooled batches in the order they were appended, removing each
+// segment once all of its batches have been pushed. It stops at the first push
+// error, leaving that segment to be replayed from its start next time; kairosdb
+// overwrites identical datapoints so re-pushing a batch is harmless. Closing
+// stop ends the replay before the next batch, with errReplayStopped.
+func (s *spool) Replay(push func([]builder.Metric) error, stop <-chan struct{}) error {
+	s.mut.Lock()
+	s.rotate()
+	segments, err := s.segments()
+	s.mut.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, seg := range segments {
+		if err := s.replaySegment(seg.path, push, stop); err != nil {
+			if os.IsNotExist(err) {
+				// dropped by enforceBounds while we were replaying
+				continue
+			}
+			return err
+		}
+
+		s.mut.Lock()
+		s.remove(seg)
+		s.mut.Unlock()
+	}
+
+	return nil
+}
+
+// Depth returns the number of spooled segments and bytes waiting to be replayed.
+func (s *spool) Depth() (int, int64) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	segments, err := s.segments()
+	if err != nil {
+		s.logger.WithError(err).Error("failed to list spool segments")
+	}
+	return len(segments), s.size
+}
+
+func (s *spool) Close() error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if s.current == nil {
+		return nil
+	}
+
+	err := s.current.Close()
+	s.current = nil
+	return err
+}
+
+func (s *spool) replaySegment(path string, push func([]builder.Metric) error, stop <-chan struct{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxSpooledBatchLength)
+	for scanner.Scan() {
+		select {
+		case <-stop:
+			return errReplayStopped
+		default:
+		}
+
+		metrics, err := decodeMetrics(scanner.Bytes())
+		if err != nil {
+			// most likely a torn write from a crash
+			s.logger.WithError(err).Errorf("skipping corrupt batch in %s", path)
+			continue
+		}
+
+		if err := push(metrics); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+func decodeMetrics(b []byte) ([]builder.Metric, error) {
+	var spooled []spooledMetric
+	if err := json.Unmarshal(b, &spooled); err != nil {
+		return nil, err
+	}
+
+	metrics := make([]builder.Metric, 0, len(spooled))
+	for _, sm := range spooled {
+		m := builder.NewMetric(sm.Name)
+		if sm.Type != "" {
+			m.AddType(sm.Type)
+		}
+		if sm.TTL > 0 {
+			m.AddTTL(sm.TTL)
+		}
+		for k, v := range sm.Tags {
+			m.AddTag(k, v)
+		}
+		for _, dp := range sm.DataPoints {
+			m.AddDataPoint(dp.Timestamp(), dataPointValue(dp))
+		}
+		metrics = append(metrics, m)
+	}
+
+	return metrics, nil
+}
+
+func dataPointValue(dp builder.DataPoint) interface{} {
+	if v, err := dp.Float64Value(); err == nil {
+		return v
+	}
+	if v, err := dp.Int64Value(); err == nil {
+		return v
+	}
+	return nil
+}
+
+type segment struct {
+	path    string
+	created time.Time
+	size    int64
+}
+
+// segments lists closed and open segments, oldest first.
+func (s *spool) segments() ([]*segment, error) {
+	infos, err := ioutil.ReadDir(s.config.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []*segment
+	for _, fi := range infos {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), segmentExt) {
+			continue
+		}
+
+		nanos, err := strconv.ParseInt(strings.TrimSuffix(fi.Name(), segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		segments = append(segments, &segment{
+			path:    filepath.Join(s.config.Dir, fi.Name()),
+			created: time.Unix(0, nanos),
+			size:    fi.Size(),
+		})
+	}
+
+	sort.Sort(segmentsByAge(segments))
+	return segments, nil
+}
+
+// rotate closes the current segment so the next Append starts a new one. The
+// caller must hold s.mut.
+func (s *spool) rotate() {
+	if s.current == nil {
+		return
+	}
+
+	if err := s.current.Close(); err != nil {
+		s.logger.WithError(err).Error("failed to close spool segment")
+	}
+	s.current = nil
+}
+
+// enforceBounds drops the oldest segments while the spool is too large, and any
+// segment older than MaxAge. The caller must hold s.mut.
+func (s *spool) enforceBounds() {
+	segments, err := s.segments()
+	if err != nil {
+		s.logger.WithError(err).Error("failed to list spool segments")
+		return
+	}
+
+	for _, seg := range segments {
+		if s.size <= s.config.MaxBytes && time.Since(seg.created) <= s.config.MaxAge {
+			break
+		}
+
+		if s.current != nil && s.current.Name() == seg.path {
+			s.rotate()
+		}
+
+		s.logger.Warnf("dropping spool segment %s (%d bytes)", seg.path, seg.size)
+		s.remove(seg)
+	}
+}
+
+// remove deletes a segment. The caller must hold s.mut.
+func (s *spool) remove(seg *segment) {
+	if err := os.Remove(seg.path); err != nil {
+		if !os.IsNotExist(err) {
+			s.logger.WithError(err).Errorf("failed to remove spool segment %s", seg.path)
+		}
+		return
+	}
+
+	s.size -= seg.size
+	if s.size < 0 {
+		s.size = 0
+	}
+}
+
+type segmentsByAge []*segment
+
+func (s segmentsByAge) Len() int           { return len(s) }
+func (s segmentsByAge) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s segmentsByAge) Less(i, j int) bool { return s[i].created.Before(s[j].created) }
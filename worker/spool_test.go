@@ -0,0 +1,168 @@
+package worker
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	builder "github.com/dan-compton/go-kairosdb/builder"
+)
+
+// batchOf makes a batch with a point of each named metric.
+func batchOf(names ...string) []builder.Metric {
+	metrics := make([]builder.Metric, 0, len(names))
+	for i, name := range names {
+		metrics = append(metrics, builder.NewMetric(name).AddTag("customer", "customer-1").AddDataPoint(testTime.UnixNano()/1e6, i))
+	}
+	return metrics
+}
+
+// names lists the metrics of batches in order.
+func names(batches ...[]builder.Metric) []string {
+	var out []string
+	for _, batch := range batches {
+		for _, m := range batch {
+			out = append(out, m.GetName())
+		}
+	}
+	return out
+}
+
+func testSpool(t *testing.T, segmentBytes int64) (*spool, func()) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSpool(&SpoolConfig{Dir: dir, SegmentBytes: segmentBytes})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return s, func() { os.RemoveAll(dir) }
+}
+
+func TestSpoolRoundTrip(t *testing.T) {
+	for _, segmentBytes := range []int64{1, defaultSegmentBytes} {
+		s, cleanup := testSpool(t, segmentBytes)
+		defer cleanup()
+
+		batches := [][]builder.Metric{batchOf("a", "b"), batchOf("c"), batchOf("d", "e", "f")}
+		for _, batch := range batches {
+			if err := s.Append(batch); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// a restarted worker picks up the spool
+		s, err := NewSpool(s.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantSegments := 1
+		if segmentBytes == 1 {
+			wantSegments = len(batches)
+		}
+		if segments, size := s.Depth(); segments != wantSegments || size == 0 {
+			t.Errorf("segment bytes %d: got %d segments of %d bytes, want %d segments", segmentBytes, segments, size, wantSegments)
+		}
+
+		var replayed [][]builder.Metric
+		err = s.Replay(func(metrics []builder.Metric) error {
+			replayed = append(replayed, metrics)
+			return nil
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := names(replayed...), names(batches...); !reflect.DeepEqual(got, want) {
+			t.Errorf("segment bytes %d: replayed %q, want %q", segmentBytes, got, want)
+		}
+		if got, want := describe(flatten(replayed)), describe(flatten(batches)); !reflect.DeepEqual(got, want) {
+			t.Errorf("segment bytes %d: replayed %q, want %q", segmentBytes, got, want)
+		}
+		if segments, size := s.Depth(); segments != 0 || size != 0 {
+			t.Errorf("segment bytes %d: left %d segments of %d bytes after replay", segmentBytes, segments, size)
+		}
+	}
+}
+
+func TestSpoolReplayFailure(t *testing.T) {
+	s, cleanup := testSpool(t, 1)
+	defer cleanup()
+
+	for _, batch := range [][]builder.Metric{batchOf("a"), batchOf("b"), batchOf("c")} {
+		if err := s.Append(batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	errPush := errors.New("push failed")
+	var replayed [][]builder.Metric
+	err := s.Replay(func(metrics []builder.Metric) error {
+		if metrics[0].GetName() == "b" {
+			return errPush
+		}
+		replayed = append(replayed, metrics)
+		return nil
+	}, nil)
+	if err != errPush {
+		t.Errorf("got error %v, want %v", err, errPush)
+	}
+	if segments, _ := s.Depth(); segments != 2 {
+		t.Errorf("got %d segments, want the failed one and the rest kept", segments)
+	}
+
+	err = s.Replay(func(metrics []builder.Metric) error {
+		replayed = append(replayed, metrics)
+		return nil
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := names(replayed...), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed %q, want %q", got, want)
+	}
+}
+
+func TestSpoolReplayStop(t *testing.T) {
+	s, cleanup := testSpool(t, defaultSegmentBytes)
+	defer cleanup()
+
+	for _, batch := range [][]builder.Metric{batchOf("a"), batchOf("b"), batchOf("c")} {
+		if err := s.Append(batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stop := make(chan struct{})
+	var replayed [][]builder.Metric
+	err := s.Replay(func(metrics []builder.Metric) error {
+		replayed = append(replayed, metrics)
+		close(stop)
+		return nil
+	}, stop)
+	if err != errReplayStopped {
+		t.Errorf("got error %v, want %v", err, errReplayStopped)
+	}
+	if got, want := names(replayed...), []string{"a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed %q, want %q", got, want)
+	}
+	if segments, _ := s.Depth(); segments != 1 {
+		t.Errorf("got %d segments, want the stopped segment kept", segments)
+	}
+}
+
+func flatten(batches [][]builder.Metric) []builder.Metric {
+	var metrics []builder.Metric
+	for _, batch := range batches {
+		metrics = append(metrics, batch...)
+	}
+	return metrics
+}
@@ -0,0 +1,255 @@
+package worker
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	builder "github.com/dan-compton/go-kairosdb/builder"
+	"github.com/opsee/basic/schema"
+)
+
+// TagRule maps the first non-empty of Fields to the series tag Tag, after
+// applying each of Normalize in order. A point missing a Required tag is
+// rejected.
+//
+// Fields are one of result.{check_id,customer_id,check_name,bastion_id,region},
+// result.target.{id,name,type,address} for the check's target or
+// response.target.{id,name,type,address} for the target of the response a
+// point came from. Normalize is one of lowercase, truncate:<n> or hash.
+type TagRule struct {
+	Tag       string   `mapstructure:"tag"`
+	Fields    []string `mapstructure:"fields"`
+	Normalize []string `mapstructure:"normalize"`
+	Required  bool     `mapstructure:"required"`
+}
+
+// DefaultTagRules is the tag set marktricks has always written.
+func DefaultTagRules() []*TagRule {
+	return []*TagRule{
+		{Tag: "check", Fields: []string{"result.check_id"}, Required: true},
+		{Tag: "customer", Fields: []string{"result.customer_id"}, Required: true},
+		{Tag: "target", Fields: []string{"response.target.id", "result.target.id"}},
+		{Tag: "target_name", Fields: []string{"response.target.name", "result.target.name"}},
+		{Tag: "target_type", Fields: []string{"response.target.type", "result.target.type"}},
+		{Tag: "target_addr", Fields: []string{"response.target.address"}},
+		{Tag: "region", Fields: []string{"result.region"}},
+	}
+}
+
+type fieldFunc func(result *schema.CheckResult, resp *schema.CheckResponse) string
+
+var tagFields = map[string]fieldFunc{
+	"result.check_id":    func(r *schema.CheckResult, _ *schema.CheckResponse) string { return r.CheckId },
+	"result.customer_id": func(r *schema.CheckResult, _ *schema.CheckResponse) string { return r.CustomerId },
+	"result.check_name":  func(r *schema.CheckResult, _ *schema.CheckResponse) string { return r.CheckName },
+	"result.bastion_id":  func(r *schema.CheckResult, _ *schema.CheckResponse) string { return r.BastionId },
+	"result.region":      func(r *schema.CheckResult, _ *schema.CheckResponse) string { return r.Region },
+
+	"result.target.id":      resultTarget(func(t *schema.Target) string { return t.Id }),
+	"result.target.name":    resultTarget(func(t *schema.Target) string { return t.Name }),
+	"result.target.type":    resultTarget(func(t *schema.Target) string { return t.Type }),
+	"result.target.address": resultTarget(func(t *schema.Target) string { return t.Address }),
+
+	"response.target.id":      responseTarget(func(t *schema.Target) string { return t.Id }),
+	"response.target.name":    responseTarget(func(t *schema.Target) string { return t.Name }),
+	"response.target.type":    responseTarget(func(t *schema.Target) string { return t.Type }),
+	"response.target.address": responseTarget(func(t *schema.Target) string { return t.Address }),
+}
+
+func resultTarget(get func(*schema.Target) string) fieldFunc {
+	return func(result *schema.CheckResult, _ *schema.CheckResponse) string {
+		if result.Target == nil {
+			return ""
+		}
+		return get(result.Target)
+	}
+}
+
+func responseTarget(get func(*schema.Target) string) fieldFunc {
+	return func(_ *schema.CheckResult, resp *schema.CheckResponse) string {
+		if resp == nil || resp.Target == nil {
+			return ""
+		}
+		return get(resp.Target)
+	}
+}
+
+type normalizeFunc func(string) string
+
+func parseNormalizer(spec string) (normalizeFunc, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	switch parts[0] {
+	case "lowercase":
+		return strings.ToLower, nil
+
+	case "hash":
+		return func(v string) string {
+			sum := sha1.Sum([]byte(v))
+			return hex.EncodeToString(sum[:])
+		}, nil
+
+	case "truncate":
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("truncate needs a length, e.g. truncate:64")
+		}
+		n, err := strconv.Atoi(parts[1])
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid truncate length: %s", parts[1])
+		}
+		return func(v string) string {
+			if len(v) > n {
+				return v[:n]
+			}
+			return v
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown normalizer: %s", spec)
+}
+
+type tagMapping struct {
+	tag        string
+	fields     []fieldFunc
+	normalizes []normalizeFunc
+	required   bool
+}
+
+// tagMapper builds series tags from check results according to TagRules.
+type tagMapper struct {
+	mappings []*tagMapping
+}
+
+func NewTagMapper(rules []*TagRule) (*tagMapper, error) {
+	m := &tagMapper{}
+	seen := make(map[string]bool)
+
+	for _, rule := range rules {
+		if rule.Tag == "" {
+			return nil, fmt.Errorf("tag rule missing tag name")
+		}
+		if seen[rule.Tag] {
+			return nil, fmt.Errorf("duplicate tag rule for %s", rule.Tag)
+		}
+		seen[rule.Tag] = true
+
+		if len(rule.Fields) == 0 {
+			return nil, fmt.Errorf("tag rule %s has no fields", rule.Tag)
+		}
+
+		mapping := &tagMapping{
+			tag:      rule.Tag,
+			required: rule.Required,
+		}
+
+		for _, field := range rule.Fields {
+			f, ok := tagFields[field]
+			if !ok {
+				return nil, fmt.Errorf("tag rule %s: unknown field %s", rule.Tag, field)
+			}
+			mapping.fields = append(mapping.fields, f)
+		}
+
+		for _, spec := range rule.Normalize {
+			n, err := parseNormalizer(spec)
+			if err != nil {
+				return nil, fmt.Errorf("tag rule %s: %s", rule.Tag, err)
+			}
+			mapping.normalizes = append(mapping.normalizes, n)
+		}
+
+		m.mappings = append(m.mappings, mapping)
+	}
+
+	return m, nil
+}
+
+// Tags returns the non-empty series tags for points from resp, or for points
+// describing the result as a whole if resp is nil.
+func (m *tagMapper) Tags(result *schema.CheckResult, resp *schema.CheckResponse) (map[string]string, error) {
+	return m.tags(result, resp, true)
+}
+
+// ScopeTags returns the tags of metrics reported on behalf of scope, as Tags
+// does for a result as a whole. A scope needn't be a check, so only the
+// customer tag is required.
+func (m *tagMapper) ScopeTags(scope *schema.CheckResult, customerTag string) (map[string]string, error) {
+	tags, err := m.tags(scope, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	if tags[customerTag] == "" {
+		return nil, fmt.Errorf("missing required tag %s", customerTag)
+	}
+	return tags, nil
+}
+
+// tags maps the tags of result and resp, failing on missing required ones
+// only if required is set.
+func (m *tagMapper) tags(result *schema.CheckResult, resp *schema.CheckResponse, required bool) (map[string]string, error) {
+	tags := make(map[string]string, len(m.mappings))
+
+	for _, mapping := range m.mappings {
+		var value string
+		for _, f := range mapping.fields {
+			if value = f(result, resp); value != "" {
+				break
+			}
+		}
+
+		// checked before normalizing, which could make something of nothing,
+		// e.g. hash
+		if value == "" {
+			if required && mapping.required {
+				return nil, fmt.Errorf("missing required tag %s", mapping.tag)
+			}
+			continue
+		}
+
+		for _, n := range mapping.normalizes {
+			value = n(value)
+		}
+
+		tags[mapping.tag] = value
+	}
+
+	return tags, nil
+}
+
+// Required returns the names of the tags every point must have.
+func (m *tagMapper) Required() []string {
+	var required []string
+	for _, mapping := range m.mappings {
+		if mapping.required {
+			required = append(required, mapping.tag)
+		}
+	}
+	return required
+}
+
+// addTags adds the non-empty tags to the metric and returns the number of tags added.
+func addTags(nm builder.Metric, tags map[string]string) int {
+	vtags := 0
+	for k, v := range tags {
+		if len(v) > 0 {
+			vtags += 1
+			nm.AddTag(k, v)
+		}
+	}
+	return vtags
+}
+
+// addMetricTags merges a metric's own tags into its series tags. A metric's tags
+// never clobber the check/customer tags.
+func addMetricTags(nm builder.Metric, tags map[string]string, metricTags []*schema.Tag) {
+	for _, tag := range metricTags {
+		if _, ok := tags[tag.Name]; ok {
+			continue
+		}
+		if tag.Name != "" && tag.Value != "" {
+			nm.AddTag(tag.Name, tag.Value)
+		}
+	}
+}
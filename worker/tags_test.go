@@ -0,0 +1,76 @@
+package worker
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/opsee/basic/schema"
+)
+
+func TestTagMapperTags(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   []*TagRule
+		result  *schema.CheckResult
+		resp    *schema.CheckResponse
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:   "defaults",
+			rules:  DefaultTagRules(),
+			result: &schema.CheckResult{CheckId: "check-1", CustomerId: "customer-1", Target: &schema.Target{Id: "sg-1", Name: "web"}},
+			resp:   &schema.CheckResponse{Target: &schema.Target{Id: "i-1", Address: "10.0.0.1"}},
+			want:   map[string]string{"check": "check-1", "customer": "customer-1", "target": "i-1", "target_name": "web", "target_addr": "10.0.0.1"},
+		},
+		{
+			name:   "result as a whole",
+			rules:  DefaultTagRules(),
+			result: &schema.CheckResult{CheckId: "check-1", CustomerId: "customer-1", Target: &schema.Target{Id: "sg-1"}},
+			want:   map[string]string{"check": "check-1", "customer": "customer-1", "target": "sg-1"},
+		},
+		{
+			name: "normalized",
+			rules: []*TagRule{
+				{Tag: "name", Fields: []string{"result.check_name"}, Normalize: []string{"lowercase", "truncate:5"}},
+				{Tag: "bastion", Fields: []string{"result.bastion_id"}, Normalize: []string{"hash"}},
+			},
+			result: &schema.CheckResult{CheckName: "Web Frontend", BastionId: "b"},
+			want:   map[string]string{"name": "web f", "bastion": "e9d71f5ee7c92d6dc9e92ffdad17b8bd49418f98"},
+		},
+		{
+			name:   "empty values aren't normalized",
+			rules:  []*TagRule{{Tag: "bastion", Fields: []string{"result.bastion_id"}, Normalize: []string{"hash"}}},
+			result: &schema.CheckResult{},
+			want:   map[string]string{},
+		},
+		{
+			name:    "missing required",
+			rules:   DefaultTagRules(),
+			result:  &schema.CheckResult{CheckId: "check-1"},
+			wantErr: true,
+		},
+		{
+			name:    "missing required with a normalizer",
+			rules:   []*TagRule{{Tag: "customer", Fields: []string{"result.customer_id"}, Normalize: []string{"hash"}, Required: true}},
+			result:  &schema.CheckResult{},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		mapper, err := NewTagMapper(test.rules)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		tags, err := mapper.Tags(test.result, test.resp)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %t", test.name, err, test.wantErr)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(tags, test.want) {
+			t.Errorf("%s: got tags %v, want %v", test.name, tags, test.want)
+		}
+	}
+}
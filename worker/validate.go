@@ -0,0 +1,37 @@
+package worker
+
+import (
+	"errors"
+
+	"github.com/opsee/basic/schema"
+)
+
+var (
+	ErrMissingCustomerId = errors.New("missing customer_id")
+	ErrMissingCheckId    = errors.New("missing check_id")
+	ErrMissingTimestamp  = errors.New("missing timestamp")
+	ErrMissingTarget     = errors.New("check response missing target")
+)
+
+// ValidateResult returns why a check result can't be ingested, or nil if it can.
+func ValidateResult(result *schema.CheckResult) error {
+	if result.CustomerId == "" {
+		return ErrMissingCustomerId
+	}
+
+	if result.CheckId == "" {
+		return ErrMissingCheckId
+	}
+
+	if result.Timestamp == nil {
+		return ErrMissingTimestamp
+	}
+
+	for _, resp := range result.Responses {
+		if resp == nil || resp.Target == nil {
+			return ErrMissingTarget
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,302 @@
+package worker
+
+import (
+	"sync/atomic"
+	"time"
+
+	builder "github.com/dan-compton/go-kairosdb/builder"
+	log "github.com/opsee/logrus"
+	"github.com/opsee/marktricks/store"
+)
+
+const (
+	defaultBatchSize        = 500
+	defaultFlushInterval    = time.Second
+	defaultSlowThreshold    = 10 * time.Second
+	defaultRecoveryInterval = 10 * time.Second
+)
+
+type batchItem struct {
+	metrics []builder.Metric
+	done    func(error)
+}
+
+// batchWriter accumulates metrics from many check results and pushes them to
+// the store in a single request once BatchSize metrics are pending or
+// FlushInterval has elapsed. Each item's done func is called with the result
+// of the push that included it.
+//
+// If a Spool is configured, batches are spooled to disk instead of failing
+// while the store is down or slower than SlowThreshold, and replayed once it
+// reports healthy again.
+type batchWriter struct {
+	config            *BatchWriterConfig
+	store             store.Store
+	itemChan          chan *batchItem
+	stopChan          chan struct{}
+	stoppedChan       chan struct{}
+	replayStopChan    chan struct{}
+	replayStoppedChan chan struct{}
+	pending           []*batchItem
+	pendingSize       int
+	degraded          int32
+	logger            *log.Entry
+}
+
+type BatchWriterConfig struct {
+	BatchSize        int
+	FlushInterval    time.Duration
+	Spool            *spool
+	SlowThreshold    time.Duration
+	RecoveryInterval time.Duration
+}
+
+func NewBatchWriter(st store.Store, config *BatchWriterConfig) *batchWriter {
+	w := &batchWriter{
+		config:      config,
+		store:       st,
+		stopChan:    make(chan struct{}, 1),
+		stoppedChan: make(chan struct{}, 1),
+		logger:      log.WithField("writer", "batch"),
+
+		replayStopChan:    make(chan struct{}),
+		replayStoppedChan: make(chan struct{}),
+	}
+
+	if w.config.BatchSize <= 0 {
+		w.logger.Infof("no batch size config detected, setting to %d", defaultBatchSize)
+		w.config.BatchSize = defaultBatchSize
+	}
+
+	if w.config.FlushInterval <= 0 {
+		w.logger.Infof("no flush interval config detected, setting to %s", defaultFlushInterval)
+		w.config.FlushInterval = defaultFlushInterval
+	}
+
+	if w.config.SlowThreshold <= 0 {
+		w.config.SlowThreshold = defaultSlowThreshold
+	}
+
+	if w.config.RecoveryInterval <= 0 {
+		w.config.RecoveryInterval = defaultRecoveryInterval
+	}
+
+	w.itemChan = make(chan *batchItem, w.config.BatchSize)
+
+	return w
+}
+
+func (w *batchWriter) Start() {
+	go w.run()
+
+	if w.config.Spool != nil {
+		go w.replay()
+	}
+}
+
+// Write queues metrics for the next batch. done is called exactly once, after
+// the batch containing the metrics has been acknowledged or has failed.
+func (w *batchWriter) Write(metrics []builder.Metric, done func(error)) {
+	w.itemChan <- &batchItem{metrics: metrics, done: done}
+}
+
+// Stop flushes pending metrics and waits up to timeout for the final push,
+// and for any spool replay to stop after its current batch. Items written
+// after Stop is called are never acknowledged.
+func (w *batchWriter) Stop(timeout time.Duration) error {
+	w.logger.Info("stopping")
+	deadline := time.After(timeout)
+
+	w.stopChan <- struct{}{}
+	if w.config.Spool != nil {
+		close(w.replayStopChan)
+	}
+
+	select {
+	case <-w.stoppedChan:
+	case <-deadline:
+		w.logger.Warn("timed out flushing pending metrics")
+		return errStopTimeout
+	}
+
+	if w.config.Spool != nil {
+		select {
+		case <-w.replayStoppedChan:
+		case <-deadline:
+			w.logger.Warn("timed out waiting for spool replay")
+			return errStopTimeout
+		}
+
+		if err := w.config.Spool.Close(); err != nil {
+			w.logger.WithError(err).Error("failed to close spool")
+		}
+	}
+
+	w.logger.Info("stopped")
+	return nil
+}
+
+func (w *batchWriter) run() {
+	ticker := time.NewTicker(w.config.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case item := <-w.itemChan:
+			w.add(item)
+
+		case <-ticker.C:
+			w.flush()
+
+		case <-w.stopChan:
+			// drain whatever was queued before stopping
+			for len(w.itemChan) > 0 {
+				w.add(<-w.itemChan)
+			}
+			w.flush()
+			w.stoppedChan <- struct{}{}
+			return
+		}
+	}
+}
+
+func (w *batchWriter) add(item *batchItem) {
+	w.pending = append(w.pending, item)
+	w.pendingSize += len(item.metrics)
+	if w.pendingSize >= w.config.BatchSize {
+		w.flush()
+	}
+}
+
+func (w *batchWriter) flush() {
+	if len(w.pending) == 0 {
+		return
+	}
+
+	defer func() {
+		w.pending = nil
+		w.pendingSize = 0
+	}()
+
+	// don't bother the store until it's healthy again
+	if w.isDegraded() && w.spoolPending() {
+		return
+	}
+
+	start := time.Now()
+	err := w.push(w.pending...)
+	if err != nil {
+		w.logger.WithError(err).Errorf("failed to push batch of %d metrics", w.pendingSize)
+	} else {
+		w.logger.Debugf("pushed batch of %d metrics", w.pendingSize)
+	}
+
+	if w.config.Spool != nil && time.Since(start) > w.config.SlowThreshold {
+		w.logger.Warnf("push took %s, spooling until it recovers", time.Since(start))
+		w.setDegraded(true)
+	}
+
+	if IsRetryable(err) && w.spoolPending() {
+		w.setDegraded(true)
+		return
+	}
+
+	if err != nil && !IsRetryable(err) && len(w.pending) > 1 {
+		// the store rejects the whole batch, push items one at a time so only
+		// the offending ones fail
+		for _, item := range w.pending {
+			item.done(w.push(item))
+		}
+	} else {
+		for _, item := range w.pending {
+			item.done(err)
+		}
+	}
+}
+
+// spoolPending appends the pending batch to the spool and acknowledges its
+// items. It returns false if there is no spool or it couldn't be written.
+func (w *batchWriter) spoolPending() bool {
+	if w.config.Spool == nil {
+		return false
+	}
+
+	var metrics []builder.Metric
+	for _, item := range w.pending {
+		metrics = append(metrics, item.metrics...)
+	}
+
+	if err := w.config.Spool.Append(metrics); err != nil {
+		w.logger.WithError(err).Error("failed to spool batch")
+		return false
+	}
+
+	for _, item := range w.pending {
+		item.done(nil)
+	}
+
+	return true
+}
+
+// replay periodically checks the store's health while degraded, and replays the
+// spool once it is healthy.
+func (w *batchWriter) replay() {
+	ticker := time.NewTicker(w.config.RecoveryInterval)
+	defer ticker.Stop()
+	defer close(w.replayStoppedChan)
+
+	for {
+		select {
+		case <-ticker.C:
+			segments, _ := w.config.Spool.Depth()
+			if !w.isDegraded() && segments == 0 {
+				continue
+			}
+
+			if err := w.store.Healthy(); err != nil {
+				w.logger.Debug("store is still unhealthy")
+				continue
+			}
+
+			w.logger.Infof("store is healthy, replaying %d spooled segments", segments)
+			err := w.config.Spool.Replay(w.pushMetrics, w.replayStopChan)
+			if err == errReplayStopped {
+				w.logger.Info("stopped replaying spool, the rest is replayed on restart")
+				return
+			}
+			if err != nil {
+				w.logger.WithError(err).Error("failed to replay spool")
+				continue
+			}
+
+			w.setDegraded(false)
+
+		case <-w.replayStopChan:
+			return
+		}
+	}
+}
+
+func (w *batchWriter) isDegraded() bool {
+	return atomic.LoadInt32(&w.degraded) == 1
+}
+
+func (w *batchWriter) setDegraded(degraded bool) {
+	if degraded {
+		atomic.StoreInt32(&w.degraded, 1)
+	} else {
+		atomic.StoreInt32(&w.degraded, 0)
+	}
+}
+
+func (w *batchWriter) push(items ...*batchItem) error {
+	var metrics []builder.Metric
+	for _, item := range items {
+		metrics = append(metrics, item.metrics...)
+	}
+	return w.pushMetrics(metrics)
+}
+
+func (w *batchWriter) pushMetrics(metrics []builder.Metric) error {
+	return w.store.Write(metrics)
+}
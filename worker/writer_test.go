@@ -0,0 +1,210 @@
+package worker
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	builder "github.com/dan-compton/go-kairosdb/builder"
+)
+
+// writeItems writes each batch as its own item and returns their outcomes,
+// in the same order, once all of them are done.
+func writeItems(t *testing.T, w Writer, batches ...[]builder.Metric) []error {
+	errs := make([]error, len(batches))
+	var wg sync.WaitGroup
+	for i, batch := range batches {
+		i := i
+		wg.Add(1)
+		w.Write(batch, func(err error) {
+			errs[i] = err
+			wg.Done()
+		})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for writes")
+	}
+	return errs
+}
+
+func TestBatchWriterSplitsRejectedBatch(t *testing.T) {
+	st := &fakeStore{fail: func(metrics []builder.Metric) error {
+		for _, m := range metrics {
+			if m.GetName() == "bad" {
+				return errRejected
+			}
+		}
+		return nil
+	}}
+
+	w := NewBatchWriter(st, &BatchWriterConfig{BatchSize: 4, FlushInterval: time.Hour})
+	w.Start()
+	defer w.Stop(time.Second)
+
+	errs := writeItems(t, w, batchOf("a"), batchOf("bad", "b"), batchOf("c"))
+	if want := []error{nil, errRejected, nil}; !reflect.DeepEqual(errs, want) {
+		t.Errorf("got errors %v, want only the item with a bad metric failed", errs)
+	}
+	if got, want := names(st.batches...), []string{"a", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("wrote %q, want %q", got, want)
+	}
+}
+
+func TestBatchWriterSpoolsWhileDown(t *testing.T) {
+	s, cleanup := testSpool(t, 1)
+	defer cleanup()
+
+	st := &fakeStore{
+		fail:    func([]builder.Metric) error { return errUnavailable },
+		healthy: errUnavailable,
+	}
+	w := NewBatchWriter(st, &BatchWriterConfig{
+		BatchSize:        1,
+		FlushInterval:    time.Hour,
+		Spool:            s,
+		RecoveryInterval: 5 * time.Millisecond,
+	})
+	w.Start()
+	defer w.Stop(time.Second)
+
+	// spooled batches are acknowledged, and the store is left alone until
+	// it is healthy
+	errs := writeItems(t, w, batchOf("a"), batchOf("b"), batchOf("c"))
+	if want := []error{nil, nil, nil}; !reflect.DeepEqual(errs, want) {
+		t.Errorf("got errors %v while spooling", errs)
+	}
+	if segments, _ := s.Depth(); segments != 3 {
+		t.Errorf("got %d spooled segments, want 3", segments)
+	}
+
+	st.mut.Lock()
+	st.fail, st.healthy = nil, nil
+	st.mut.Unlock()
+
+	waitFor(t, "the spool to replay", func() bool { return st.written() == 3 })
+	if got, want := names(st.batches...), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed %q, want %q", got, want)
+	}
+	waitFor(t, "the writer to recover", func() bool { return !w.isDegraded() })
+
+	if errs := writeItems(t, w, batchOf("d")); errs[0] != nil {
+		t.Fatal(errs[0])
+	}
+	if got, want := names(st.batches...), []string{"a", "b", "c", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("wrote %q, want %q", got, want)
+	}
+}
+
+func TestBatchWriterStopStopsReplay(t *testing.T) {
+	s, cleanup := testSpool(t, 1)
+	defer cleanup()
+	for _, batch := range [][]builder.Metric{batchOf("a"), batchOf("b"), batchOf("c")} {
+		if err := s.Append(batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pushing := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	st := &fakeStore{fail: func([]builder.Metric) error {
+		once.Do(func() { close(pushing) })
+		<-release
+		return nil
+	}}
+	w := NewBatchWriter(st, &BatchWriterConfig{Spool: s, RecoveryInterval: 5 * time.Millisecond})
+	w.Start()
+	<-pushing
+
+	if err := w.Stop(10 * time.Millisecond); err != errStopTimeout {
+		t.Errorf("got %v stopping during a stuck push, want %v", err, errStopTimeout)
+	}
+
+	// the replay stops after the push it's stuck in
+	close(release)
+	select {
+	case <-w.replayStoppedChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("replay kept running after stop")
+	}
+	if got, want := names(st.batches...), []string{"a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed %q after stop, want %q", got, want)
+	}
+	if segments, _ := s.Depth(); segments != 2 {
+		t.Errorf("got %d spooled segments, want 2 left to replay on restart", segments)
+	}
+}
+
+func TestBatchWriterFlushesOnSize(t *testing.T) {
+	st := &fakeStore{}
+	w := NewBatchWriter(st, &BatchWriterConfig{BatchSize: 3, FlushInterval: time.Hour})
+	w.Start()
+
+	// items are acknowledged once the batch they filled is written
+	errs := writeItems(t, w, batchOf("a", "b"), batchOf("c"))
+	if want := []error{nil, nil}; !reflect.DeepEqual(errs, want) {
+		t.Errorf("got errors %v", errs)
+	}
+	if got, want := len(st.batches), 1; got != want {
+		t.Errorf("got %d batches, want %d", got, want)
+	}
+
+	done := make(chan error, 1)
+	w.Write(batchOf("d"), func(err error) { done <- err })
+	if err := w.Stop(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// the rest is flushed on stop
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	default:
+		t.Error("pending item wasn't flushed on stop")
+	}
+	if got, want := names(st.batches...), []string{"a", "b", "c", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("wrote %q, want %q", got, want)
+	}
+	if got, want := len(st.batches), 2; got != want {
+		t.Errorf("got %d batches, want %d", got, want)
+	}
+}
+
+func TestBatchWriterFlushesOnInterval(t *testing.T) {
+	st := &fakeStore{}
+	w := NewBatchWriter(st, &BatchWriterConfig{BatchSize: 100, FlushInterval: 5 * time.Millisecond})
+	w.Start()
+	defer w.Stop(time.Second)
+
+	errs := writeItems(t, w, batchOf("a"), batchOf("b", "c"))
+	if want := []error{nil, nil}; !reflect.DeepEqual(errs, want) {
+		t.Errorf("got errors %v", errs)
+	}
+	if got, want := names(st.batches...), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("wrote %q, want %q", got, want)
+	}
+}
+
+func TestBatchWriterFailure(t *testing.T) {
+	st := &fakeStore{fail: func([]builder.Metric) error { return errUnavailable }}
+	w := NewBatchWriter(st, &BatchWriterConfig{BatchSize: 3, FlushInterval: time.Hour})
+	w.Start()
+	defer w.Stop(time.Second)
+
+	// without a spool, every item of the batch fails for nsq to retry
+	errs := writeItems(t, w, batchOf("a", "b"), batchOf("c"))
+	if want := []error{errUnavailable, errUnavailable}; !reflect.DeepEqual(errs, want) {
+		t.Errorf("got errors %v, want %v", errs, want)
+	}
+}